@@ -0,0 +1,32 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrClosed is returned once the backplane is closed
+var ErrClosed = errors.New("backplane closed")
+
+// Handler receives the messages published on a subscribed channel
+type Handler func(channel string, data []byte)
+
+// Backplane carries messages between the nodes running the socket service, and keeps the short lived values
+// they share
+type Backplane interface {
+	// Publish sends the data to every subscriber of the channel, on every node
+	Publish(ctx context.Context, channel string, data []byte) error
+	// Subscribe delivers the messages of the channels to the handler, in publish order, until the backplane is closed
+	Subscribe(ctx context.Context, handler Handler, channels ...string) error
+	// SetNX stores the value under the key for the ttl unless the key is set, and tells if it stored it
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Replace replaces the value of a key that is set, keeping its expiry
+	Replace(ctx context.Context, key string, value []byte) error
+	// Get returns the value of the key, nil when it is not set. Reading a key does not extend its expiry.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// GetDel returns the value of the key and deletes it in one step, so only one caller on any node gets it,
+	// nil when it is not set
+	GetDel(ctx context.Context, key string) ([]byte, error)
+	Close() error
+}
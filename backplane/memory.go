@@ -0,0 +1,147 @@
+package backplane
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// size of the queue of every subscriber of the in-process backplane
+const memoryQueueSize = 1024
+
+type memoryMessage struct {
+	channel string
+	data    []byte
+}
+
+type memorySubscriber struct {
+	handler Handler
+	queue   chan memoryMessage
+}
+
+type memoryBackplane struct {
+	mu          sync.RWMutex
+	closed      bool
+	subscribers map[string][]*memorySubscriber
+	values      *ttlcache.Cache[string, []byte]
+	valuesMu    sync.Mutex
+	// closed by Close, stops the handler goroutines and the publishes waiting on a full queue
+	done     chan struct{}
+	handlers sync.WaitGroup
+}
+
+// NewMemoryBackplane is used to create a backplane within the process, for single node setups and tests
+func NewMemoryBackplane() Backplane {
+	values := ttlcache.New[string, []byte](ttlcache.WithDisableTouchOnHit[string, []byte]())
+	go values.Start()
+	return &memoryBackplane{
+		subscribers: make(map[string][]*memorySubscriber),
+		values:      values,
+		done:        make(chan struct{}),
+	}
+}
+
+// Publish waits for room in the queue of a slow subscriber without holding the lock, so subscribes and Close
+// are not held up by it
+func (b *memoryBackplane) Publish(ctx context.Context, channel string, data []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrClosed
+	}
+	subscribers := append([]*memorySubscriber(nil), b.subscribers[channel]...)
+	b.mu.RUnlock()
+
+	msg := memoryMessage{channel: channel, data: append([]byte(nil), data...)}
+	for _, s := range subscribers {
+		select {
+		case s.queue <- msg:
+		case <-b.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Subscribe(ctx context.Context, handler Handler, channels ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	s := &memorySubscriber{handler: handler, queue: make(chan memoryMessage, memoryQueueSize)}
+	for _, channel := range channels {
+		b.subscribers[channel] = append(b.subscribers[channel], s)
+	}
+	b.handlers.Add(1)
+	go func() {
+		defer b.handlers.Done()
+		for {
+			select {
+			case msg := <-s.queue:
+				s.handler(msg.channel, msg.data)
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *memoryBackplane) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	b.valuesMu.Lock()
+	defer b.valuesMu.Unlock()
+	_, loaded := b.values.GetOrSet(key, append([]byte(nil), value...), ttlcache.WithTTL[string, []byte](ttl))
+	return !loaded, nil
+}
+
+func (b *memoryBackplane) Replace(ctx context.Context, key string, value []byte) error {
+	b.valuesMu.Lock()
+	defer b.valuesMu.Unlock()
+	item := b.values.Get(key)
+	if item == nil {
+		return nil
+	}
+	if ttl := time.Until(item.ExpiresAt()); ttl > 0 {
+		b.values.Set(key, append([]byte(nil), value...), ttl)
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Get(ctx context.Context, key string) ([]byte, error) {
+	if item := b.values.Get(key); item != nil {
+		return item.Value(), nil
+	}
+	return nil, nil
+}
+
+func (b *memoryBackplane) GetDel(ctx context.Context, key string) ([]byte, error) {
+	b.valuesMu.Lock()
+	defer b.valuesMu.Unlock()
+	item := b.values.Get(key)
+	if item == nil {
+		return nil, nil
+	}
+	b.values.Delete(key)
+	return item.Value(), nil
+}
+
+// Close returns once every handler returned, it must not be called from a handler
+func (b *memoryBackplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.values.Stop()
+	close(b.done)
+	b.subscribers = nil
+	b.mu.Unlock()
+	b.handlers.Wait()
+	return nil
+}
@@ -0,0 +1,88 @@
+package backplane
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryCloseWaitsForHandlers(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackplane()
+	started := make(chan struct{})
+	var done atomic.Bool
+	err := b.Subscribe(ctx, func(channel string, data []byte) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		done.Store(true)
+	}, "a")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := b.Publish(ctx, "a", []byte("1")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	<-started
+	b.Close()
+	if !done.Load() {
+		t.Error("close returned while a handler was running")
+	}
+	if err := b.Publish(ctx, "a", []byte("2")); err != ErrClosed {
+		t.Errorf("publish after close: err = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestMemoryPublishFullQueue(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackplane()
+	block := make(chan struct{})
+	if err := b.Subscribe(ctx, func(channel string, data []byte) { <-block }, "slow"); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	// the handler holds one message, the queue the others
+	for i := 0; i <= memoryQueueSize; i++ {
+		if err := b.Publish(ctx, "slow", nil); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+
+	published := make(chan error, 1)
+	go func() { published <- b.Publish(ctx, "slow", nil) }()
+	// a publish waiting on the full queue holds up neither subscribes nor close
+	subscribed := make(chan error, 1)
+	go func() { subscribed <- b.Subscribe(ctx, func(string, []byte) {}, "other") }()
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscribe held up by a publish to a full queue")
+	}
+	close(block)
+	b.Close()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish to a full queue outlived close")
+	}
+}
+
+func TestMemoryGetDel(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackplane()
+	t.Cleanup(func() { b.Close() })
+	if _, err := b.SetNX(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if got, err := b.GetDel(ctx, "k"); err != nil || string(got) != "v" {
+		t.Fatalf("first get del = %q %v, want v", got, err)
+	}
+	if got, err := b.GetDel(ctx, "k"); err != nil || got != nil {
+		t.Errorf("second get del = %q %v, want nothing", got, err)
+	}
+	if got, _ := b.Get(ctx, "k"); got != nil {
+		t.Errorf("get = %q after get del", got)
+	}
+}
@@ -0,0 +1,116 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+type redisBackplane struct {
+	client redis.UniversalClient
+	mu     sync.Mutex
+	subs   []*redis.PubSub
+}
+
+// NewRedisBackplane is used to create a backplane on the redis server or cluster configured under name in database.yml,
+// a cluster is used when more than one address is configured
+func NewRedisBackplane(ctx context.Context, name string) (Backplane, error) {
+	dbConfig, err := configs.Get(constant.DatabaseConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := dbConfig.Sub(name)
+	if serverConfig == nil {
+		return nil, fmt.Errorf("database config %s not found", name)
+	}
+	redisConfig := models.RedisClusterConfig{Name: name}
+	if err := serverConfig.Unmarshal(&redisConfig); err != nil {
+		return nil, err
+	}
+	if len(redisConfig.Addresses) == 0 {
+		return nil, fmt.Errorf("no addresses in redis config %s", name)
+	}
+	for i, address := range redisConfig.Addresses {
+		redisConfig.Addresses[i] = configs.GetStringWithEnv(address)
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    redisConfig.Addresses,
+		Username: configs.GetStringWithEnv(serverConfig.GetString(constant.DatabaseUsernameConfigKey)),
+		Password: configs.GetStringWithEnv(serverConfig.GetString(constant.DatabasePasswordConfigKey)),
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisBackplane{client: client}, nil
+}
+
+func (b *redisBackplane) Publish(ctx context.Context, channel string, data []byte) error {
+	return b.client.Publish(ctx, channel, data).Err()
+}
+
+func (b *redisBackplane) Subscribe(ctx context.Context, handler Handler, channels ...string) error {
+	sub := b.client.Subscribe(ctx, channels...)
+	// wait for the subscription to be confirmed, so nothing published after this returns is missed
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range sub.Channel() {
+			handler(msg.Channel, []byte(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+func (b *redisBackplane) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (b *redisBackplane) Replace(ctx context.Context, key string, value []byte) error {
+	err := b.client.SetArgs(ctx, key, value, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+func (b *redisBackplane) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := b.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// GetDel needs redis 6.2 or later
+func (b *redisBackplane) GetDel(ctx context.Context, key string) ([]byte, error) {
+	value, err := b.client.GetDel(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (b *redisBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		sub.Close()
+	}
+	b.subs = nil
+	return b.client.Close()
+}
@@ -0,0 +1,223 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/store"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// number of messages a single ack can acknowledge, every one of them is a read and a write of the store
+const maxAckMessageIDs = 100
+
+// unackedMessage is a chat message written to a connection and not acked by its device yet
+type unackedMessage struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// track remembers the message until the device acks it
+func (c *Client) track(messageID string, data []byte) {
+	c.unackedMu.Lock()
+	defer c.unackedMu.Unlock()
+	c.unacked[messageID] = &unackedMessage{data: data, sentAt: time.Now(), attempts: 1}
+}
+
+func (c *Client) tracked(messageID string) bool {
+	c.unackedMu.Lock()
+	defer c.unackedMu.Unlock()
+	_, ok := c.unacked[messageID]
+	return ok
+}
+
+func (c *Client) untrack(messageID string) {
+	c.unackedMu.Lock()
+	defer c.unackedMu.Unlock()
+	delete(c.unacked, messageID)
+}
+
+// takeUnacked returns the ids of the messages still waiting for an ack and stops tracking them
+func (c *Client) takeUnacked() []string {
+	c.unackedMu.Lock()
+	defer c.unackedMu.Unlock()
+	ids := make([]string, 0, len(c.unacked))
+	for id := range c.unacked {
+		ids = append(ids, id)
+	}
+	c.unacked = make(map[string]*unackedMessage)
+	return ids
+}
+
+// retransmitDue sends again the messages whose ack timed out. After the configured number of attempts the
+// messages are put back in the offline queue, so the user gets them on the next connection.
+func (c *Client) retransmitDue(now time.Time) {
+	requeue(c, c.dueRetransmits(now))
+}
+
+// dueRetransmits queues again the messages whose ack timed out and returns the ones given up on
+func (c *Client) dueRetransmits(now time.Time) []string {
+	c.unackedMu.Lock()
+	defer c.unackedMu.Unlock()
+	var givenUp []string
+	for id, m := range c.unacked {
+		if now.Sub(m.sentAt) < settings.ackTimeout {
+			continue
+		}
+		if m.attempts > settings.maxRetransmits {
+			log.ApplicationWarn(c.ctx).Str("messageID", id).Int("attempts", m.attempts).Msg("giving up on unacked message")
+			delete(c.unacked, id)
+			givenUp = append(givenUp, id)
+			continue
+		}
+		if err := c.Send(constant.MessageTypeChatMessage, m.data); err != nil {
+			continue
+		}
+		m.sentAt = now
+		m.attempts++
+	}
+	return givenUp
+}
+
+// retransmitter periodically retransmits the unacked messages of every connection
+func (h *Hub) retransmitter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, c := range h.all() {
+			c.retransmitDue(now)
+		}
+	}
+}
+
+// deliverChatMessage writes the message to every connection of the recipient on every node and tracks it until acked.
+// It returns the number of connections of this node it was queued on plus the number of other nodes it was forwarded to.
+func deliverChatMessage(msg models.ChatMessage) (int, error) {
+	delivered, err := deliverChatMessageLocal(msg)
+	if err != nil {
+		return 0, err
+	}
+	if len(cluster.userNodes(msg.To)) == 0 {
+		return delivered, nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return delivered, err
+	}
+	return delivered + cluster.forward(&models.ClusterMessage{Kind: constant.ClusterKindChat, UserID: msg.To, Data: data}), nil
+}
+
+// deliverChatMessageLocal writes the message to the connections of the recipient on this node
+func deliverChatMessageLocal(msg models.ChatMessage) (int, error) {
+	env, err := NewEnvelope(constant.MessageTypeChatMessage, msg)
+	if err != nil {
+		return 0, err
+	}
+	clients, data, err := pushToUser(msg.To, env, msg.ID, "")
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range clients {
+		c.track(msg.ID, data)
+	}
+	return len(clients), nil
+}
+
+// requeueUnacked puts the messages the closed connection never acked back in the offline queue
+func requeueUnacked(c *Client) {
+	requeue(c, c.takeUnacked())
+}
+
+// requeue puts the messages of the connection back in the offline queue of its user, unless another device of the
+// user already acked them
+func requeue(c *Client, messageIDs []string) {
+	ctx := context.Background()
+	for _, id := range messageIDs {
+		msg, err := messageStore.Get(ctx, id)
+		if err != nil {
+			log.ApplicationError(c.ctx).Err(err).Str("messageID", id).Msg("error reading unacked message")
+			continue
+		}
+		if msg.Status != constant.MessageStatusSent {
+			continue
+		}
+		if err := messageStore.Enqueue(ctx, userKey(c.UserID), id); err != nil {
+			log.ApplicationError(c.ctx).Err(err).Str("messageID", id).Msg("error requeueing unacked message")
+		}
+	}
+}
+
+// handleAck records that messages reached a device of the recipient or were read, and tells the sender
+func handleAck(mc *MessageContext) error {
+	req := models.Ack{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	if req.Status != constant.MessageStatusDelivered && req.Status != constant.MessageStatusRead {
+		return NewProtocolError("ABP11004", errors.New("status should be delivered or read"))
+	}
+	if len(req.MessageIDs) == 0 {
+		return NewProtocolError("ABP11004", errors.New("message_ids are required"))
+	}
+	if len(req.MessageIDs) > maxAckMessageIDs {
+		return NewProtocolError("ABP11004", fmt.Errorf("at most %d message_ids per ack", maxAckMessageIDs))
+	}
+
+	user := userKey(mc.Client.UserID)
+	for _, id := range req.MessageIDs {
+		mc.Client.untrack(id)
+		msg, err := messageStore.Get(mc, id)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// only the recipient can ack a message
+		if userKey(msg.To) != user {
+			continue
+		}
+		changed, err := messageStore.SetStatus(mc, id, user, req.Status)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		sendReceipt(msg, req.Status)
+		activityType := constant.ActivityMessageDelivered
+		if req.Status == constant.MessageStatusRead {
+			activityType = constant.ActivityMessageRead
+		}
+		emitActivity(models.ActivityEvent{
+			Type:           activityType,
+			UserID:         msg.To,
+			DeviceID:       mc.Client.DeviceID,
+			MessageID:      msg.ID,
+			ConversationID: msg.ConversationID,
+			PeerID:         msg.From,
+		})
+	}
+	return nil
+}
+
+// sendReceipt pushes the new status of the message to the devices of its sender
+func sendReceipt(msg models.ChatMessage, status string) {
+	env, err := NewEnvelope(constant.MessageTypeReceipt, models.Receipt{
+		MessageID:      msg.ID,
+		ConversationID: msg.ConversationID,
+		UserID:         msg.To,
+		Status:         status,
+		At:             time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return
+	}
+	hub.SendEnvelopeToUser(msg.From, env)
+}
@@ -0,0 +1,116 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestRetransmitDue(t *testing.T) {
+	withMessageStore(t)
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.ackTimeout = time.Second
+	settings.maxRetransmits = 2
+
+	ctx := context.Background()
+	for _, id := range []string{"acked", "unacked"} {
+		if err := messageStore.Save(ctx, &models.ChatMessage{ID: id, ConversationID: conversationID("1", "2"), From: "1", To: "2"}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	// another device of the user acked this one
+	if _, err := messageStore.SetStatus(ctx, "acked", "2", constant.MessageStatusDelivered); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+
+	c := newTestClient("2", "parent")
+	c.track("acked", []byte(`{}`))
+	c.track("unacked", []byte(`{}`))
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		after       time.Duration
+		wantSent    int
+		wantTracked bool
+		wantQueued  []string
+	}{
+		{name: "within the ack timeout", after: 500 * time.Millisecond, wantTracked: true},
+		{name: "first retransmit", after: 2 * time.Second, wantSent: 2, wantTracked: true},
+		{name: "second retransmit", after: 4 * time.Second, wantSent: 2, wantTracked: true},
+		{name: "given up and queued unless acked", after: 6 * time.Second, wantQueued: []string{"unacked"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.retransmitDue(now.Add(tt.after))
+			if sent := len(c.send); sent != tt.wantSent {
+				t.Errorf("sent = %d, want %d", sent, tt.wantSent)
+			}
+			for len(c.send) > 0 {
+				<-c.send
+			}
+			if tracked := c.tracked("unacked"); tracked != tt.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, tt.wantTracked)
+			}
+			pending, err := messageStore.Pending(ctx, userKey("2"), 10)
+			if err != nil {
+				t.Fatalf("pending: %v", err)
+			}
+			var queued []string
+			for _, msg := range pending {
+				queued = append(queued, msg.ID)
+			}
+			if strings.Join(queued, ",") != strings.Join(tt.wantQueued, ",") {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestHandleAckLimit(t *testing.T) {
+	withMessageStore(t)
+
+	ids := func(n int) string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = fmt.Sprintf("%q", fmt.Sprintf("m%d", i))
+		}
+		return "[" + strings.Join(list, ",") + "]"
+	}
+	tests := []struct {
+		name     string
+		payload  string
+		wantCode string
+	}{
+		{name: "no ids", payload: `{"message_ids":[],"status":"read"}`, wantCode: "ABP11004"},
+		{name: "unknown status", payload: `{"message_ids":["m1"],"status":"sent"}`, wantCode: "ABP11004"},
+		{name: "at the limit", payload: `{"message_ids":` + ids(maxAckMessageIDs) + `,"status":"read"}`},
+		{name: "over the limit", payload: `{"message_ids":` + ids(maxAckMessageIDs+1) + `,"status":"read"}`, wantCode: "ABP11004"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &MessageContext{
+				Context: context.Background(),
+				Client:  newTestClient("2", "parent"),
+				Message: &models.Envelope{Type: constant.MessageTypeAck, Payload: json.RawMessage(tt.payload)},
+			}
+			err := handleAck(mc)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			if perr, ok := err.(*ProtocolError); !ok || perr.Code != tt.wantCode {
+				t.Fatalf("err = %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
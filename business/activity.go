@@ -0,0 +1,103 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/events"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// activity publishes the socket activity, nil when it is disabled
+var activity *events.Producer
+
+var activityTopic string
+
+// initActivity sets up the producer of the socket activity configured in application.yml
+func initActivity() error {
+	var publisher events.Publisher
+	switch producerType := configs.GetAppConfigD(constant.ActivityProducerKey, constant.ActivityProducerNone); producerType {
+	case constant.ActivityProducerNone:
+		return nil
+	case constant.ActivityProducerMemory:
+		publisher = eventBroker
+	case constant.ActivityProducerKafka:
+		producerConfig := models.KafkaProducerConfig{}
+		if err := configs.UnmarshalAppConfig(constant.ActivityKafkaKey, &producerConfig); err != nil {
+			return err
+		}
+		var err error
+		if publisher, err = events.NewKafkaProducerPublisher(producerConfig); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown activity producer %s", producerType)
+	}
+
+	activityTopic = configs.GetAppConfigD(constant.ActivityTopicKey, "ms-pet-socket-activity")
+	producer, err := events.NewProducer(publisher, events.ProducerConfig{
+		QueueSize:      configs.GetAppConfigIntD(constant.ActivityQueueSizeKey, 10000),
+		BatchSize:      configs.GetAppConfigIntD(constant.ActivityBatchSizeKey, 100),
+		Linger:         millis(configs.GetAppConfigIntD(constant.ActivityLingerInMillisKey, 500)),
+		BufferDir:      configs.GetAppConfigD(constant.ActivityBufferDirKey, "activity-buffer"),
+		BufferMaxBytes: int64(configs.GetAppConfigIntD(constant.ActivityBufferMaxBytesKey, 100<<20)),
+		RetryInterval:  millis(configs.GetAppConfigIntD(constant.ActivityRetryIntervalInMillisKey, 5000)),
+	})
+	if err != nil {
+		publisher.Close()
+		return err
+	}
+	activity = producer
+	return nil
+}
+
+// CloseActivity publishes the pending socket activity, buffering to disk what cannot make it before the deadline
+func CloseActivity(ctx context.Context) error {
+	if activity == nil {
+		return nil
+	}
+	return activity.Close(ctx)
+}
+
+// emitActivity stamps the event and queues it for publishing, it never blocks the caller
+func emitActivity(event models.ActivityEvent) {
+	if activity == nil {
+		return
+	}
+	event.SchemaVersion = models.ActivitySchemaVersion
+	event.EventID = uuid.New().String()
+	event.OccurredAt = time.Now().UnixMilli()
+	event.Node = cluster.id
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.ApplicationError(context.Background()).Err(err).Str("type", event.Type).Msg("error encoding activity event")
+		return
+	}
+	activity.Emit(events.Message{
+		Topic:   activityTopic,
+		Key:     []byte(userKey(event.UserID)),
+		Value:   data,
+		Headers: map[string]string{"type": event.Type},
+	})
+}
+
+// emitConnectionActivity publishes the opening or closing of the connection
+func emitConnectionActivity(c *Client, eventType string) {
+	event := models.ActivityEvent{
+		Type:         eventType,
+		UserID:       c.UserID,
+		DeviceID:     c.DeviceID,
+		ConnectionID: c.ID,
+		Actor:        c.Actor,
+	}
+	if eventType == constant.ActivityConnectionClosed {
+		event.DurationMs = time.Since(c.ConnectedAt).Milliseconds()
+	}
+	emitActivity(event)
+}
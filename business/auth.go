@@ -0,0 +1,146 @@
+package business
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const defaultAuthExpiryWarning = time.Minute
+
+// tokenExpiry warns the connection before its token expires and closes it when no fresh token came in time
+type tokenExpiry struct {
+	mu        sync.Mutex
+	expiresAt time.Time
+	warn      *time.Timer
+	expire    *time.Timer
+}
+
+// tokenExpiresAt returns the expiry of the token, zero when it does not expire
+func tokenExpiresAt(claims *models.JWTLoginToken) time.Time {
+	if claims == nil || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+// trackTokenExpiry replaces the deadline of the connection, a zero expiry stops tracking it
+func (c *Client) trackTokenExpiry(expiresAt time.Time) {
+	c.expiry.mu.Lock()
+	defer c.expiry.mu.Unlock()
+	c.expiry.stopLocked()
+	c.expiry.expiresAt = expiresAt
+	if expiresAt.IsZero() {
+		return
+	}
+	warning := millis(configs.GetAppConfigIntD(constant.AuthExpiryWarningInMillisKey, int(defaultAuthExpiryWarning.Milliseconds())))
+	// tokens already within the warning window are warned about right away
+	c.expiry.warn = time.AfterFunc(time.Until(expiresAt.Add(-warning)), func() { c.warnTokenExpiry(expiresAt) })
+	c.expiry.expire = time.AfterFunc(time.Until(expiresAt), func() { c.expireToken(expiresAt) })
+}
+
+func (c *Client) stopTokenExpiry() {
+	c.expiry.mu.Lock()
+	defer c.expiry.mu.Unlock()
+	c.expiry.stopLocked()
+}
+
+func (e *tokenExpiry) stopLocked() {
+	if e.warn != nil {
+		e.warn.Stop()
+	}
+	if e.expire != nil {
+		e.expire.Stop()
+	}
+}
+
+// current tells if the deadline is still the one of the token, the timers of a replaced token may fire late
+func (e *tokenExpiry) current(expiresAt time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.expiresAt.Equal(expiresAt)
+}
+
+func (c *Client) warnTokenExpiry(expiresAt time.Time) {
+	if !c.expiry.current(expiresAt) {
+		return
+	}
+	env, err := NewEnvelope(constant.MessageTypeAuthExpiring, models.AuthExpiring{ExpiresAt: expiresAt.UnixMilli()})
+	if err != nil {
+		return
+	}
+	c.SendEnvelope(env)
+}
+
+func (c *Client) expireToken(expiresAt time.Time) {
+	if !c.expiry.current(expiresAt) {
+		return
+	}
+	log.ApplicationInfo(c.ctx).Time("expiresAt", expiresAt).Msg("closing connection with expired token")
+	c.closeWithReason(websocket.ClosePolicyViolation, "token expired")
+	hub.Unregister(c)
+}
+
+// handleAuthRefresh moves the connection onto a fresh token of the same user, pushing back its deadline
+func handleAuthRefresh(mc *MessageContext) error {
+	req := models.AuthRefresh{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	claims, err := utils.DecodeUserTokenClaims(req.Token)
+	if err != nil {
+		return NewProtocolError("ABP11018", err)
+	}
+	if userKey(claims.UserData.UserID) != userKey(mc.Client.UserID) {
+		return NewProtocolError("ABP11019", errors.New(claims.UserData.UserID))
+	}
+	if !utils.IsBlank(claims.DeviceId) && claims.DeviceId != mc.Client.DeviceID {
+		return NewProtocolError("ABP11022", errors.New(claims.DeviceId))
+	}
+	// the actor is fixed for the life of the connection, the audit trail of the session names only one
+	if actor := tokenActor(claims); !strings.EqualFold(actor, mc.Client.Actor) {
+		return NewProtocolError("ABP11021", errors.New(actor))
+	}
+	if revoked(claims.Id, mc.Client.UserID, mc.Client.DeviceID, claims.IssuedAt) {
+		return NewProtocolError("ABP11020", errRevoked)
+	}
+	expiresAt := tokenExpiresAt(claims)
+	mc.Client.setToken(claims)
+	mc.Client.trackTokenExpiry(expiresAt)
+
+	resp := models.AuthRefreshed{}
+	if !expiresAt.IsZero() {
+		resp.ExpiresAt = expiresAt.UnixMilli()
+	}
+	return mc.Reply(constant.MessageTypeAuthRefreshed, resp)
+}
+
+// tokenActor returns the user acting as the user of the token, empty when the token is not an impersonation
+func tokenActor(claims *models.JWTLoginToken) string {
+	if claims == nil || claims.Act == nil {
+		return ""
+	}
+	return strings.TrimSpace(claims.Act.Subject)
+}
+
+// auditImpersonation records the start and the end of every session an actor opens as another user
+func auditImpersonation(c *Client, opened bool) {
+	if c.Actor == "" {
+		return
+	}
+	if opened {
+		log.AuditInfo(c.ctx).Str(constant.ActionLogParam, "impersonate").Str(constant.ConnectionLogParam, c.ID).
+			Str(constant.DeviceLogParam, c.DeviceID).Strs("scopes", c.Scopes()).Msg("impersonation session opened")
+		return
+	}
+	log.AuditInfo(c.ctx).Str(constant.ActionLogParam, "impersonate").Str(constant.ConnectionLogParam, c.ID).
+		Str(constant.DeviceLogParam, c.DeviceID).Int64("durationMs", time.Since(c.ConnectedAt).Milliseconds()).Msg("impersonation session closed")
+}
@@ -0,0 +1,173 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestTokenActor(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *models.JWTLoginToken
+		want   string
+	}{
+		{name: "no claims"},
+		{name: "no act claim", claims: &models.JWTLoginToken{}},
+		{name: "act claim", claims: &models.JWTLoginToken{TokenClaims: models.TokenClaims{Act: &models.Actor{Subject: " support-7 "}}},
+			want: "support-7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenActor(tt.claims); got != tt.want {
+				t.Errorf("actor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// signToken signs the claims with the jwt_key of the tests
+func signToken(t *testing.T, claims *models.JWTLoginToken) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return token
+}
+
+func TestHandleAuthRefresh(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	claims := func(userID, deviceID, tokenID string, expiresAt int64) *models.JWTLoginToken {
+		return &models.JWTLoginToken{
+			UserData:       models.TokenUserData{UserID: userID},
+			TokenClaims:    models.TokenClaims{UserType: "provider", DeviceId: deviceID},
+			StandardClaims: jwt.StandardClaims{Id: tokenID, ExpiresAt: expiresAt},
+		}
+	}
+	storeRevocation(models.Revocation{TokenID: "refresh-revoked", ExpiresAt: time.Now().Add(time.Hour).UnixMilli()})
+
+	tests := []struct {
+		name          string
+		userID        string // of the connection, 1 when empty
+		actor         string // of the connection
+		token         string
+		wantCode      string
+		wantExpiresAt int64
+	}{
+		{name: "fresh token", token: signToken(t, claims("1", "", "refresh-1", expiresAt)), wantExpiresAt: expiresAt * 1000},
+		{name: "user id matched without case", userID: "a1", token: signToken(t, claims("A1", "", "refresh-2", expiresAt)),
+			wantExpiresAt: expiresAt * 1000},
+		{name: "token without expiry", token: signToken(t, claims("1", "", "refresh-3", 0))},
+		{name: "unreadable token", token: "bogus", wantCode: "ABP11018"},
+		{name: "expired token", token: signToken(t, claims("1", "", "refresh-4", time.Now().Add(-time.Minute).Unix())), wantCode: "ABP11018"},
+		{name: "token of another user", token: signToken(t, claims("2", "", "refresh-5", expiresAt)), wantCode: "ABP11019"},
+		{name: "token of another device", token: signToken(t, claims("1", "tablet", "refresh-6", expiresAt)), wantCode: "ABP11022"},
+		{name: "plain token on an impersonation session", actor: "support-7", token: signToken(t, claims("1", "", "refresh-7", expiresAt)),
+			wantCode: "ABP11021"},
+		{name: "revoked token", token: signToken(t, claims("1", "", "refresh-revoked", expiresAt)), wantCode: "ABP11020"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := tt.userID
+			if userID == "" {
+				userID = "1"
+			}
+			c := newTestClient(userID, "parent")
+			c.Actor = tt.actor
+			t.Cleanup(c.stopTokenExpiry)
+			payload, _ := json.Marshal(models.AuthRefresh{Token: tt.token})
+			mc := &MessageContext{
+				Context: context.Background(),
+				Client:  c,
+				Message: &models.Envelope{Type: constant.MessageTypeAuthRefresh, ID: "r", Payload: payload},
+			}
+			err := handleAuthRefresh(mc)
+			if tt.wantCode != "" {
+				if perr, ok := err.(*ProtocolError); !ok || perr.Code != tt.wantCode {
+					t.Fatalf("err = %v, want %s", err, tt.wantCode)
+				}
+				if c.UserType() != "parent" {
+					t.Errorf("user type = %s, the refused token was applied", c.UserType())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			env := nextFrame(t, c)
+			refreshed := models.AuthRefreshed{}
+			if err := json.Unmarshal(env.Payload, &refreshed); err != nil || env.Type != constant.MessageTypeAuthRefreshed {
+				t.Fatalf("reply %s %v, want %s", env.Type, err, constant.MessageTypeAuthRefreshed)
+			}
+			if refreshed.ExpiresAt != tt.wantExpiresAt {
+				t.Errorf("expires at = %d, want %d", refreshed.ExpiresAt, tt.wantExpiresAt)
+			}
+			if c.UserType() != "provider" || c.TokenID() == "" {
+				t.Errorf("user type %s token id %s, want the claims of the fresh token", c.UserType(), c.TokenID())
+			}
+		})
+	}
+}
+
+func TestClientTokenExpiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		expiresIn   time.Duration // zero for a token without expiry
+		refreshedIn time.Duration // expiry of the token sent with auth.refresh, zero when none is sent
+		wantWarning bool
+		wantClosed  bool
+	}{
+		{name: "expired without refresh", expiresIn: 100 * time.Millisecond, wantWarning: true, wantClosed: true},
+		{name: "refreshed in time", expiresIn: 100 * time.Millisecond, refreshedIn: time.Hour, wantWarning: true},
+		{name: "token without expiry", wantWarning: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", "parent")
+			peer := withSocket(t, c)
+			t.Cleanup(c.stopTokenExpiry)
+			var expiresAt time.Time
+			if tt.expiresIn > 0 {
+				expiresAt = time.Now().Add(tt.expiresIn)
+			}
+			// within the default warning window, the warning goes out right away
+			c.trackTokenExpiry(expiresAt)
+			if tt.wantWarning {
+				env := nextFrame(t, c)
+				warning := models.AuthExpiring{}
+				if err := json.Unmarshal(env.Payload, &warning); err != nil || env.Type != constant.MessageTypeAuthExpiring {
+					t.Fatalf("frame %s %v, want %s", env.Type, err, constant.MessageTypeAuthExpiring)
+				}
+				if warning.ExpiresAt != expiresAt.UnixMilli() {
+					t.Errorf("warned of expiry at %d, want %d", warning.ExpiresAt, expiresAt.UnixMilli())
+				}
+			}
+			if tt.refreshedIn > 0 {
+				c.trackTokenExpiry(time.Now().Add(tt.refreshedIn))
+			}
+
+			time.Sleep(tt.expiresIn + 200*time.Millisecond)
+			if c.closed() != tt.wantClosed {
+				t.Fatalf("closed = %v, want %v", c.closed(), tt.wantClosed)
+			}
+			if !tt.wantClosed {
+				if len(c.send) > 0 {
+					t.Errorf("%d frames queued, want none", len(c.send))
+				}
+				return
+			}
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err := peer.ReadMessage()
+			if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "token expired" {
+				t.Errorf("peer got %v, want a policy violation close for the expired token", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// authorizer checks the message types and topics used by the connections against the authorization policy
+type authorizer struct {
+	policy models.AuthzPolicy
+}
+
+// without a policy in application.yml every message type and subscription is allowed
+var authz = &authorizer{policy: models.AuthzPolicy{DefaultAction: constant.AuthzAllow}}
+
+// initAuthorization loads the authorization policy of application.yml
+func initAuthorization() error {
+	policy := models.AuthzPolicy{DefaultAction: constant.AuthzAllow}
+	if err := configs.UnmarshalAppConfig(constant.AuthorizationPolicyKey, &policy); err != nil {
+		return err
+	}
+	switch policy.DefaultAction {
+	case constant.AuthzAllow, constant.AuthzDeny:
+	default:
+		return fmt.Errorf("unknown default action %s", policy.DefaultAction)
+	}
+	for i, rule := range policy.Topics {
+		if err := validTopic(strings.ReplaceAll(rule.Pattern, constant.AuthzUserIDPlaceholder, "user"), true); err != nil {
+			return fmt.Errorf("topic rule %d: %v", i, err)
+		}
+		for _, action := range rule.Actions {
+			if action != constant.AuthzActionSubscribe && action != constant.AuthzActionPublish {
+				return fmt.Errorf("topic rule %d: unknown action %s", i, action)
+			}
+		}
+	}
+	authz = &authorizer{policy: policy}
+	return nil
+}
+
+// authorizeMessage checks the connection may send the message type
+func (a *authorizer) authorizeMessage(ctx context.Context, c *Client, msgType string) error {
+	matched := false
+	for _, rule := range a.policy.Messages {
+		if !contains(rule.Types, msgType) {
+			continue
+		}
+		matched = true
+		if granted(c, rule.UserTypes, rule.Scopes) {
+			return nil
+		}
+	}
+	if !matched && a.policy.DefaultAction == constant.AuthzAllow {
+		return nil
+	}
+	a.audit(ctx, c, constant.AuthzActionSend, msgType)
+	return NewProtocolError("ABP11016", errors.New(msgType))
+}
+
+// authorizeTopic checks the connection may subscribe to the topic pattern or publish to the topic
+func (a *authorizer) authorizeTopic(ctx context.Context, c *Client, action, topic string) error {
+	matched := false
+	for _, rule := range a.policy.Topics {
+		if !contains(rule.Actions, action) {
+			continue
+		}
+		if !patternCovers(strings.ReplaceAll(rule.Pattern, constant.AuthzUserIDPlaceholder, c.UserID), topic) {
+			continue
+		}
+		matched = true
+		if granted(c, rule.UserTypes, rule.Scopes) {
+			return nil
+		}
+	}
+	if !matched && action == constant.AuthzActionSubscribe && a.policy.DefaultAction == constant.AuthzAllow {
+		return nil
+	}
+	a.audit(ctx, c, action, topic)
+	return NewProtocolError("ABP11015", errors.New(topic))
+}
+
+// audit logs the denied action to the audit log
+func (a *authorizer) audit(ctx context.Context, c *Client, action, target string) {
+	log.AuditWarn(ctx).Str(constant.ActionLogParam, action).Str("target", target).Str("userType", c.UserType()).
+		Strs("scopes", c.Scopes()).Str(constant.DeviceLogParam, c.DeviceID).Msg("action denied")
+}
+
+// granted tells if the connection is of one of the user types and holds every scope, empty lists do not restrict
+func granted(c *Client, userTypes, scopes []string) bool {
+	if len(userTypes) > 0 && !containsFold(userTypes, c.UserType()) {
+		return false
+	}
+	clientScopes := c.Scopes()
+	for _, scope := range scopes {
+		if !contains(clientScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// patternCovers tells if every topic matched by the topic, itself possibly a pattern, is matched by the pattern
+func patternCovers(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, constant.TopicSeparator)
+	topicSegments := strings.Split(topic, constant.TopicSeparator)
+	for i, segment := range patternSegments {
+		if segment == constant.TopicWildcardRest && i == len(patternSegments)-1 {
+			return len(topicSegments) > i
+		}
+		if i >= len(topicSegments) {
+			return false
+		}
+		switch {
+		case segment == constant.TopicWildcard && topicSegments[i] != constant.TopicWildcardRest:
+		case segment != topicSegments[i]:
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
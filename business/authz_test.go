@@ -0,0 +1,114 @@
+package business
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestAuthorizeMessage(t *testing.T) {
+	rules := []models.MessageRule{
+		{Types: []string{"chat.send"}, UserTypes: []string{"parent", "provider"}, Scopes: []string{"chat.write"}},
+		{Types: []string{"slots.update"}, UserTypes: []string{"provider"}},
+		// a second rule of the same type grants it to the holders of the scope whatever their user type
+		{Types: []string{"slots.update"}, Scopes: []string{"slots.admin"}},
+		{Types: []string{"user.kick"}, Scopes: []string{"admin", "user.write"}},
+	}
+
+	tests := []struct {
+		name          string
+		defaultAction string
+		userType      string
+		scopes        []string
+		msgType       string
+		allowed       bool
+	}{
+		{name: "user type and scope of the rule", userType: "parent", scopes: []string{"chat.write"}, msgType: "chat.send", allowed: true},
+		{name: "scope missing", userType: "parent", msgType: "chat.send"},
+		{name: "user type not in the rule", userType: "admin", scopes: []string{"chat.write"}, msgType: "chat.send"},
+		{name: "user type matched without case", userType: "PROVIDER", scopes: []string{"chat.write"}, msgType: "chat.send", allowed: true},
+		{name: "rule without scopes", userType: "provider", msgType: "slots.update", allowed: true},
+		{name: "granted by another rule", userType: "parent", scopes: []string{"slots.admin"}, msgType: "slots.update", allowed: true},
+		{name: "denied by every rule", userType: "parent", scopes: []string{"chat.write"}, msgType: "slots.update"},
+		{name: "every scope of the rule", scopes: []string{"user.write", "admin"}, msgType: "user.kick", allowed: true},
+		{name: "one scope of the rule", scopes: []string{"admin"}, msgType: "user.kick"},
+		{name: "type without rule allowed by default", defaultAction: constant.AuthzAllow, userType: "parent", msgType: "presence.set", allowed: true},
+		{name: "type without rule denied by default", defaultAction: constant.AuthzDeny, userType: "parent", msgType: "presence.set"},
+		{name: "default does not widen a rule", defaultAction: constant.AuthzAllow, userType: "parent", msgType: "user.kick"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultAction := tt.defaultAction
+			if defaultAction == "" {
+				defaultAction = constant.AuthzDeny
+			}
+			a := &authorizer{policy: models.AuthzPolicy{DefaultAction: defaultAction, Messages: rules}}
+			c := newTestClient("1", tt.userType, tt.scopes...)
+			err := a.authorizeMessage(context.Background(), c, tt.msgType)
+			if (err == nil) != tt.allowed {
+				t.Fatalf("err = %v, allowed %v", err, tt.allowed)
+			}
+			if perr, ok := err.(*ProtocolError); err != nil && (!ok || perr.Code != "ABP11016") {
+				t.Errorf("err = %v, want ABP11016", err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTopic(t *testing.T) {
+	withPolicy(t, models.AuthzPolicy{
+		DefaultAction: constant.AuthzAllow,
+		Topics: []models.TopicRule{
+			{Pattern: "provider:*:slots", Actions: []string{constant.AuthzActionSubscribe}, UserTypes: []string{"parent"}},
+			{Pattern: "provider:{user_id}:#", Actions: []string{constant.AuthzActionSubscribe, constant.AuthzActionPublish},
+				UserTypes: []string{"provider"}},
+			{Pattern: "city:*:alerts", Actions: []string{constant.AuthzActionPublish}, Scopes: []string{"alerts.publish"}},
+			{Pattern: "ops:#", Actions: []string{constant.AuthzActionSubscribe}, UserTypes: []string{"admin"}, Scopes: []string{"ops.read"}},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		userID   string
+		userType string
+		scopes   []string
+		action   string
+		topic    string
+		allowed  bool
+	}{
+		{name: "rule grants the user type", userType: "parent", action: constant.AuthzActionSubscribe, topic: "provider:9:slots", allowed: true},
+		{name: "wildcard covered by the rule", userType: "parent", action: constant.AuthzActionSubscribe, topic: "provider:*:slots", allowed: true},
+		{name: "rule denies the user type", userType: "admin", action: constant.AuthzActionSubscribe, topic: "provider:9:slots"},
+		{name: "own topics of the user", userID: "9", userType: "provider", action: constant.AuthzActionPublish, topic: "provider:9:news", allowed: true},
+		{name: "topics of another user", userID: "8", userType: "provider", action: constant.AuthzActionPublish, topic: "provider:9:news"},
+		{name: "rest wildcard wider than the rule", userID: "9", userType: "provider", action: constant.AuthzActionPublish, topic: "provider:#"},
+		{name: "subscribe without rule falls back to default", userType: "parent", action: constant.AuthzActionSubscribe, topic: "news:today", allowed: true},
+		{name: "publish without rule is denied", userType: "admin", action: constant.AuthzActionPublish, topic: "news:today"},
+		{name: "publish with the scope", action: constant.AuthzActionPublish, scopes: []string{"alerts.publish"}, topic: "city:rome:alerts", allowed: true},
+		{name: "publish without the scope", action: constant.AuthzActionPublish, topic: "city:rome:alerts"},
+		{name: "subscribe under a publish rule falls back to default", action: constant.AuthzActionSubscribe, topic: "city:rome:alerts", allowed: true},
+		{name: "subscribe with the user type and scope", userType: "admin", scopes: []string{"ops.read"}, action: constant.AuthzActionSubscribe,
+			topic: "ops:db:load", allowed: true},
+		{name: "subscribe with the scope of another user type", userType: "provider", scopes: []string{"ops.read"},
+			action: constant.AuthzActionSubscribe, topic: "ops:db:load"},
+		{name: "subscribe with the user type but not the scope", userType: "admin", action: constant.AuthzActionSubscribe, topic: "ops:db:load"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := tt.userID
+			if userID == "" {
+				userID = "1"
+			}
+			c := newTestClient(userID, tt.userType, tt.scopes...)
+			err := authz.authorizeTopic(context.Background(), c, tt.action, tt.topic)
+			if (err == nil) != tt.allowed {
+				t.Fatalf("err = %v, allowed %v", err, tt.allowed)
+			}
+			if perr, ok := err.(*ProtocolError); err != nil && (!ok || perr.Code != "ABP11015") {
+				t.Errorf("err = %v, want ABP11015", err)
+			}
+		})
+	}
+}
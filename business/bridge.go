@@ -0,0 +1,395 @@
+package business
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/events"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// delays between the attempts to read an event or to write it to the dead letter or offline topic
+const (
+	eventRetryDelay    = time.Second
+	eventRetryDelayMax = 30 * time.Second
+)
+
+// eventBridge pushes the domain events read from kafka to the users they concern. An event is committed only
+// once it was handed to the hub, or written to the dead letter topic when it cannot be routed.
+// Users neither connected nor holding a session to resume do not get the event, it is counted as undelivered
+// and written to the offline topic with the users it missed, for them to be notified another way.
+type eventBridge struct {
+	consumer        events.Consumer
+	deadLetters     events.Publisher
+	deadLetterTopic string
+	offlineTopic    string
+	typeField       string
+	payloadField    string
+	routes          []models.EventRoute
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var bridge *eventBridge
+
+// eventBroker is the in-process broker the bridge reads from when no kafka is configured
+var eventBroker = events.NewMemoryBroker()
+
+// EventBroker returns the in-process broker, events published to it are pushed like the ones read from kafka
+func EventBroker() *events.MemoryBroker {
+	return eventBroker
+}
+
+// initEventBridge starts reading the domain events from the broker configured in application.yml
+func initEventBridge() error {
+	consumerConfig := models.KafkaConsumerConfig{}
+	if err := configs.UnmarshalAppConfig(constant.EventsConsumerKey, &consumerConfig); err != nil {
+		return err
+	}
+	var routes []models.EventRoute
+	if err := configs.UnmarshalAppConfig(constant.EventsRoutesKey, &routes); err != nil {
+		return err
+	}
+
+	b := &eventBridge{
+		deadLetterTopic: configs.GetAppConfigD(constant.EventsDeadLetterTopicKey, ""),
+		offlineTopic:    configs.GetAppConfigD(constant.EventsOfflineTopicKey, ""),
+		typeField:       configs.GetAppConfigD(constant.EventsTypeFieldKey, "type"),
+		payloadField:    configs.GetAppConfigD(constant.EventsPayloadFieldKey, ""),
+		routes:          routes,
+		done:            make(chan struct{}),
+	}
+	switch brokerType := configs.GetAppConfigD(constant.EventsBrokerKey, constant.EventBrokerMemory); brokerType {
+	case constant.EventBrokerMemory:
+		b.consumer = eventBroker.Consumer(consumerConfig.ConsumerGroup, consumerConfig.Topics...)
+		b.deadLetters = eventBroker
+	case constant.EventBrokerKafka:
+		consumer, err := events.NewKafkaConsumer(consumerConfig)
+		if err != nil {
+			return err
+		}
+		deadLetters, err := events.NewKafkaPublisher(consumerConfig.Servers)
+		if err != nil {
+			consumer.Close()
+			return err
+		}
+		b.consumer, b.deadLetters = consumer, deadLetters
+	default:
+		return fmt.Errorf("unknown event broker %s", brokerType)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	bridge = b
+	log.ApplicationInfo(ctx).Strs("topics", consumerConfig.Topics).Int("routes", len(routes)).Msg("event bridge started")
+	go b.run(ctx)
+	return nil
+}
+
+// CloseEventBridge stops reading events, waiting for the event being pushed
+func CloseEventBridge(ctx context.Context) error {
+	if bridge == nil {
+		return nil
+	}
+	bridge.cancel()
+	select {
+	case <-bridge.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := bridge.consumer.Close()
+	if bridge.deadLetters != events.Publisher(eventBroker) {
+		err = errors.Join(err, bridge.deadLetters.Close())
+	}
+	return err
+}
+
+func (b *eventBridge) run(ctx context.Context) {
+	defer close(b.done)
+	delay := eventRetryDelay
+	for {
+		msg, err := b.consumer.Fetch(ctx)
+		if ctx.Err() != nil || errors.Is(err, events.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.ApplicationError(ctx).Err(err).Msg("error reading event")
+			if !sleepCtx(ctx, delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		delay = eventRetryDelay
+
+		// an event is never skipped, it is retried until it is pushed or dead lettered
+		if !retryEvent(ctx, msg, "error handling event", func() error { return b.handle(ctx, msg) }) {
+			return
+		}
+		if err := b.consumer.Commit(ctx, msg); err != nil {
+			log.ApplicationError(ctx).Err(err).Str("topic", msg.Topic).Int64("offset", msg.Offset).Msg("error committing event")
+		}
+	}
+}
+
+// routedEvent is where and as what an event is pushed
+type routedEvent struct {
+	msgType string
+	users   []string
+	// socket topic the event is published to
+	topic   string
+	payload json.RawMessage
+}
+
+// handle pushes the event to its users and topic, or writes it to the dead letter topic when it cannot be routed.
+// The users it did not reach are handed to the offline topic, they are not a routing failure
+func (b *eventBridge) handle(ctx context.Context, msg *events.Message) error {
+	routed, reason := b.route(msg)
+	if reason != "" {
+		return b.deadLetter(ctx, msg, reason)
+	}
+	newEnvelope := func() (*models.Envelope, error) {
+		env, err := NewEnvelope(routed.msgType, nil)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = routed.payload
+		return env, nil
+	}
+	delivered := 0
+	var undelivered []string
+	for _, user := range routed.users {
+		env, err := newEnvelope()
+		if err != nil {
+			return err
+		}
+		connections := hub.SendEnvelopeToUser(user, env)
+		// the session of the user keeps the event for its devices reconnecting
+		if connections == 0 && sessions.stream(user) == nil {
+			undelivered = append(undelivered, user)
+		}
+		delivered += connections
+	}
+	if routed.topic != "" {
+		env, err := newEnvelope()
+		if err != nil {
+			return err
+		}
+		connections := hub.PublishToTopic(routed.topic, env)
+		if connections == 0 {
+			metrics.AddBridgeEventsUndelivered(msg.Topic, constant.BridgeTargetTopic, 1)
+		}
+		delivered += connections
+	}
+	if len(undelivered) > 0 {
+		metrics.AddBridgeEventsUndelivered(msg.Topic, constant.BridgeTargetUser, len(undelivered))
+		// retried on its own, retrying the event would push it again to the users that got it
+		if !retryEvent(ctx, msg, "error writing event to the offline topic", func() error {
+			return b.offline(ctx, msg, undelivered)
+		}) {
+			return ctx.Err()
+		}
+	}
+	log.ApplicationInfo(ctx).Str("topic", msg.Topic).Int64("offset", msg.Offset).Str(constant.ActionLogParam, routed.msgType).
+		Strs("users", routed.users).Str("socketTopic", routed.topic).Int("delivered", delivered).Msg("event pushed")
+	return nil
+}
+
+// route finds the message type, users, topic and payload of the event, or the reason it cannot be routed
+func (b *eventBridge) route(msg *events.Message) (*routedEvent, string) {
+	event, err := decodeEvent(msg.Value)
+	if err != nil {
+		return nil, "malformed event: " + err.Error()
+	}
+	eventType, _ := lookupField(event, b.typeField).(string)
+	if eventType == "" {
+		return nil, "missing event type"
+	}
+	var route *models.EventRoute
+	for i := range b.routes {
+		r := &b.routes[i]
+		if (r.Topic == "" || r.Topic == msg.Topic) && (r.EventType == "" || r.EventType == eventType) {
+			route = r
+			break
+		}
+	}
+	if route == nil {
+		return nil, "no route for " + eventType
+	}
+
+	routed := &routedEvent{msgType: route.MessageType}
+	for _, field := range route.UserFields {
+		routed.users = append(routed.users, userIDs(lookupField(event, field))...)
+	}
+	if route.TargetTopic != "" {
+		topic, err := expandTopic(route.TargetTopic, event)
+		if err != nil {
+			return nil, "no target topic for " + eventType + ": " + err.Error()
+		}
+		routed.topic = topic
+	}
+	if len(routed.users) == 0 && routed.topic == "" {
+		return nil, "no target user for " + eventType
+	}
+
+	var payload interface{} = event
+	if b.payloadField != "" {
+		payload = lookupField(event, b.payloadField)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "malformed payload: " + err.Error()
+	}
+	routed.payload = data
+	if routed.msgType == "" {
+		routed.msgType = eventType
+	}
+	return routed, ""
+}
+
+// decodeEvent decodes the event keeping its numbers as written, ids above 2^53 do not survive a float64
+func decodeEvent(data []byte) (map[string]interface{}, error) {
+	event := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("data after the event")
+	}
+	return event, nil
+}
+
+// placeholders of the event fields in the target topic of a route, like booking:{data.booking_id}
+var topicPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// expandTopic replaces the placeholders of the topic template with the fields of the event
+func expandTopic(template string, event map[string]interface{}) (string, error) {
+	var missing []string
+	topic := topicPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		field := strings.Trim(placeholder, "{}")
+		values := userIDs(lookupField(event, field))
+		if len(values) != 1 {
+			missing = append(missing, field)
+			return ""
+		}
+		return values[0]
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return topic, validTopic(topic, false)
+}
+
+// deadLetter writes the event that cannot be routed to the dead letter topic
+func (b *eventBridge) deadLetter(ctx context.Context, msg *events.Message, reason string) error {
+	log.ApplicationWarn(ctx).Str("topic", msg.Topic).Int64("offset", msg.Offset).Str("reason", reason).Msg("event not routed")
+	if b.deadLetterTopic == "" {
+		return nil
+	}
+	headers := originHeaders(msg)
+	headers[constant.DeadLetterReasonHeader] = reason
+	return b.deadLetters.Publish(ctx, events.Message{Topic: b.deadLetterTopic, Key: msg.Key, Value: msg.Value, Headers: headers})
+}
+
+// offline writes the routed event to the offline topic with the users it did not reach
+func (b *eventBridge) offline(ctx context.Context, msg *events.Message, users []string) error {
+	log.ApplicationInfo(ctx).Str("topic", msg.Topic).Int64("offset", msg.Offset).Strs("users", users).Msg("event not delivered, users offline")
+	if b.offlineTopic == "" {
+		return nil
+	}
+	headers := originHeaders(msg)
+	headers[constant.OfflineUsersHeader] = strings.Join(users, ",")
+	return b.deadLetters.Publish(ctx, events.Message{Topic: b.offlineTopic, Key: msg.Key, Value: msg.Value, Headers: headers})
+}
+
+// originHeaders are the headers naming where an event written back to kafka was read from
+func originHeaders(msg *events.Message) map[string]string {
+	return map[string]string{
+		constant.OriginalTopicHeader:     msg.Topic,
+		constant.OriginalPartitionHeader: strconv.Itoa(msg.Partition),
+		constant.OriginalOffsetHeader:    strconv.FormatInt(msg.Offset, 10),
+	}
+}
+
+// lookupField returns the value at the dotted path of the event, nil when missing
+func lookupField(event map[string]interface{}, path string) interface{} {
+	var value interface{} = event
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// userIDs reads the user ids of a field holding one id or a list of them
+func userIDs(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if strings.TrimSpace(v) != "" {
+			return []string{v}
+		}
+	case json.Number:
+		return []string{v.String()}
+	case []interface{}:
+		var ids []string
+		for _, item := range v {
+			ids = append(ids, userIDs(item)...)
+		}
+		return ids
+	}
+	return nil
+}
+
+// retryEvent runs fn until it succeeds, waiting longer between the attempts. It returns false when the context is
+// done first.
+func retryEvent(ctx context.Context, msg *events.Message, errMsg string, fn func() error) bool {
+	delay := eventRetryDelay
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		log.ApplicationError(ctx).Err(err).Str("topic", msg.Topic).Int64("offset", msg.Offset).Msg(errMsg)
+		if !sleepCtx(ctx, delay) {
+			return false
+		}
+		delay = nextRetryDelay(delay)
+	}
+}
+
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > eventRetryDelayMax {
+		return eventRetryDelayMax
+	}
+	return delay
+}
+
+// sleepCtx waits for the delay, returning false when the context is done first
+func sleepCtx(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,207 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/events"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestUserIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []string
+	}{
+		{name: "string", value: "42", want: []string{"42"}},
+		{name: "blank string", value: "  "},
+		{name: "number", value: json.Number("42"), want: []string{"42"}},
+		{name: "number above 2^53", value: json.Number("9007199254740993"), want: []string{"9007199254740993"}},
+		{name: "list", value: []interface{}{"1", json.Number("2"), true, ""}, want: []string{"1", "2"}},
+		{name: "float", value: 42.0},
+		{name: "missing", value: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userIDs(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userIDs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testBridge(deadLetters events.Publisher) *eventBridge {
+	return &eventBridge{
+		deadLetters:     deadLetters,
+		deadLetterTopic: "dead-letters",
+		offlineTopic:    "offline",
+		typeField:       "type",
+		payloadField:    "data",
+		routes: []models.EventRoute{
+			{Topic: "payment-events", EventType: "payment.captured", MessageType: "payment.update", UserFields: []string{"data.parent_id"}},
+			{EventType: "booking.created", UserFields: []string{"data.parent_id", "data.provider_id"}},
+			{EventType: "slots.updated", TargetTopic: "provider:{data.provider_id}:slots"},
+		},
+	}
+}
+
+func TestEventBridgeRoute(t *testing.T) {
+	b := testBridge(nil)
+
+	tests := []struct {
+		name        string
+		topic       string
+		event       string
+		wantType    string
+		wantUsers   []string
+		wantTopic   string
+		wantPayload string
+		wantReason  string
+	}{
+		{name: "route of the topic", topic: "payment-events", event: `{"type":"payment.captured","data":{"parent_id":"7"}}`,
+			wantType: "payment.update", wantUsers: []string{"7"}, wantPayload: `{"parent_id":"7"}`},
+		{name: "every user field", topic: "booking-events", event: `{"type":"booking.created","data":{"parent_id":"7","provider_id":["8","9"]}}`,
+			wantType: "booking.created", wantUsers: []string{"7", "8", "9"}, wantPayload: `{"parent_id":"7","provider_id":["8","9"]}`},
+		{name: "large numeric ids stay exact", topic: "booking-events",
+			event:    `{"type":"booking.created","data":{"parent_id":9007199254740993,"provider_id":[12345678901234567890]}}`,
+			wantType: "booking.created", wantUsers: []string{"9007199254740993", "12345678901234567890"},
+			wantPayload: `{"parent_id":9007199254740993,"provider_id":[12345678901234567890]}`},
+		{name: "target topic", topic: "booking-events", event: `{"type":"slots.updated","data":{"provider_id":9007199254740993}}`,
+			wantType: "slots.updated", wantTopic: "provider:9007199254740993:slots", wantPayload: `{"provider_id":9007199254740993}`},
+		{name: "route of another topic", topic: "booking-events", event: `{"type":"payment.captured","data":{"parent_id":"7"}}`,
+			wantReason: "no route for payment.captured"},
+		{name: "missing type", topic: "booking-events", event: `{"data":{"parent_id":"7"}}`, wantReason: "missing event type"},
+		{name: "no target user", topic: "booking-events", event: `{"type":"booking.created","data":{}}`,
+			wantReason: "no target user for booking.created"},
+		{name: "no target topic", topic: "booking-events", event: `{"type":"slots.updated","data":{}}`,
+			wantReason: "no target topic for slots.updated"},
+		{name: "malformed", topic: "booking-events", event: `{"type":`, wantReason: "malformed event"},
+		{name: "data after the event", topic: "booking-events", event: `{"type":"booking.created"} {}`,
+			wantReason: "malformed event: data after the event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routed, reason := b.route(&events.Message{Topic: tt.topic, Value: []byte(tt.event)})
+			if tt.wantReason != "" {
+				if !strings.HasPrefix(reason, tt.wantReason) {
+					t.Fatalf("reason = %q, want %q", reason, tt.wantReason)
+				}
+				return
+			}
+			if reason != "" {
+				t.Fatalf("reason = %q", reason)
+			}
+			if routed.msgType != tt.wantType {
+				t.Errorf("type = %s, want %s", routed.msgType, tt.wantType)
+			}
+			if !reflect.DeepEqual(routed.users, tt.wantUsers) {
+				t.Errorf("users = %v, want %v", routed.users, tt.wantUsers)
+			}
+			if routed.topic != tt.wantTopic {
+				t.Errorf("topic = %s, want %s", routed.topic, tt.wantTopic)
+			}
+			if string(routed.payload) != tt.wantPayload {
+				t.Errorf("payload = %s, want %s", routed.payload, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestEventBridgeDeadLetter(t *testing.T) {
+	broker := events.NewMemoryBroker()
+	defer broker.Close()
+	b := testBridge(broker)
+
+	msg := &events.Message{Topic: "booking-events", Partition: 2, Offset: 41, Key: []byte("k"), Value: []byte(`{"type":"unknown"}`)}
+	if err := b.handle(context.Background(), msg); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	letters := broker.Messages("dead-letters")
+	if len(letters) != 1 {
+		t.Fatalf("dead letters = %d, want 1", len(letters))
+	}
+	letter := letters[0]
+	if string(letter.Key) != "k" || string(letter.Value) != string(msg.Value) {
+		t.Errorf("dead letter = %s %s, want the event", letter.Key, letter.Value)
+	}
+	wantHeaders := map[string]string{
+		constant.DeadLetterReasonHeader:  "no route for unknown",
+		constant.OriginalTopicHeader:     "booking-events",
+		constant.OriginalPartitionHeader: "2",
+		constant.OriginalOffsetHeader:    "41",
+	}
+	for header, want := range wantHeaders {
+		if got := letter.Headers[header]; got != want {
+			t.Errorf("header %s = %q, want %q", header, got, want)
+		}
+	}
+
+	t.Run("without a dead letter topic the event is dropped", func(t *testing.T) {
+		b.deadLetterTopic = ""
+		if err := b.handle(context.Background(), msg); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		if got := len(broker.Messages("dead-letters")); got != 1 {
+			t.Errorf("dead letters = %d, want 1", got)
+		}
+	})
+
+	t.Run("publish errors are returned to retry the event", func(t *testing.T) {
+		b.deadLetterTopic = "dead-letters"
+		broker.Close()
+		if err := b.handle(context.Background(), msg); err == nil {
+			t.Error("handle succeeded on a closed broker")
+		}
+	})
+}
+
+func TestEventBridgeOfflineUsers(t *testing.T) {
+	broker := events.NewMemoryBroker()
+	defer broker.Close()
+	b := testBridge(broker)
+
+	msg := &events.Message{Topic: "booking-events", Partition: 1, Offset: 7,
+		Value: []byte(`{"type":"booking.created","data":{"parent_id":"offline-1","provider_id":"offline-2"}}`)}
+	if err := b.handle(context.Background(), msg); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if got := len(broker.Messages("dead-letters")); got != 0 {
+		t.Errorf("dead letters = %d, want 0, offline users are not a routing failure", got)
+	}
+	offline := broker.Messages("offline")
+	if len(offline) != 1 {
+		t.Fatalf("offline events = %d, want 1", len(offline))
+	}
+	if string(offline[0].Value) != string(msg.Value) {
+		t.Errorf("offline event = %s, want the event", offline[0].Value)
+	}
+	wantHeaders := map[string]string{
+		constant.OfflineUsersHeader:      "offline-1,offline-2",
+		constant.OriginalTopicHeader:     "booking-events",
+		constant.OriginalPartitionHeader: "1",
+		constant.OriginalOffsetHeader:    "7",
+	}
+	for header, want := range wantHeaders {
+		if got := offline[0].Headers[header]; got != want {
+			t.Errorf("header %s = %q, want %q", header, got, want)
+		}
+	}
+
+	t.Run("without an offline topic the users are only counted", func(t *testing.T) {
+		b.offlineTopic = ""
+		if err := b.handle(context.Background(), msg); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		if got := len(broker.Messages("offline")); got != 1 {
+			t.Errorf("offline events = %d, want 1", got)
+		}
+		if got := len(broker.Messages("dead-letters")); got != 0 {
+			t.Errorf("dead letters = %d, want 0", got)
+		}
+	})
+}
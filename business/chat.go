@@ -0,0 +1,93 @@
+package business
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const defaultChatMaxTextLength = 4000
+
+// handleChatSend routes a chat message from the connected user to every online device of the recipient
+func handleChatSend(mc *MessageContext) error {
+	req := models.ChatSend{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	req.To = strings.TrimSpace(req.To)
+	if utils.IsBlank(req.To) || utils.IsBlank(req.Text) {
+		return NewProtocolError("ABP11004", errors.New("to and text are required"))
+	}
+	if len(req.Text) > configs.GetAppConfigIntD(constant.ChatMaxTextLengthKey, defaultChatMaxTextLength) {
+		return NewProtocolError("ABP11004", errors.New("text is too long"))
+	}
+
+	sender := mc.Client.UserID
+	if userKey(sender) == userKey(req.To) {
+		return NewProtocolError("ABP11004", errors.New("cannot message yourself"))
+	}
+	allowed, err := chatPolicy.CanChat(mc, sender, req.To)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.ApplicationWarn(mc).Str("recipient", req.To).Msg("chat between users not allowed")
+		return NewProtocolError("ABP11012", nil)
+	}
+
+	msg := models.ChatMessage{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID(sender, req.To),
+		From:           sender,
+		To:             req.To,
+		Text:           req.Text,
+		ClientMsgID:    req.ClientMsgID,
+		SentAt:         time.Now().UnixMilli(),
+		Actor:          mc.Client.Actor,
+	}
+	if err := messageStore.Save(mc, &msg); err != nil {
+		return err
+	}
+	emitActivity(models.ActivityEvent{
+		Type:           constant.ActivityMessageSent,
+		UserID:         msg.From,
+		DeviceID:       mc.Client.DeviceID,
+		MessageID:      msg.ID,
+		ConversationID: msg.ConversationID,
+		PeerID:         msg.To,
+		Actor:          msg.Actor,
+	})
+	msg.Status = constant.MessageStatusSent
+	delivered, err := deliverChatMessage(msg)
+	if err != nil {
+		return err
+	}
+	if delivered == 0 {
+		if err := messageStore.Enqueue(mc, userKey(msg.To), msg.ID); err != nil {
+			return err
+		}
+	}
+	// keep the other devices of the sender in sync with the conversation
+	env, err := NewEnvelope(constant.MessageTypeChatMessage, msg)
+	if err != nil {
+		return err
+	}
+	cluster.forwardEvent(sender, env, mc.Client.DeviceID)
+	if _, _, err := pushToUser(sender, env, "", mc.Client.DeviceID); err != nil {
+		return err
+	}
+
+	return mc.Reply(constant.MessageTypeChatSent, models.ChatSent{
+		ID:          msg.ID,
+		ClientMsgID: msg.ClientMsgID,
+		SentAt:      msg.SentAt,
+		Delivered:   delivered,
+	})
+}
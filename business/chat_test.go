@@ -0,0 +1,227 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/store"
+	"github.com/smartpet/websocket/utils/httpclient"
+)
+
+// chatPolicyFunc lets a test decide the chat policy inline
+type chatPolicyFunc func(sender, recipient string) (bool, error)
+
+func (f chatPolicyFunc) CanChat(ctx context.Context, sender, recipient string) (bool, error) {
+	return f(sender, recipient)
+}
+
+// withMessageStore replaces the message store with an empty memory store for the test
+func withMessageStore(t *testing.T) {
+	t.Helper()
+	previous := messageStore
+	messageStore = store.NewMemoryStore()
+	t.Cleanup(func() { messageStore = previous })
+}
+
+// withClient adds the connection to the hub for the test
+func withClient(t *testing.T, c *Client) {
+	t.Helper()
+	hub.add(c)
+	t.Cleanup(func() { hub.remove(c) })
+}
+
+func TestHandleChatSend(t *testing.T) {
+	previous := chatPolicy
+	t.Cleanup(func() { chatPolicy = previous })
+
+	tests := []struct {
+		name          string
+		payload       string
+		allowed       bool
+		policyErr     error
+		online        bool
+		wantCode      string
+		wantErr       bool
+		wantDelivered int
+		wantQueued    bool
+	}{
+		{name: "missing recipient", payload: `{"to":" ","text":"hi"}`, allowed: true, wantCode: "ABP11004"},
+		{name: "blank text", payload: `{"to":"2","text":"  "}`, allowed: true, wantCode: "ABP11004"},
+		{name: "text too long", payload: `{"to":"2","text":"` + strings.Repeat("a", defaultChatMaxTextLength+1) + `"}`,
+			allowed: true, wantCode: "ABP11004"},
+		{name: "message to yourself", payload: `{"to":"1","text":"hi"}`, allowed: true, wantCode: "ABP11004"},
+		{name: "not allowed by the policy", payload: `{"to":"2","text":"hi"}`, wantCode: "ABP11012"},
+		{name: "policy failing", payload: `{"to":"2","text":"hi"}`, policyErr: errors.New("booking service down"), wantErr: true},
+		{name: "recipient online", payload: `{"to":"2","text":"hi","client_msg_id":"c1"}`, allowed: true, online: true, wantDelivered: 1},
+		{name: "recipient offline", payload: `{"to":"2","text":"hi","client_msg_id":"c1"}`, allowed: true, wantQueued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMessageStore(t)
+			chatPolicy = chatPolicyFunc(func(sender, recipient string) (bool, error) {
+				return tt.allowed, tt.policyErr
+			})
+			sender := newTestClient("1", "parent")
+			otherDevice := newTestClient("1", "parent")
+			otherDevice.DeviceID = "tablet"
+			withClient(t, sender)
+			withClient(t, otherDevice)
+			recipient := newTestClient("2", "provider")
+			if tt.online {
+				withClient(t, recipient)
+			}
+			mc := &MessageContext{
+				Context: context.Background(),
+				Client:  sender,
+				Message: &models.Envelope{Type: constant.MessageTypeChatSend, ID: "m", Payload: json.RawMessage(tt.payload)},
+			}
+
+			err := handleChatSend(mc)
+			if tt.wantCode != "" {
+				if perr, ok := err.(*ProtocolError); !ok || perr.Code != tt.wantCode {
+					t.Fatalf("err = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("err = nil, want the policy error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+
+			// the other device of the sender gets a copy, the sending one gets chat.sent
+			if env := nextFrame(t, otherDevice); env.Type != constant.MessageTypeChatMessage {
+				t.Errorf("other device got %s, want %s", env.Type, constant.MessageTypeChatMessage)
+			}
+			env := nextFrame(t, sender)
+			sent := models.ChatSent{}
+			if err := json.Unmarshal(env.Payload, &sent); err != nil {
+				t.Fatalf("decoding chat.sent: %v", err)
+			}
+			if env.Type != constant.MessageTypeChatSent || sent.ClientMsgID != "c1" || sent.Delivered != tt.wantDelivered {
+				t.Errorf("reply %s %+v, want %s for c1 delivered %d", env.Type, sent, constant.MessageTypeChatSent, tt.wantDelivered)
+			}
+			if tt.online {
+				if env := nextFrame(t, recipient); env.Type != constant.MessageTypeChatMessage {
+					t.Errorf("recipient got %s, want %s", env.Type, constant.MessageTypeChatMessage)
+				}
+			}
+			pending, err := messageStore.Pending(context.Background(), userKey("2"), 10)
+			if err != nil {
+				t.Fatalf("pending: %v", err)
+			}
+			if queued := len(pending) == 1 && pending[0].ID == sent.ID; queued != tt.wantQueued {
+				t.Errorf("pending = %v, want queued %v", pending, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestBookingChatPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantAllowed bool
+		wantErr     bool
+		wantCached  bool
+	}{
+		{name: "booking between the users", status: http.StatusOK, body: `{"data":{"allowed":true}}`, wantAllowed: true, wantCached: true},
+		{name: "no booking", status: http.StatusOK, body: `{"data":{"allowed":false}}`},
+		{name: "booking service failing", status: http.StatusBadRequest, body: `{}`, wantErr: true},
+		{name: "unreadable answer", status: http.StatusOK, body: `{`, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(server.Close)
+			client, err := httpclient.GetClientWithCustomTimeout(httpclient.Config{ConnectTimeout: time.Second}, time.Second)
+			if err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			p := &bookingChatPolicy{url: server.URL, client: client, cacheTTL: time.Minute}
+			// a pair of users of its own for every case, so the cache of another case does not answer
+			sender, recipient := "booking-"+string(rune('a'+i)), "Provider-"+string(rune('a'+i))
+
+			allowed, err := p.CanChat(context.Background(), sender, recipient)
+			if (err != nil) != tt.wantErr || allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v err = %v, want %v err %v", allowed, err, tt.wantAllowed, tt.wantErr)
+			}
+			// the relationship goes both ways, so the cache answers for the recipient too
+			calls.Store(0)
+			p.CanChat(context.Background(), strings.ToLower(recipient), sender)
+			if cached := calls.Load() == 0; cached != tt.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestDeniedRecipient(t *testing.T) {
+	previous := chatPolicy
+	t.Cleanup(func() { chatPolicy = previous })
+	var mu sync.Mutex
+	checked := map[string]int{}
+	chatPolicy = chatPolicyFunc(func(sender, recipient string) (bool, error) {
+		mu.Lock()
+		checked[recipient]++
+		mu.Unlock()
+		if recipient == "broken" {
+			return false, errors.New("booking service down")
+		}
+		return !strings.HasPrefix(recipient, "stranger"), nil
+	})
+
+	tests := []struct {
+		name       string
+		recipients []string
+		wantDenied string
+		wantErr    bool
+	}{
+		{name: "every recipient allowed", recipients: []string{"2", "3", "4"}},
+		{name: "one recipient denied", recipients: []string{"2", "stranger", "3"}, wantDenied: "stranger"},
+		{name: "policy failing", recipients: []string{"2", "broken"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denied, err := deniedRecipient(context.Background(), "1", tt.recipients)
+			if denied != tt.wantDenied || (err != nil) != tt.wantErr {
+				t.Errorf("denied %q err %v, want %q error %v", denied, err, tt.wantDenied, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("repeated recipient checked once", func(t *testing.T) {
+		checked = map[string]int{}
+		recipients := make([]string, 0, 50)
+		for i := 0; i < 50; i++ {
+			recipients = append(recipients, "many")
+		}
+		recipients = append(recipients, "MANY")
+		if denied, err := deniedRecipient(context.Background(), "1", recipients); denied != "" || err != nil {
+			t.Fatalf("denied %q err %v", denied, err)
+		}
+		if checked["many"] != 1 || len(checked) != 1 {
+			t.Errorf("checked %v, want many once", checked)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	"github.com/smartpet/websocket/utils/httpclient"
+	"golang.org/x/sync/errgroup"
+)
+
+// chat policy checks run at once for the recipients of a single request
+const chatPolicyConcurrency = 8
+
+// errRecipientDenied stops the remaining checks of deniedRecipient once one recipient is refused
+var errRecipientDenied = errors.New("recipient denied")
+
+// ChatPolicy decides whether the sender may message the recipient
+type ChatPolicy interface {
+	CanChat(ctx context.Context, sender, recipient string) (bool, error)
+}
+
+var chatPolicy ChatPolicy = openChatPolicy{}
+
+// SetChatPolicy replaces the policy used by chat.send
+func SetChatPolicy(policy ChatPolicy) {
+	chatPolicy = policy
+}
+
+// deniedRecipient checks the recipients against the chat policy a few at a time and returns one the sender may
+// not chat with, empty when every one is allowed. A recipient listed more than once is checked once.
+func deniedRecipient(ctx context.Context, sender string, recipients []string) (string, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(chatPolicyConcurrency)
+	var mu sync.Mutex
+	denied := ""
+	seen := make(map[string]struct{}, len(recipients))
+	for _, recipient := range recipients {
+		if _, ok := seen[userKey(recipient)]; ok {
+			continue
+		}
+		seen[userKey(recipient)] = struct{}{}
+		recipient := recipient
+		g.Go(func() error {
+			allowed, err := chatPolicy.CanChat(gctx, sender, recipient)
+			if err != nil || allowed {
+				return err
+			}
+			mu.Lock()
+			if denied == "" {
+				denied = recipient
+			}
+			mu.Unlock()
+			return errRecipientDenied
+		})
+	}
+	err := g.Wait()
+	// checks cut short by the refusal of another recipient fail with the cancelled context
+	if denied != "" {
+		return denied, nil
+	}
+	return "", err
+}
+
+// openChatPolicy lets every user message every other user
+type openChatPolicy struct{}
+
+func (openChatPolicy) CanChat(ctx context.Context, sender, recipient string) (bool, error) {
+	return true, nil
+}
+
+// bookingChatPolicy allows only users with a booking between them, as told by the booking service.
+// Allowed pairs are cached, so a conversation does not hit the booking service for every message.
+type bookingChatPolicy struct {
+	url      string
+	client   *httpclient.CustomHttpClient
+	cacheTTL time.Duration
+}
+
+func newBookingChatPolicy(cacheTTL time.Duration) (*bookingChatPolicy, error) {
+	externalConfig, err := configs.Get(constant.ExternalConfig)
+	if err != nil {
+		return nil, err
+	}
+	bookingConfig := externalConfig.Sub(constant.BookingService)
+	if bookingConfig == nil {
+		return nil, fmt.Errorf("%s config not found", constant.BookingService)
+	}
+	client, err := httpclient.GetClientWithCustomTimeout(httpclient.Config{
+		ConnectTimeout: millis(bookingConfig.GetInt(constant.HTTPConnectTimeoutInMillisKey)),
+	}, millis(bookingConfig.GetInt(constant.HTTPTimeoutInMillisKey)))
+	if err != nil {
+		return nil, err
+	}
+	return &bookingChatPolicy{
+		url:      os.ExpandEnv(bookingConfig.GetString(constant.URLConfigKey)),
+		client:   client,
+		cacheTTL: cacheTTL,
+	}, nil
+}
+
+func relationshipCacheKey(sender, recipient string) string {
+	// a booking relationship goes both ways
+	a, b := userKey(sender), userKey(recipient)
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("chat:relationship:%s:%s", a, b)
+}
+
+func (p *bookingChatPolicy) CanChat(ctx context.Context, sender, recipient string) (bool, error) {
+	key := relationshipCacheKey(sender, recipient)
+	cache := utils.GetCache()
+	if cache != nil && cache.Has(key) {
+		return true, nil
+	}
+
+	query := url.Values{}
+	query.Set("user_id", sender)
+	query.Set("other_user_id", recipient)
+	resp, err := p.client.RequestWithRetries(ctx, p.url+"?"+query.Encode(), http.MethodGet, nil, nil,
+		constant.BookingSvcRetry, constant.BookingSvcWaitTime, constant.BookingSvcWaitTimeMax)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("booking service returned " + resp.Status)
+	}
+
+	relationship := models.ChatRelationship{}
+	result := models.Response{Response: &relationship}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, err
+	}
+	if relationship.Allowed && cache != nil {
+		cache.Set(key, true, p.cacheTTL)
+	}
+	return relationship.Allowed, nil
+}
+
+// initChatPolicy sets up the chat policy configured in application.yml
+func initChatPolicy() error {
+	switch policy := configs.GetAppConfigD(constant.ChatPolicyKey, constant.ChatPolicyBooking); policy {
+	case constant.ChatPolicyOpen:
+		SetChatPolicy(openChatPolicy{})
+	case constant.ChatPolicyBooking:
+		cacheTTL := time.Duration(configs.GetAppConfigIntD(constant.ChatRelationshipCacheInSecondsKey, 300)) * time.Second
+		p, err := newBookingChatPolicy(cacheTTL)
+		if err != nil {
+			return err
+		}
+		SetChatPolicy(p)
+	default:
+		return fmt.Errorf("unknown chat policy %s", policy)
+	}
+	return nil
+}
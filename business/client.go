@@ -0,0 +1,375 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// errors returned while queueing messages on a connection
+var (
+	ErrClientClosed = errors.New("connection closed")
+	ErrQueueFull    = errors.New("send queue full")
+	ErrSlowConsumer = errors.New("slow consumer disconnected")
+)
+
+// Client is a single live socket connection of a user device.
+// Reads happen on the goroutine of the request, writes on a dedicated writer goroutine
+// fed by a bounded send queue, as gorilla connections support only one concurrent writer.
+type Client struct {
+	ID          string
+	UserID      string
+	DeviceID    string
+	ConnectedAt time.Time
+	// user acting as UserID when the connection is impersonated, the act claim of the token
+	Actor string
+
+	// ctx carries the request id and user of the connection for logging
+	ctx  context.Context
+	conn *websocket.Conn
+
+	// unix nano of the last frame of any kind and of the last message received from the client
+	lastSeen     atomic.Int64
+	lastActivity atomic.Int64
+
+	send      chan outbound
+	done      chan struct{}
+	closeOnce sync.Once
+	// closed to make the writer flush the queue and close the connection
+	drain     chan struct{}
+	drainOnce sync.Once
+	// serialises the overflow handling of concurrent senders
+	sendMu sync.Mutex
+
+	// chat messages written to the connection and waiting for the ack of the device
+	unacked   map[string]*unackedMessage
+	unackedMu sync.Mutex
+
+	// set while the app of the device is in the background
+	away atomic.Bool
+
+	// last typing event sent per event type and recipient, for rate limiting
+	lastTyping map[string]time.Time
+	typingMu   sync.Mutex
+
+	// token of the logical session the connection belongs to
+	resumeToken string
+
+	// expiry of the token the connection is authenticated with
+	expiry tokenExpiry
+	// claims of the token, replaced on auth.refresh while other goroutines read them
+	token atomic.Pointer[tokenState]
+}
+
+// outbound is a frame queued on the connection, with the type of its envelope for the metrics
+type outbound struct {
+	msgType string
+	data    []byte
+}
+
+// tokenState holds the claims of the token of the connection the server acts on
+type tokenState struct {
+	// user type and scopes of the token, checked against the authorization policy
+	UserType string
+	Scopes   []string
+	// id and issue time in unix seconds of the token, for revocation
+	TokenID  string
+	IssuedAt int64
+}
+
+// setToken replaces the claims of the token of the connection
+func (c *Client) setToken(claims *models.JWTLoginToken) {
+	c.token.Store(&tokenState{UserType: claims.UserType, Scopes: claims.Scope, TokenID: claims.Id, IssuedAt: claims.IssuedAt})
+}
+
+// UserType returns the user type of the token of the connection
+func (c *Client) UserType() string {
+	if t := c.token.Load(); t != nil {
+		return t.UserType
+	}
+	return ""
+}
+
+// Scopes returns the scopes of the token of the connection, the slice must not be modified
+func (c *Client) Scopes() []string {
+	if t := c.token.Load(); t != nil {
+		return t.Scopes
+	}
+	return nil
+}
+
+// TokenID returns the id of the token of the connection
+func (c *Client) TokenID() string {
+	if t := c.token.Load(); t != nil {
+		return t.TokenID
+	}
+	return ""
+}
+
+// IssuedAt returns the issue time of the token of the connection in unix seconds
+func (c *Client) IssuedAt() int64 {
+	if t := c.token.Load(); t != nil {
+		return t.IssuedAt
+	}
+	return 0
+}
+
+func newClient(ctx context.Context, conn *websocket.Conn, userID, deviceID string) *Client {
+	c := &Client{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		DeviceID:    deviceID,
+		ConnectedAt: time.Now(),
+		conn:        conn,
+		send:        make(chan outbound, settings.sendQueueSize),
+		done:        make(chan struct{}),
+		drain:       make(chan struct{}),
+		unacked:     make(map[string]*unackedMessage),
+		lastTyping:  make(map[string]time.Time),
+	}
+	c.ctx = context.WithValue(ctx, constant.ConnectionLogParam, c.ID)
+	c.touch(true)
+	return c
+}
+
+// Send queues a text frame holding an envelope of the type on the connection, applying the overflow policy when
+// the queue is full
+func (c *Client) Send(msgType string, data []byte) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	for {
+		select {
+		case <-c.done:
+			return ErrClientClosed
+		default:
+		}
+		select {
+		case c.send <- outbound{msgType: msgType, data: data}:
+			metrics.AddSocketSendQueueDepth(1)
+			return nil
+		default:
+		}
+
+		metrics.IncSocketMessagesDropped(settings.overflowPolicy)
+		switch settings.overflowPolicy {
+		case constant.OverflowDropNewest:
+			return ErrQueueFull
+		case constant.OverflowDisconnect:
+			log.ApplicationWarn(c.ctx).Int("queueSize", cap(c.send)).Msg("disconnecting slow consumer")
+			c.closeWithReason(websocket.CloseTryAgainLater, "slow consumer")
+			return ErrSlowConsumer
+		default:
+			// drop the oldest message and retry
+			select {
+			case <-c.send:
+				metrics.AddSocketSendQueueDepth(-1)
+			default:
+			}
+		}
+	}
+}
+
+// SendEnvelope queues the message on the connection
+func (c *Client) SendEnvelope(env *models.Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return c.Send(env.Type, data)
+}
+
+// sendError queues an error frame, errors other than ProtocolError are reported as internal errors
+func (c *Client) sendError(correlationID string, err error) error {
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		perr = NewProtocolError("ABP11000", nil)
+	}
+	env, eerr := NewEnvelope(constant.MessageTypeError, perr.payload())
+	if eerr != nil {
+		return eerr
+	}
+	env.CorrelationID = correlationID
+	return c.SendEnvelope(env)
+}
+
+// Close closes the connection, it is safe to call more than once
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.stopTokenExpiry()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// closeWithReason tells the client why the connection is closed before closing it
+func (c *Client) closeWithReason(code int, reason string) {
+	metrics.IncSocketCloses(constant.MetricsSideServer, code)
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(settings.writeWait))
+	c.Close()
+}
+
+// Done is closed once the connection is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) touch(activity bool) {
+	now := time.Now().UnixNano()
+	c.lastSeen.Store(now)
+	if activity {
+		c.lastActivity.Store(now)
+	}
+}
+
+// stale tells if the connection missed its pongs or was idle for too long, and the close code to use
+func (c *Client) stale(now time.Time) (bool, int, string) {
+	if now.Sub(time.Unix(0, c.lastSeen.Load())) > settings.pongWait {
+		return true, websocket.CloseGoingAway, "heartbeat timeout"
+	}
+	if settings.idleTimeout > 0 && now.Sub(time.Unix(0, c.lastActivity.Load())) > settings.idleTimeout {
+		return true, websocket.CloseNormalClosure, "idle timeout"
+	}
+	return false, 0, ""
+}
+
+// reader reads the messages of the connection and dispatches them until the connection fails.
+// Every pong pushes the read deadline, so a peer that stops answering pings fails the read.
+func (c *Client) reader() {
+	defer c.Close()
+	c.conn.SetReadLimit(int64(settings.maxMessageSize))
+	c.conn.SetReadDeadline(time.Now().Add(settings.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.touch(false)
+		return c.conn.SetReadDeadline(time.Now().Add(settings.pongWait))
+	})
+	for {
+		// read in a message
+		messageType, p, err := c.conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// the close frame with 1009 was already sent by the connection
+			log.ApplicationWarn(c.ctx).Int("limit", settings.maxMessageSize).Msg("closing connection sending a frame over the size limit")
+			metrics.IncSocketCloses(constant.MetricsSideServer, websocket.CloseMessageTooBig)
+			return
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.ApplicationError(c.ctx).Msg(err.Error())
+			}
+			c.countClientClose(err)
+			return
+		}
+		c.touch(true)
+		c.conn.SetReadDeadline(time.Now().Add(settings.pongWait))
+		if messageType != websocket.TextMessage {
+			metrics.AddSocketMessage(constant.MetricsDirectionIn, constant.MetricsTypeInvalid, len(p))
+			c.sendError("", NewProtocolError("ABP11009", errors.New("only text frames are supported")))
+			continue
+		}
+		router.Dispatch(c, p)
+	}
+}
+
+// writer writes the queued messages and the server pings to the connection until it is closed
+func (c *Client) writer() {
+	ticker := time.NewTicker(settings.pingPeriod)
+	defer ticker.Stop()
+	defer c.discardQueue()
+	for {
+		select {
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(settings.writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case msg := <-c.send:
+			metrics.AddSocketSendQueueDepth(-1)
+			if err := c.write(msg); err != nil {
+				log.ApplicationError(c.ctx).Err(err).Msg("error writing message")
+				c.Close()
+				return
+			}
+		case <-c.drain:
+			c.flush()
+			c.closeWithReason(websocket.CloseGoingAway, "server shutdown")
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// write writes a queued message to the connection, counting it by type with its write time
+func (c *Client) write(msg outbound) error {
+	c.conn.SetWriteDeadline(time.Now().Add(settings.writeWait))
+	start := time.Now()
+	if err := c.conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+		return err
+	}
+	metrics.ObserveSocketWrite(time.Since(start))
+	metrics.AddSocketMessage(constant.MetricsDirectionOut, metricsMessageType(msg.msgType), len(msg.data))
+	return nil
+}
+
+// countClientClose counts the close code of a connection the client closed or lost, the connections closed by
+// the server were counted when they were closed
+func (c *Client) countClientClose(err error) {
+	if c.closed() {
+		return
+	}
+	code := websocket.CloseAbnormalClosure
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		code = closeErr.Code
+	}
+	metrics.IncSocketCloses(constant.MetricsSideClient, code)
+}
+
+// flush writes whatever is left in the send queue
+func (c *Client) flush() {
+	for {
+		select {
+		case msg := <-c.send:
+			metrics.AddSocketSendQueueDepth(-1)
+			if err := c.write(msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// discardQueue keeps the queue depth metric right for messages that were never written
+func (c *Client) discardQueue() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	for {
+		select {
+		case <-c.send:
+			metrics.AddSocketSendQueueDepth(-1)
+		default:
+			return
+		}
+	}
+}
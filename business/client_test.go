@@ -0,0 +1,167 @@
+package business
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+)
+
+// withSocket gives the connection a socket, the frames written to it are read from the returned peer
+func withSocket(t *testing.T, c *Client) *websocket.Conn {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	c.conn = <-conns
+	t.Cleanup(func() { c.conn.Close() })
+	return peer
+}
+
+func TestClientSendOverflow(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.sendQueueSize = 2
+
+	tests := []struct {
+		name       string
+		policy     string
+		wantErrs   []error
+		wantQueued []string
+		wantClosed bool
+	}{
+		{name: "drop oldest", policy: constant.OverflowDropOldest, wantErrs: []error{nil, nil, nil}, wantQueued: []string{"b", "c"}},
+		{name: "drop newest", policy: constant.OverflowDropNewest, wantErrs: []error{nil, nil, ErrQueueFull}, wantQueued: []string{"a", "b"}},
+		{name: "disconnect", policy: constant.OverflowDisconnect, wantErrs: []error{nil, nil, ErrSlowConsumer}, wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.overflowPolicy = tt.policy
+			c := newTestClient("1", "parent")
+			peer := withSocket(t, c)
+			for i, data := range []string{"a", "b", "c"} {
+				if err := c.Send("test", []byte(data)); err != tt.wantErrs[i] {
+					t.Errorf("send %s: err = %v, want %v", data, err, tt.wantErrs[i])
+				}
+			}
+			if c.closed() != tt.wantClosed {
+				t.Fatalf("closed = %v, want %v", c.closed(), tt.wantClosed)
+			}
+			if tt.wantClosed {
+				peer.SetReadDeadline(time.Now().Add(time.Second))
+				_, _, err := peer.ReadMessage()
+				if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+					t.Errorf("peer got %v, want a try again later close", err)
+				}
+				if err := c.Send("test", []byte("d")); err != ErrClientClosed {
+					t.Errorf("send after close: err = %v, want %v", err, ErrClientClosed)
+				}
+				return
+			}
+			var queued []string
+			for len(c.send) > 0 {
+				queued = append(queued, string((<-c.send).data))
+			}
+			if strings.Join(queued, ",") != strings.Join(tt.wantQueued, ",") {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestClientStale(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.pongWait = time.Minute
+
+	tests := []struct {
+		name          string
+		noIdleTimeout bool
+		seen          time.Duration // since the last frame of any kind
+		active        time.Duration // since the last message of the client
+		wantStale     bool
+		wantCode      int
+		wantReason    string
+	}{
+		{name: "live", seen: 30 * time.Second, active: 5 * time.Minute},
+		{name: "pongs missed", seen: 2 * time.Minute, active: 2 * time.Minute, wantStale: true,
+			wantCode: websocket.CloseGoingAway, wantReason: "heartbeat timeout"},
+		{name: "idle while answering pings", seen: 30 * time.Second, active: 11 * time.Minute, wantStale: true,
+			wantCode: websocket.CloseNormalClosure, wantReason: "idle timeout"},
+		{name: "no idle timeout", noIdleTimeout: true, seen: 30 * time.Second, active: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.idleTimeout = 10 * time.Minute
+			if tt.noIdleTimeout {
+				settings.idleTimeout = 0
+			}
+			now := time.Now()
+			c := newTestClient("1", "parent")
+			c.lastSeen.Store(now.Add(-tt.seen).UnixNano())
+			c.lastActivity.Store(now.Add(-tt.active).UnixNano())
+			stale, code, reason := c.stale(now)
+			if stale != tt.wantStale || code != tt.wantCode || reason != tt.wantReason {
+				t.Errorf("stale = %v %d %q, want %v %d %q", stale, code, reason, tt.wantStale, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestClientReadLimit(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.maxMessageSize = 64
+
+	tests := []struct {
+		name       string
+		frame      string
+		wantClosed bool
+	}{
+		{name: "frame within the limit", frame: `{"type":"unknown","id":"1"}`},
+		{name: "frame over the limit", frame: `{"type":"unknown","id":"1","payload":"` + strings.Repeat("x", 64) + `"}`, wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", "parent")
+			peer := withSocket(t, c)
+			go c.reader()
+			if err := peer.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if !tt.wantClosed {
+				// the frame reached the router, which answers the unknown type with an error
+				if env := nextFrame(t, c); env.Type != constant.MessageTypeError || c.closed() {
+					t.Errorf("got %s with the connection closed %v, want an error frame on an open connection", env.Type, c.closed())
+				}
+				return
+			}
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err := peer.ReadMessage()
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("peer got %v, want a message too big close", err)
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Error("connection still open")
+			}
+		})
+	}
+}
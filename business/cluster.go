@@ -0,0 +1,564 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/backplane"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// timeout of a publish on the backplane
+const clusterPublishTimeout = 2 * time.Second
+
+// nodes not heard from for this many heartbeats are considered gone
+const clusterMissedHeartbeats = 3
+
+// clusterNode connects this node to the other nodes of the service over the backplane.
+// Every node tells the others about the presence of the users connected to it, which doubles as
+// the routing table: frames for a user are only published to the nodes the user is connected to.
+// Likewise frames for a topic only go to the nodes having subscribers for it.
+// The backplane delivers at most once, so every change of the state of a node bumps its version. The others
+// ask for its whole state again when a change skips a version or its heartbeat tells a version they do not have.
+type clusterNode struct {
+	id        string
+	prefix    string
+	backplane backplane.Backplane
+
+	mu sync.RWMutex
+	// user key to the presence of the user on each other node it is connected to
+	routes map[string]map[string]string
+	// topic pattern to the other nodes having subscribers for it
+	topicRoutes map[string]map[string]struct{}
+	// last time each other node was heard from
+	nodes map[string]time.Time
+	// presence of the users on this node and topic patterns it has subscribers for, as last told to the others
+	announced       map[string]string
+	announcedTopics map[string]struct{}
+	// version of the state of this node, and of the state of each other node as last applied here
+	version  uint64
+	versions map[string]uint64
+	// held from the version bump of a change to its publish, so the other nodes get the versions in order
+	// without mu being held while publishing
+	changeMu sync.Mutex
+	// last time the state of each other node was asked for
+	syncs map[string]time.Time
+	// interval of the heartbeats, also the minimum interval between two state requests to a node
+	interval time.Duration
+	stop     chan struct{}
+}
+
+func newClusterNode(b backplane.Backplane, prefix string) *clusterNode {
+	return &clusterNode{
+		id:              nodeID(),
+		prefix:          prefix,
+		backplane:       b,
+		routes:          make(map[string]map[string]string),
+		topicRoutes:     make(map[string]map[string]struct{}),
+		nodes:           make(map[string]time.Time),
+		announced:       make(map[string]string),
+		announcedTopics: make(map[string]struct{}),
+		versions:        make(map[string]uint64),
+		syncs:           make(map[string]time.Time),
+		stop:            make(chan struct{}),
+	}
+}
+
+var cluster = newClusterNode(backplane.NewMemoryBackplane(), "ms-pet-socket")
+
+func nodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
+	}
+	return host + "-" + uuid.New().String()[:8]
+}
+
+// initBackplane connects this node to the backplane configured in application.yml
+func initBackplane(ctx context.Context) error {
+	prefix := configs.GetAppConfigD(constant.ClusterChannelPrefixKey, cluster.prefix)
+	var b backplane.Backplane
+	switch backplaneType := configs.GetAppConfigD(constant.ClusterBackplaneKey, constant.BackplaneMemory); backplaneType {
+	case constant.BackplaneMemory:
+		b = backplane.NewMemoryBackplane()
+	case constant.BackplaneRedis:
+		var err error
+		if b, err = backplane.NewRedisBackplane(ctx, constant.RedisserverDB); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown backplane %s", backplaneType)
+	}
+	cluster = newClusterNode(b, prefix)
+	heartbeat := millis(configs.GetAppConfigIntD(constant.ClusterHeartbeatIntervalInMillisKey, 5000))
+	return cluster.start(ctx, heartbeat)
+}
+
+// CloseBackplane tells the other nodes this node is leaving and disconnects from the backplane
+func CloseBackplane(ctx context.Context) error {
+	return cluster.close(ctx)
+}
+
+func (n *clusterNode) allChannel() string {
+	return n.prefix + ":all"
+}
+
+func (n *clusterNode) nodeChannel(node string) string {
+	return n.prefix + ":node:" + node
+}
+
+func (n *clusterNode) start(ctx context.Context, heartbeat time.Duration) error {
+	if err := n.backplane.Subscribe(ctx, n.handle, n.allChannel(), n.nodeChannel(n.id)); err != nil {
+		return err
+	}
+	log.ApplicationInfo(ctx).Str("node", n.id).Msg("joined the cluster")
+	n.interval = heartbeat
+	n.publish("", &models.ClusterMessage{Kind: constant.ClusterKindHello})
+	go n.heartbeat(heartbeat)
+	return nil
+}
+
+func (n *clusterNode) close(ctx context.Context) error {
+	close(n.stop)
+	n.publish("", &models.ClusterMessage{Kind: constant.ClusterKindBye})
+	return n.backplane.Close()
+}
+
+// heartbeat tells the others this node is alive and the version of its state, and forgets the nodes that went silent
+func (n *clusterNode) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.changeMu.Lock()
+			n.mu.RLock()
+			version := n.version
+			n.mu.RUnlock()
+			n.publish("", &models.ClusterMessage{Kind: constant.ClusterKindHeartbeat, Version: version})
+			n.changeMu.Unlock()
+			for _, node := range n.silentNodes(now.Add(-clusterMissedHeartbeats * interval)) {
+				log.ApplicationWarn(context.Background()).Str("node", node).Msg("node stopped sending heartbeats")
+				n.dropNode(node)
+			}
+		}
+	}
+}
+
+// publish sends the message to the node, or to every node when node is empty
+func (n *clusterNode) publish(node string, msg *models.ClusterMessage) bool {
+	msg.Origin = n.id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	channel := n.allChannel()
+	if node != "" {
+		channel = n.nodeChannel(node)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+	defer cancel()
+	if err := n.backplane.Publish(ctx, channel, data); err != nil {
+		log.ApplicationError(ctx).Err(err).Str("kind", msg.Kind).Str("channel", channel).Msg("error publishing on backplane")
+		return false
+	}
+	return true
+}
+
+// forward publishes the message to the other nodes the user is connected to and returns the number of them
+func (n *clusterNode) forward(msg *models.ClusterMessage) int {
+	forwarded := 0
+	for _, node := range n.userNodes(msg.UserID) {
+		if n.publish(node, msg) {
+			forwarded++
+		}
+	}
+	return forwarded
+}
+
+// forwardBroadcast publishes the data to every other node and returns the number of them known to be alive
+func (n *clusterNode) forwardBroadcast(msgType string, data []byte) int {
+	if !n.publish("", &models.ClusterMessage{Kind: constant.ClusterKindBroadcast, MessageType: msgType, Data: data}) {
+		return 0
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.nodes)
+}
+
+// forwardEvent publishes the event to the other nodes the user is connected to, they sequence it for their connections
+func (n *clusterNode) forwardEvent(userID string, env *models.Envelope, exceptDevice string) int {
+	if len(n.userNodes(userID)) == 0 {
+		return 0
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return 0
+	}
+	return n.forward(&models.ClusterMessage{Kind: constant.ClusterKindEvent, UserID: userID, ExceptDevice: exceptDevice, Data: data})
+}
+
+// announce tells the other nodes about the presence of the user on this node when it changed. The presence is
+// read under changeMu with the version given to it, so concurrent changes are published in the order they were read.
+func (n *clusterNode) announce(userID string, presence func() string) {
+	key := userKey(userID)
+	n.changeMu.Lock()
+	defer n.changeMu.Unlock()
+	status := presence()
+	n.mu.Lock()
+	if last, ok := n.announced[key]; (ok && last == status) || (!ok && status == constant.PresenceOffline) {
+		n.mu.Unlock()
+		return
+	}
+	if status == constant.PresenceOffline {
+		delete(n.announced, key)
+	} else {
+		n.announced[key] = status
+	}
+	n.version++
+	version := n.version
+	n.mu.Unlock()
+	n.publish("", &models.ClusterMessage{Kind: constant.ClusterKindPresence, UserID: userID, Status: status, Version: version})
+}
+
+// announceTopics tells the other nodes this node got its first subscriber for the patterns, or lost its last one.
+// Whether the node has subscribers is read under changeMu, a subscribe and an unsubscribe racing each other
+// cannot be published in the wrong order.
+func (n *clusterNode) announceTopics(patterns []string, subscribed func(pattern string) bool) {
+	n.changeMu.Lock()
+	defer n.changeMu.Unlock()
+	for _, pattern := range patterns {
+		has := subscribed(pattern)
+		n.mu.Lock()
+		if _, was := n.announcedTopics[pattern]; was == has {
+			n.mu.Unlock()
+			continue
+		}
+		kind := constant.ClusterKindUnsubscribe
+		if has {
+			n.announcedTopics[pattern] = struct{}{}
+			kind = constant.ClusterKindSubscribe
+		} else {
+			delete(n.announcedTopics, pattern)
+		}
+		n.version++
+		version := n.version
+		n.mu.Unlock()
+		n.publish("", &models.ClusterMessage{Kind: kind, Topic: pattern, Version: version})
+	}
+}
+
+// state returns the state of this node, for the nodes that do not have it. The version is read first, a change made
+// meanwhile is in the state and its own message only applies it again.
+func (n *clusterNode) state() *models.ClusterMessage {
+	n.mu.RLock()
+	version := n.version
+	state := make(map[string]string, len(n.announced))
+	for user, status := range n.announced {
+		state[user] = status
+	}
+	n.mu.RUnlock()
+	return &models.ClusterMessage{Kind: constant.ClusterKindState, Presence: state, Patterns: topics.patterns(nil),
+		Revocations: revocations(), Version: version}
+}
+
+// applied records the version of the change of the node just applied, asking for the whole state of the node
+// when a change was missed
+func (n *clusterNode) applied(node string, version uint64) {
+	n.mu.Lock()
+	inOrder := version == n.versions[node]+1
+	if inOrder {
+		n.versions[node] = version
+	}
+	n.mu.Unlock()
+	if !inOrder {
+		n.requestState(node)
+	}
+}
+
+// checkVersion asks for the whole state of the node when its heartbeat tells a version this node does not have
+func (n *clusterNode) checkVersion(node string, version uint64) {
+	n.mu.RLock()
+	current := n.versions[node] == version
+	n.mu.RUnlock()
+	if !current {
+		n.requestState(node)
+	}
+}
+
+// requestState asks the node for its whole state, at most once per heartbeat interval
+func (n *clusterNode) requestState(node string) {
+	now := time.Now()
+	n.mu.Lock()
+	if last, ok := n.syncs[node]; ok && now.Sub(last) < n.interval {
+		n.mu.Unlock()
+		return
+	}
+	n.syncs[node] = now
+	n.mu.Unlock()
+	log.ApplicationInfo(context.Background()).Str("node", node).Msg("routes of node out of date, asking for its state")
+	n.publish(node, &models.ClusterMessage{Kind: constant.ClusterKindSync})
+}
+
+// replaceState replaces the routes through the node with its whole state and updates the presence of the users
+// whose routes changed
+func (n *clusterNode) replaceState(node string, state map[string]string, patterns []string, version uint64) {
+	n.mu.Lock()
+	users := make(map[string]struct{})
+	for key, routes := range n.routes {
+		if _, ok := routes[node]; !ok {
+			continue
+		}
+		delete(routes, node)
+		if len(routes) == 0 {
+			delete(n.routes, key)
+		}
+		users[key] = struct{}{}
+	}
+	for key, status := range state {
+		if status == constant.PresenceOffline {
+			continue
+		}
+		key = userKey(key)
+		if n.routes[key] == nil {
+			n.routes[key] = make(map[string]string)
+		}
+		n.routes[key][node] = status
+		users[key] = struct{}{}
+	}
+	for pattern, routes := range n.topicRoutes {
+		delete(routes, node)
+		if len(routes) == 0 {
+			delete(n.topicRoutes, pattern)
+		}
+	}
+	for _, pattern := range patterns {
+		if n.topicRoutes[pattern] == nil {
+			n.topicRoutes[pattern] = make(map[string]struct{})
+		}
+		n.topicRoutes[pattern][node] = struct{}{}
+	}
+	n.versions[node] = version
+	delete(n.syncs, node)
+	n.mu.Unlock()
+	for user := range users {
+		presence.notify(user)
+	}
+}
+
+// forwardTopic publishes the frame to the other nodes having subscribers for the topic and returns the number of them
+func (n *clusterNode) forwardTopic(topic, msgType string, data []byte) int {
+	forwarded := 0
+	for _, node := range n.topicNodes(topic) {
+		if n.publish(node, &models.ClusterMessage{Kind: constant.ClusterKindTopic, Topic: topic, MessageType: msgType, Data: data}) {
+			forwarded++
+		}
+	}
+	return forwarded
+}
+
+// topicNodes returns the other nodes having subscribers for the topic
+func (n *clusterNode) topicNodes(topic string) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var nodes []string
+	for pattern, routes := range n.topicRoutes {
+		if !topicMatches(pattern, topic) {
+			continue
+		}
+		for node := range routes {
+			if _, ok := seen[node]; !ok {
+				seen[node] = struct{}{}
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes
+}
+
+func (n *clusterNode) setTopicRoute(pattern, node string, subscribed bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !subscribed {
+		delete(n.topicRoutes[pattern], node)
+		if len(n.topicRoutes[pattern]) == 0 {
+			delete(n.topicRoutes, pattern)
+		}
+		return
+	}
+	if n.topicRoutes[pattern] == nil {
+		n.topicRoutes[pattern] = make(map[string]struct{})
+	}
+	n.topicRoutes[pattern][node] = struct{}{}
+}
+
+// userNodes returns the other nodes the user is connected to
+func (n *clusterNode) userNodes(userID string) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	routes := n.routes[userKey(userID)]
+	nodes := make([]string, 0, len(routes))
+	for node := range routes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// presence returns the presence of the user on each other node it is connected to
+func (n *clusterNode) presence(userID string) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	routes := n.routes[userKey(userID)]
+	statuses := make([]string, 0, len(routes))
+	for _, status := range routes {
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (n *clusterNode) setRoute(userID, node, status string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := userKey(userID)
+	if status == constant.PresenceOffline {
+		delete(n.routes[key], node)
+		if len(n.routes[key]) == 0 {
+			delete(n.routes, key)
+		}
+		return
+	}
+	if n.routes[key] == nil {
+		n.routes[key] = make(map[string]string)
+	}
+	n.routes[key][node] = status
+}
+
+func (n *clusterNode) seen(node string, at time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[node] = at
+}
+
+func (n *clusterNode) silentNodes(since time.Time) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var silent []string
+	for node, at := range n.nodes {
+		if at.Before(since) {
+			silent = append(silent, node)
+		}
+	}
+	return silent
+}
+
+// dropNode forgets the routes through the node and updates the presence of the users that were connected to it
+func (n *clusterNode) dropNode(node string) {
+	n.mu.Lock()
+	delete(n.nodes, node)
+	delete(n.versions, node)
+	delete(n.syncs, node)
+	var users []string
+	for key, routes := range n.routes {
+		if _, ok := routes[node]; !ok {
+			continue
+		}
+		delete(routes, node)
+		if len(routes) == 0 {
+			delete(n.routes, key)
+		}
+		users = append(users, key)
+	}
+	for pattern, routes := range n.topicRoutes {
+		delete(routes, node)
+		if len(routes) == 0 {
+			delete(n.topicRoutes, pattern)
+		}
+	}
+	n.mu.Unlock()
+	for _, user := range users {
+		presence.notify(user)
+	}
+}
+
+// handle runs the messages received from the other nodes
+func (n *clusterNode) handle(channel string, data []byte) {
+	msg := &models.ClusterMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		log.ApplicationError(context.Background()).Err(err).Str("channel", channel).Msg("malformed backplane message")
+		return
+	}
+	if msg.Origin == n.id {
+		return
+	}
+	n.seen(msg.Origin, time.Now())
+
+	switch msg.Kind {
+	case constant.ClusterKindHello, constant.ClusterKindSync:
+		n.publish(msg.Origin, n.state())
+	case constant.ClusterKindState:
+		n.replaceState(msg.Origin, msg.Presence, msg.Patterns, msg.Version)
+		for _, r := range msg.Revocations {
+			if storeRevocation(r) {
+				enforceRevocation(r)
+			}
+		}
+	case constant.ClusterKindHeartbeat:
+		n.checkVersion(msg.Origin, msg.Version)
+	case constant.ClusterKindBye:
+		n.dropNode(msg.Origin)
+	case constant.ClusterKindPresence:
+		n.setRoute(msg.UserID, msg.Origin, msg.Status)
+		presence.notify(msg.UserID)
+		n.applied(msg.Origin, msg.Version)
+	case constant.ClusterKindUser:
+		send(hub.Clients(msg.UserID), msg.MessageType, msg.Data)
+	case constant.ClusterKindDevice:
+		hub.sendToDevice(msg.UserID, msg.DeviceID, msg.MessageType, msg.Data)
+	case constant.ClusterKindBroadcast:
+		send(hub.all(), msg.MessageType, msg.Data)
+	case constant.ClusterKindSubscribe:
+		n.setTopicRoute(msg.Topic, msg.Origin, true)
+		n.applied(msg.Origin, msg.Version)
+	case constant.ClusterKindUnsubscribe:
+		n.setTopicRoute(msg.Topic, msg.Origin, false)
+		n.applied(msg.Origin, msg.Version)
+	case constant.ClusterKindTopic:
+		send(topics.matching(msg.Topic), msg.MessageType, msg.Data)
+	case constant.ClusterKindRevoke:
+		if msg.Revocation != nil && storeRevocation(*msg.Revocation) {
+			enforceRevocation(*msg.Revocation)
+		}
+	case constant.ClusterKindEvent:
+		env := &models.Envelope{}
+		if err := json.Unmarshal(msg.Data, env); err != nil {
+			return
+		}
+		pushToUser(msg.UserID, env, "", msg.ExceptDevice)
+	case constant.ClusterKindChat:
+		chat := models.ChatMessage{}
+		if err := json.Unmarshal(msg.Data, &chat); err != nil {
+			return
+		}
+		delivered, err := deliverChatMessageLocal(chat)
+		if err != nil || delivered > 0 {
+			return
+		}
+		// the recipient left this node before the message arrived
+		if err := messageStore.Enqueue(context.Background(), userKey(chat.To), chat.ID); err != nil {
+			log.ApplicationError(context.Background()).Err(err).Str("messageID", chat.ID).Msg("error queueing forwarded message")
+		}
+	default:
+		log.ApplicationWarn(context.Background()).Str("kind", msg.Kind).Msg("unknown backplane message")
+	}
+}
@@ -0,0 +1,214 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/backplane"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestClusterApplied(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		versions    []uint64
+		wantVersion uint64
+		wantSyncs   int
+	}{
+		{name: "in order", versions: []uint64{1, 2, 3}, wantVersion: 3},
+		{name: "version skipped", versions: []uint64{1, 3}, wantVersion: 1, wantSyncs: 1},
+		{name: "version applied again", versions: []uint64{1, 2, 2}, wantVersion: 2, wantSyncs: 1},
+		{name: "first change missed", versions: []uint64{2}, wantSyncs: 1},
+		{name: "state asked for once per interval", interval: time.Hour, versions: []uint64{2, 3, 4}, wantSyncs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := backplane.NewMemoryBackplane()
+			t.Cleanup(func() { b.Close() })
+			n := newClusterNode(b, "test")
+			n.interval = tt.interval
+			syncs := make(chan string, 10)
+			err := b.Subscribe(context.Background(), func(channel string, data []byte) {
+				msg := models.ClusterMessage{}
+				if json.Unmarshal(data, &msg) == nil && msg.Kind == constant.ClusterKindSync {
+					syncs <- msg.Origin
+				}
+			}, n.nodeChannel("peer"))
+			if err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+
+			for _, version := range tt.versions {
+				n.applied("peer", version)
+			}
+			if n.versions["peer"] != tt.wantVersion {
+				t.Errorf("version = %d, want %d", n.versions["peer"], tt.wantVersion)
+			}
+			got := 0
+			for timeout := time.After(100 * time.Millisecond); ; {
+				select {
+				case <-syncs:
+					got++
+					continue
+				case <-timeout:
+				}
+				break
+			}
+			if got != tt.wantSyncs {
+				t.Errorf("state asked for %d times, want %d", got, tt.wantSyncs)
+			}
+		})
+	}
+}
+
+// slowFirstChange holds back the publish of the first change of the node, as a slow network would
+type slowFirstChange struct {
+	backplane.Backplane
+}
+
+func (b slowFirstChange) Publish(ctx context.Context, channel string, data []byte) error {
+	msg := models.ClusterMessage{}
+	if json.Unmarshal(data, &msg) == nil && msg.Kind == constant.ClusterKindPresence && msg.Version == 1 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return b.Backplane.Publish(ctx, channel, data)
+}
+
+func TestClusterAnnounceInOrder(t *testing.T) {
+	ctx := context.Background()
+	b := backplane.NewMemoryBackplane()
+	watcher, announcer := newClusterNode(b, "test"), newClusterNode(slowFirstChange{b}, "test")
+	for _, n := range []*clusterNode{watcher, announcer} {
+		if err := n.start(ctx, time.Hour); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+	// the handlers of both nodes are done once the backplane is closed, none outlives the test
+	t.Cleanup(func() {
+		announcer.close(ctx)
+		watcher.close(ctx)
+		b.Close()
+	})
+	var syncs atomic.Int32
+	err := b.Subscribe(ctx, func(channel string, data []byte) {
+		msg := models.ClusterMessage{}
+		if json.Unmarshal(data, &msg) == nil && msg.Kind == constant.ClusterKindSync {
+			syncs.Add(1)
+		}
+	}, announcer.nodeChannel(announcer.id))
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// the changes made while the first one is being published have to reach the other nodes after it
+	const users = 10
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			announcer.announce(user, func() string { return constant.PresenceOnline })
+		}("cluster-" + strconv.Itoa(i))
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		watcher.mu.RLock()
+		version, routes := watcher.versions[announcer.id], len(watcher.routes)
+		watcher.mu.RUnlock()
+		if syncs.Load() > 0 {
+			t.Fatalf("state asked for at version %d, changes arrived out of order", version)
+		}
+		if version == users && routes == users {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("version %d with %d routes, want %d", version, routes, users)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterForwardBroadcast(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []string
+		closed bool
+		want   int
+	}{
+		{name: "no other node", want: 0},
+		{name: "other nodes", nodes: []string{"a", "b"}, want: 2},
+		{name: "backplane down", nodes: []string{"a"}, closed: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := backplane.NewMemoryBackplane()
+			t.Cleanup(func() { b.Close() })
+			n := newClusterNode(b, "test")
+			for _, node := range tt.nodes {
+				n.seen(node, time.Now())
+			}
+			if tt.closed {
+				b.Close()
+			}
+			if got := n.forwardBroadcast("notice", []byte("{}")); got != tt.want {
+				t.Errorf("forwarded to %d nodes, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterAnnounceTopics(t *testing.T) {
+	b := backplane.NewMemoryBackplane()
+	t.Cleanup(func() { b.Close() })
+	n := newClusterNode(b, "test")
+	published := make(chan models.ClusterMessage, 10)
+	err := b.Subscribe(context.Background(), func(channel string, data []byte) {
+		msg := models.ClusterMessage{}
+		if json.Unmarshal(data, &msg) == nil {
+			published <- msg
+		}
+	}, n.allChannel())
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// what the registry tells when the announce runs, not what the caller saw, decides what is published
+	steps := []struct {
+		name        string
+		subscribed  bool
+		wantKind    string
+		wantVersion uint64
+	}{
+		{name: "first subscriber", subscribed: true, wantKind: constant.ClusterKindSubscribe, wantVersion: 1},
+		{name: "racing first subscriber", subscribed: true},
+		{name: "last subscriber gone", wantKind: constant.ClusterKindUnsubscribe, wantVersion: 2},
+		{name: "subscribe announced after the unsubscribe of the last one"},
+		{name: "first subscriber again", subscribed: true, wantKind: constant.ClusterKindSubscribe, wantVersion: 3},
+	}
+	for _, step := range steps {
+		n.announceTopics([]string{"city:*:alerts"}, func(string) bool { return step.subscribed })
+		select {
+		case msg := <-published:
+			if msg.Kind != step.wantKind || msg.Version != step.wantVersion || msg.Topic != "city:*:alerts" {
+				t.Fatalf("%s: published %s %s at version %d, want %s at version %d", step.name, msg.Kind, msg.Topic, msg.Version,
+					step.wantKind, step.wantVersion)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if step.wantKind != "" {
+				t.Fatalf("%s: nothing published, want %s", step.name, step.wantKind)
+			}
+		}
+	}
+}
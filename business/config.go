@@ -0,0 +1,165 @@
+package business
+
+import (
+	"context"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// socketConfig is the tuning of the socket connections, read from the socket block of application.yml
+type socketConfig struct {
+	sendQueueSize  int
+	overflowPolicy string
+	writeWait      time.Duration
+	pingPeriod     time.Duration
+	pongWait       time.Duration
+	// largest frame read from a client, bigger ones close the connection with 1009
+	maxMessageSize int
+	idleTimeout    time.Duration
+	reapInterval   time.Duration
+	reconnectDelay time.Duration
+	// upper bound of the random delay added to reconnectDelay, so clients do not all come back at once
+	reconnectJitter time.Duration
+	ackTimeout      time.Duration
+	maxRetransmits  int
+	// events kept per user for replay on resume, and how long the session of a closed connection can be resumed
+	replayBufferSize int
+	resumeTTL        time.Duration
+	// live connections of a user and of one device of a user on this node, 0 for no limit
+	maxConnectionsPerUser   int
+	maxConnectionsPerDevice int
+	connectionLimitPolicy   string
+}
+
+var settings = defaultSocketConfig()
+
+func defaultSocketConfig() socketConfig {
+	return socketConfig{
+		sendQueueSize:    256,
+		overflowPolicy:   constant.OverflowDropOldest,
+		writeWait:        10 * time.Second,
+		pingPeriod:       25 * time.Second,
+		pongWait:         60 * time.Second,
+		maxMessageSize:   64 * 1024,
+		idleTimeout:      10 * time.Minute,
+		reapInterval:     30 * time.Second,
+		reconnectDelay:   time.Second,
+		reconnectJitter:  5 * time.Second,
+		ackTimeout:       10 * time.Second,
+		maxRetransmits:   3,
+		replayBufferSize: 500,
+		resumeTTL:        5 * time.Minute,
+		// a device coming back replaces the connection it has not noticed is dead yet
+		connectionLimitPolicy: constant.ConnectionLimitEvictOldest,
+	}
+}
+
+func loadSocketConfig() socketConfig {
+	cfg := defaultSocketConfig()
+	cfg.sendQueueSize = configs.GetAppConfigIntD(constant.SocketSendQueueSizeKey, cfg.sendQueueSize)
+	cfg.overflowPolicy = configs.GetAppConfigD(constant.SocketOverflowPolicyKey, cfg.overflowPolicy)
+	cfg.writeWait = millis(configs.GetAppConfigIntD(constant.SocketWriteWaitInMillisKey, int(cfg.writeWait.Milliseconds())))
+	cfg.pingPeriod = millis(configs.GetAppConfigIntD(constant.SocketPingPeriodInMillisKey, int(cfg.pingPeriod.Milliseconds())))
+	cfg.pongWait = millis(configs.GetAppConfigIntD(constant.SocketPongWaitInMillisKey, int(cfg.pongWait.Milliseconds())))
+	cfg.maxMessageSize = configs.GetAppConfigIntD(constant.SocketMaxMessageSizeInBytesKey, cfg.maxMessageSize)
+	cfg.idleTimeout = millis(configs.GetAppConfigIntD(constant.SocketIdleTimeoutInMillisKey, int(cfg.idleTimeout.Milliseconds())))
+	cfg.reapInterval = millis(configs.GetAppConfigIntD(constant.SocketReapIntervalInMillisKey, int(cfg.reapInterval.Milliseconds())))
+	cfg.reconnectDelay = millis(configs.GetAppConfigIntD(constant.SocketReconnectDelayInMillisKey, int(cfg.reconnectDelay.Milliseconds())))
+	cfg.reconnectJitter = millis(configs.GetAppConfigIntD(constant.SocketReconnectJitterInMillisKey, int(cfg.reconnectJitter.Milliseconds())))
+	cfg.ackTimeout = millis(configs.GetAppConfigIntD(constant.ChatAckTimeoutInMillisKey, int(cfg.ackTimeout.Milliseconds())))
+	cfg.maxRetransmits = configs.GetAppConfigIntD(constant.ChatMaxRetransmitsKey, cfg.maxRetransmits)
+	cfg.replayBufferSize = configs.GetAppConfigIntD(constant.SocketReplayBufferSizeKey, cfg.replayBufferSize)
+	cfg.resumeTTL = millis(configs.GetAppConfigIntD(constant.SocketResumeTtlInMillisKey, int(cfg.resumeTTL.Milliseconds())))
+	cfg.maxConnectionsPerUser = configs.GetAppConfigIntD(constant.SocketMaxConnectionsPerUserKey, cfg.maxConnectionsPerUser)
+	cfg.maxConnectionsPerDevice = configs.GetAppConfigIntD(constant.SocketMaxConnectionsPerDeviceKey, cfg.maxConnectionsPerDevice)
+	cfg.connectionLimitPolicy = configs.GetAppConfigD(constant.SocketConnectionLimitPolicyKey, cfg.connectionLimitPolicy)
+	return cfg.withDefaults()
+}
+
+// withDefaults replaces the unknown policies and the values out of range with their defaults
+func (cfg socketConfig) withDefaults() socketConfig {
+	defaults := defaultSocketConfig()
+	switch cfg.overflowPolicy {
+	case constant.OverflowDropOldest, constant.OverflowDropNewest, constant.OverflowDisconnect:
+	default:
+		log.ApplicationWarn(context.Background()).Str(constant.SocketOverflowPolicyKey, cfg.overflowPolicy).Msg("unknown overflow policy, falling back to " + constant.OverflowDropOldest)
+		cfg.overflowPolicy = constant.OverflowDropOldest
+	}
+	switch cfg.connectionLimitPolicy {
+	case constant.ConnectionLimitRejectNew, constant.ConnectionLimitEvictOldest:
+	default:
+		log.ApplicationWarn(context.Background()).Str(constant.SocketConnectionLimitPolicyKey, cfg.connectionLimitPolicy).Msg("unknown connection limit policy, falling back to " + constant.ConnectionLimitEvictOldest)
+		cfg.connectionLimitPolicy = constant.ConnectionLimitEvictOldest
+	}
+	if cfg.sendQueueSize <= 0 {
+		cfg.sendQueueSize = defaults.sendQueueSize
+	}
+	if cfg.maxMessageSize <= 0 {
+		cfg.maxMessageSize = defaults.maxMessageSize
+	}
+	if cfg.replayBufferSize <= 0 {
+		cfg.replayBufferSize = defaults.replayBufferSize
+	}
+	// both drive tickers, which panic on a period that is not positive
+	if cfg.pongWait <= 0 {
+		log.ApplicationWarn(context.Background()).Int64(constant.SocketPongWaitInMillisKey, cfg.pongWait.Milliseconds()).Msg("pong wait must be positive, falling back to the default")
+		cfg.pongWait = defaults.pongWait
+	}
+	if cfg.reapInterval <= 0 {
+		log.ApplicationWarn(context.Background()).Int64(constant.SocketReapIntervalInMillisKey, cfg.reapInterval.Milliseconds()).Msg("reap interval must be positive, falling back to the default")
+		cfg.reapInterval = defaults.reapInterval
+	}
+	// a ping has to go out before the pong wait runs out
+	if cfg.pingPeriod <= 0 || cfg.pingPeriod >= cfg.pongWait {
+		cfg.pingPeriod = cfg.pongWait * 9 / 10
+	}
+	return cfg
+}
+
+// retransmitInterval checks for timed out acks often enough to retransmit close to the timeout
+func retransmitInterval(ackTimeout time.Duration) time.Duration {
+	if interval := ackTimeout / 4; interval > time.Second {
+		return interval
+	}
+	return time.Second
+}
+
+func millis(value int) time.Duration {
+	return time.Duration(value) * time.Millisecond
+}
+
+// Init loads the socket configuration, registers the message handlers and starts the reaper.
+// It has to be called after the configs are initialised.
+func Init() {
+	settings = loadSocketConfig()
+	log.ApplicationInfo(context.Background()).Int(constant.SocketSendQueueSizeKey, settings.sendQueueSize).
+		Str(constant.SocketOverflowPolicyKey, settings.overflowPolicy).Msg("socket configuration loaded")
+
+	if err := initOrigins(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising origin allowlist")
+	}
+	if err := initAuthorization(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising authorization policy")
+	}
+	if err := initChatPolicy(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising chat policy")
+	}
+	if err := initMessageStore(context.Background()); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising message store")
+	}
+	if err := initBackplane(context.Background()); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising backplane")
+	}
+	if err := initEventBridge(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising event bridge")
+	}
+	if err := initActivity(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error initialising activity producer")
+	}
+	registerHandlers()
+	go hub.reaper(settings.reapInterval)
+	go hub.retransmitter(retransmitInterval(settings.ackTimeout))
+}
@@ -0,0 +1,45 @@
+package business
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+)
+
+func TestSocketConfigWithDefaults(t *testing.T) {
+	defaults := defaultSocketConfig()
+	tests := []struct {
+		name   string
+		change func(cfg *socketConfig)
+		check  func(cfg socketConfig) bool
+	}{
+		{name: "zero pong wait", change: func(cfg *socketConfig) { cfg.pongWait = 0 },
+			check: func(cfg socketConfig) bool {
+				return cfg.pongWait == defaults.pongWait && cfg.pingPeriod > 0 && cfg.pingPeriod < cfg.pongWait
+			}},
+		{name: "negative pong wait", change: func(cfg *socketConfig) { cfg.pongWait, cfg.pingPeriod = -time.Second, 0 },
+			check: func(cfg socketConfig) bool {
+				return cfg.pongWait == defaults.pongWait && cfg.pingPeriod == defaults.pongWait*9/10
+			}},
+		{name: "zero reap interval", change: func(cfg *socketConfig) { cfg.reapInterval = 0 },
+			check: func(cfg socketConfig) bool { return cfg.reapInterval == defaults.reapInterval }},
+		{name: "negative reap interval", change: func(cfg *socketConfig) { cfg.reapInterval = -time.Second },
+			check: func(cfg socketConfig) bool { return cfg.reapInterval == defaults.reapInterval }},
+		{name: "ping period past the pong wait", change: func(cfg *socketConfig) { cfg.pingPeriod = 2 * cfg.pongWait },
+			check: func(cfg socketConfig) bool { return cfg.pingPeriod == cfg.pongWait*9/10 }},
+		{name: "unknown overflow policy", change: func(cfg *socketConfig) { cfg.overflowPolicy = "drop-everything" },
+			check: func(cfg socketConfig) bool { return cfg.overflowPolicy == constant.OverflowDropOldest }},
+		{name: "values in range kept", change: func(cfg *socketConfig) { cfg.pongWait, cfg.reapInterval = time.Second, time.Second },
+			check: func(cfg socketConfig) bool { return cfg.pongWait == time.Second && cfg.reapInterval == time.Second }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultSocketConfig()
+			tt.change(&cfg)
+			if got := cfg.withDefaults(); !tt.check(got) {
+				t.Errorf("config %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package business
+
+import (
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+// registerHandlers registers the handlers of the message types served by this package
+func registerHandlers() {
+	RegisterHandler(constant.MessageTypePing, handlePing)
+	RegisterHandler(constant.MessageTypeChatSend, handleChatSend)
+	RegisterHandler(constant.MessageTypeHistoryFetch, handleHistoryFetch)
+	RegisterHandler(constant.MessageTypeAck, handleAck)
+	RegisterHandler(constant.MessageTypePresenceSet, handlePresenceSet)
+	RegisterHandler(constant.MessageTypePresenceSubscribe, handlePresenceSubscribe)
+	RegisterHandler(constant.MessageTypePresenceUnsubscribe, handlePresenceUnsubscribe)
+	RegisterHandler(constant.MessageTypeTypingStart, handleTyping)
+	RegisterHandler(constant.MessageTypeTypingStop, handleTyping)
+	RegisterHandler(constant.MessageTypeSubscribe, handleSubscribe)
+	RegisterHandler(constant.MessageTypeUnsubscribe, handleUnsubscribe)
+	RegisterHandler(constant.MessageTypePublish, handlePublish)
+	RegisterHandler(constant.MessageTypeAuthRefresh, handleAuthRefresh)
+}
+
+// handlePing answers the application level ping with the server time
+func handlePing(mc *MessageContext) error {
+	return mc.Reply(constant.MessageTypePong, models.Pong{DT: time.Now()})
+}
@@ -0,0 +1,249 @@
+package business
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// Hub is the registry of every live connection of this process, keyed by user and then by connection
+type Hub struct {
+	mu    sync.RWMutex
+	users map[string]map[string]*Client
+	// set once shutdown starts, no new connections are accepted after that
+	draining atomic.Bool
+}
+
+// NewHub is used to create an empty hub
+func NewHub() *Hub {
+	return &Hub{
+		users: make(map[string]map[string]*Client),
+	}
+}
+
+var hub = NewHub()
+
+// GetHub returns the hub of this process
+func GetHub() *Hub {
+	return hub
+}
+
+// user ids are matched case insensitively, same as the token validation
+func userKey(userID string) string {
+	return strings.ToUpper(strings.TrimSpace(userID))
+}
+
+// Register adds the client to the hub and updates the presence of its user. Connections going over the
+// connection limits of this node are closed, the oldest ones or the new one depending on the policy.
+// It returns false when the new connection is the one refused, it is closed without ever joining the hub.
+func (h *Hub) Register(c *Client) bool {
+	evicted, added := h.add(c)
+	if added {
+		presence.refresh(c.UserID)
+	}
+	for _, e := range evicted {
+		h.evict(e, c)
+	}
+	return added
+}
+
+// add returns the connections to close for the new one to fit in the limits, and whether the new one was kept.
+// The limits are checked under the lock, so of concurrent upgrades that all passed admits only those fitting are kept.
+func (h *Hub) add(c *Client) ([]*Client, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := userKey(c.UserID)
+	clients, ok := h.users[key]
+	if !ok {
+		clients = make(map[string]*Client)
+		h.users[key] = clients
+	}
+	clients[c.ID] = c
+	evicted := overLimit(clients, c)
+	if containsClient(evicted, c) {
+		delete(clients, c.ID)
+		if len(clients) == 0 {
+			delete(h.users, key)
+		}
+		return evicted, false
+	}
+	return evicted, true
+}
+
+// Unregister removes the client from the hub, drops its presence and topic subscriptions and updates the presence of its user.
+// It is safe to call more than once. The client is closed first, so subscriptions racing the removal are refused.
+func (h *Hub) Unregister(c *Client) {
+	c.Close()
+	if !h.remove(c) {
+		return
+	}
+	presence.forget(c)
+	cluster.announceTopics(topics.forget(c), topics.subscribed)
+	presence.refresh(c.UserID)
+}
+
+func (h *Hub) remove(c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := userKey(c.UserID)
+	clients, ok := h.users[key]
+	if !ok {
+		return false
+	}
+	if _, ok := clients[c.ID]; !ok {
+		return false
+	}
+	delete(clients, c.ID)
+	if len(clients) == 0 {
+		delete(h.users, key)
+	}
+	return true
+}
+
+// Clients returns the live connections of the user
+func (h *Hub) Clients(userID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := h.users[userKey(userID)]
+	result := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		result = append(result, c)
+	}
+	return result
+}
+
+// IsOnline tells if the user has at least one live connection
+func (h *Hub) IsOnline(userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users[userKey(userID)]) > 0
+}
+
+// Count returns the number of live connections
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	count := 0
+	for _, clients := range h.users {
+		count += len(clients)
+	}
+	return count
+}
+
+func (h *Hub) all() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	result := make([]*Client, 0, len(h.users))
+	for _, clients := range h.users {
+		for _, c := range clients {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// SendToUser sends the data to every device of the user, on every node.
+// It returns the number of connections of this node it was queued on plus the number of other nodes it was forwarded to.
+func (h *Hub) SendToUser(userID, msgType string, data []byte) int {
+	return send(h.Clients(userID), msgType, data) +
+		cluster.forward(&models.ClusterMessage{Kind: constant.ClusterKindUser, UserID: userID, MessageType: msgType, Data: data})
+}
+
+// SendEnvelopeToUser sends the message to every device of the user as the next event of its sequence,
+// devices reconnecting after missing it get it replayed
+func (h *Hub) SendEnvelopeToUser(userID string, env *models.Envelope) int {
+	connections, nodes := h.deliverEnvelope(userID, env)
+	return connections + nodes
+}
+
+// deliverEnvelope is SendEnvelopeToUser returning apart the connections of this node the message was queued on
+// and the other nodes it was forwarded to
+func (h *Hub) deliverEnvelope(userID string, env *models.Envelope) (int, int) {
+	forwarded := cluster.forwardEvent(userID, env, "")
+	clients, _, err := pushToUser(userID, env, "", "")
+	if err != nil {
+		return 0, forwarded
+	}
+	return len(clients), forwarded
+}
+
+// SendToDevice sends the data to the connections of one device of the user, on every node
+func (h *Hub) SendToDevice(userID, deviceID, msgType string, data []byte) int {
+	connections, nodes := h.deliverToDevice(userID, deviceID, msgType, data)
+	return connections + nodes
+}
+
+// deliverToDevice is SendToDevice returning apart the connections of this node and the other nodes
+func (h *Hub) deliverToDevice(userID, deviceID, msgType string, data []byte) (int, int) {
+	return h.sendToDevice(userID, deviceID, msgType, data),
+		cluster.forward(&models.ClusterMessage{Kind: constant.ClusterKindDevice, UserID: userID, DeviceID: deviceID, MessageType: msgType, Data: data})
+}
+
+func (h *Hub) sendToDevice(userID, deviceID, msgType string, data []byte) int {
+	var clients []*Client
+	for _, c := range h.Clients(userID) {
+		if c.DeviceID == deviceID {
+			clients = append(clients, c)
+		}
+	}
+	return send(clients, msgType, data)
+}
+
+// Broadcast sends the data to every connection of every node and returns the number of connections of this node
+// plus the number of other nodes it was published to
+func (h *Hub) Broadcast(msgType string, data []byte) int {
+	connections, nodes := h.deliverBroadcast(msgType, data)
+	return connections + nodes
+}
+
+// deliverBroadcast is Broadcast returning apart the connections of this node and the other nodes
+func (h *Hub) deliverBroadcast(msgType string, data []byte) (int, int) {
+	return send(h.all(), msgType, data), cluster.forwardBroadcast(msgType, data)
+}
+
+// reaper closes and deregisters the connections that stopped answering pings or went idle
+func (h *Hub) reaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, c := range h.all() {
+			if stale, code, reason := c.stale(now); stale {
+				log.ApplicationInfo(c.ctx).Str("reason", reason).Msg("reaping stale connection")
+				c.closeWithReason(code, reason)
+				h.Unregister(c)
+			}
+		}
+		sessions.sweep(now)
+	}
+}
+
+func send(clients []*Client, msgType string, data []byte) int {
+	delivered := 0
+	for _, c := range clients {
+		if err := c.Send(msgType, data); err != nil {
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// SendToUser sends the data to every device of the user
+func SendToUser(userID, msgType string, data []byte) int {
+	return hub.SendToUser(userID, msgType, data)
+}
+
+// SendToDevice sends the data to one device of the user
+func SendToDevice(userID, deviceID, msgType string, data []byte) int {
+	return hub.SendToDevice(userID, deviceID, msgType, data)
+}
+
+// Broadcast sends the data to every connected user
+func Broadcast(msgType string, data []byte) int {
+	return hub.Broadcast(msgType, data)
+}
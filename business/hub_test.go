@@ -0,0 +1,106 @@
+package business
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// queued empties the send queue of the connection and returns the frames it held
+func queued(c *Client) []string {
+	var frames []string
+	for len(c.send) > 0 {
+		frames = append(frames, string((<-c.send).data))
+	}
+	return frames
+}
+
+func clientIDs(clients []*Client) []string {
+	ids := make([]string, 0, len(clients))
+	for _, c := range clients {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestHubRegistry(t *testing.T) {
+	h := NewHub()
+	phone := newClient(context.Background(), nil, "u1", "phone")
+	tablet := newClient(context.Background(), nil, " U1 ", "tablet")
+	other := newClient(context.Background(), nil, "u2", "phone")
+	for _, c := range []*Client{phone, tablet, other} {
+		withSocket(t, c)
+		h.Register(c)
+	}
+
+	if got, want := clientIDs(h.Clients("u1")), clientIDs([]*Client{phone, tablet}); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("clients of u1 = %v, want %v", got, want)
+	}
+	if !h.IsOnline("U1") || h.Count() != 3 {
+		t.Fatalf("online %v count %d, want true 3", h.IsOnline("U1"), h.Count())
+	}
+
+	h.Unregister(phone)
+	if !h.IsOnline("u1") || len(h.Clients("u1")) != 1 {
+		t.Errorf("u1 online %v with %d clients, want online with one", h.IsOnline("u1"), len(h.Clients("u1")))
+	}
+	// removing the last device drops the user
+	h.Unregister(tablet)
+	h.Unregister(tablet)
+	if h.IsOnline("u1") || len(h.Clients("u1")) != 0 || h.Count() != 1 {
+		t.Errorf("u1 online %v with %d clients, count %d, want offline with none and count 1",
+			h.IsOnline("u1"), len(h.Clients("u1")), h.Count())
+	}
+	if _, ok := h.users[userKey("u1")]; ok {
+		t.Error("user without connections kept in the registry")
+	}
+	if delivered := h.SendToUser("u1", "test", []byte("gone")); delivered != 0 {
+		t.Errorf("delivered to a user without connections = %d, want 0", delivered)
+	}
+}
+
+func TestHubFanOut(t *testing.T) {
+	h := NewHub()
+	phone := newClient(context.Background(), nil, "u1", "phone")
+	tablet := newClient(context.Background(), nil, "u1", "tablet")
+	other := newClient(context.Background(), nil, "u2", "phone")
+	for _, c := range []*Client{phone, tablet, other} {
+		h.Register(c)
+	}
+
+	tests := []struct {
+		name          string
+		send          func() int
+		wantDelivered int
+		wantGot       []*Client
+	}{
+		{name: "every device of the user", send: func() int { return h.SendToUser("U1", "test", []byte("user")) },
+			wantDelivered: 2, wantGot: []*Client{phone, tablet}},
+		{name: "one device of the user", send: func() int { return h.SendToDevice("u1", "tablet", "test", []byte("device")) },
+			wantDelivered: 1, wantGot: []*Client{tablet}},
+		{name: "unknown device", send: func() int { return h.SendToDevice("u1", "watch", "test", []byte("device")) }},
+		{name: "offline user", send: func() int { return h.SendToUser("u3", "test", []byte("user")) }},
+		{name: "every connection", send: func() int { return h.Broadcast("test", []byte("all")) },
+			wantDelivered: 3, wantGot: []*Client{phone, tablet, other}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delivered := tt.send(); delivered != tt.wantDelivered {
+				t.Errorf("delivered = %d, want %d", delivered, tt.wantDelivered)
+			}
+			for _, c := range []*Client{phone, tablet, other} {
+				want := 0
+				for _, w := range tt.wantGot {
+					if w == c {
+						want = 1
+					}
+				}
+				if got := queued(c); len(got) != want {
+					t.Errorf("device %s of %s got %v, want %d frames", c.DeviceID, c.UserID, got, want)
+				}
+			}
+		})
+	}
+}
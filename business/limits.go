@@ -0,0 +1,98 @@
+package business
+
+import (
+	"sort"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// close reasons of the connections going over the connection limits
+const (
+	evictedCloseReason  = "replaced by a newer connection"
+	rejectedCloseReason = "too many connections"
+)
+
+// admits tells if a new connection of the device of the user fits in the limits. It lets the upgrade be refused
+// up front under reject_new, Register still enforces the limits should concurrent upgrades race past it.
+// The limits are counted on each node, connections of the user on the other nodes of the cluster do not count.
+func (h *Hub) admits(userID, deviceID string) bool {
+	if settings.connectionLimitPolicy != constant.ConnectionLimitRejectNew {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := h.users[userKey(userID)]
+	if settings.maxConnectionsPerUser > 0 && len(clients) >= settings.maxConnectionsPerUser {
+		return false
+	}
+	return settings.maxConnectionsPerDevice <= 0 || deviceID == "" || len(deviceClients(clients, deviceID)) < settings.maxConnectionsPerDevice
+}
+
+// overLimit returns the connections of the user to close now that the newest one joined them, the limit of
+// the device is applied first and the connections it closes no longer count against the limit of the user
+func overLimit(clients map[string]*Client, newest *Client) []*Client {
+	var evicted []*Client
+	if newest.DeviceID != "" {
+		evicted = pickEvictions(deviceClients(clients, newest.DeviceID), settings.maxConnectionsPerDevice, newest)
+		if len(evicted) > 0 && evicted[0] == newest {
+			return evicted
+		}
+	}
+	remaining := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		if !containsClient(evicted, c) {
+			remaining = append(remaining, c)
+		}
+	}
+	return append(evicted, pickEvictions(remaining, settings.maxConnectionsPerUser, newest)...)
+}
+
+// pickEvictions returns the oldest connections above the limit, or only the newest one under reject_new
+func pickEvictions(conns []*Client, limit int, newest *Client) []*Client {
+	if limit <= 0 || len(conns) <= limit {
+		return nil
+	}
+	if settings.connectionLimitPolicy == constant.ConnectionLimitRejectNew {
+		return []*Client{newest}
+	}
+	// the newest connection always sorts last, connections opened within the same clock tick included
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i] == newest || conns[j] == newest {
+			return conns[j] == newest
+		}
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns[:len(conns)-limit]
+}
+
+func deviceClients(clients map[string]*Client, deviceID string) []*Client {
+	var result []*Client
+	for _, c := range clients {
+		if c.DeviceID == deviceID {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func containsClient(clients []*Client, c *Client) bool {
+	for _, other := range clients {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// evict closes a connection over the limits, telling the client why in the close frame
+func (h *Hub) evict(c *Client, newest *Client) {
+	reason := evictedCloseReason
+	if c == newest {
+		reason = rejectedCloseReason
+	}
+	log.ApplicationInfo(c.ctx).Str(constant.DeviceLogParam, c.DeviceID).Str("reason", reason).Msg("closing connection over the connection limit")
+	c.closeWithReason(websocket.ClosePolicyViolation, reason)
+	h.Unregister(c)
+}
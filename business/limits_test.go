@@ -0,0 +1,62 @@
+package business
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+)
+
+func TestHubAddLimits(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+
+	tests := []struct {
+		name        string
+		policy      string
+		perUser     int
+		perDevice   int
+		devices     []string
+		wantAdded   []bool
+		wantEvicted []int // index of the connection evicted by each one, -1 for none
+		wantLive    int
+	}{
+		{name: "reject new over the user limit", policy: constant.ConnectionLimitRejectNew, perUser: 1,
+			devices: []string{"a", "b", "c"}, wantAdded: []bool{true, false, false}, wantEvicted: []int{-1, 1, 2}, wantLive: 1},
+		{name: "reject new over the device limit", policy: constant.ConnectionLimitRejectNew, perUser: 5, perDevice: 1,
+			devices: []string{"a", "a", "b"}, wantAdded: []bool{true, false, true}, wantEvicted: []int{-1, 1, -1}, wantLive: 2},
+		{name: "evict oldest over the user limit", policy: constant.ConnectionLimitEvictOldest, perUser: 2,
+			devices: []string{"a", "b", "c"}, wantAdded: []bool{true, true, true}, wantEvicted: []int{-1, -1, 0}, wantLive: 3},
+		{name: "no limits", policy: constant.ConnectionLimitRejectNew,
+			devices: []string{"a", "a", "a"}, wantAdded: []bool{true, true, true}, wantEvicted: []int{-1, -1, -1}, wantLive: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.connectionLimitPolicy = tt.policy
+			settings.maxConnectionsPerUser = tt.perUser
+			settings.maxConnectionsPerDevice = tt.perDevice
+			h := NewHub()
+			clients := make([]*Client, len(tt.devices))
+			start := time.Now()
+			for i, device := range tt.devices {
+				c := newTestClient("7", "parent")
+				c.ID, c.DeviceID, c.ConnectedAt = device+string(rune('0'+i)), device, start.Add(time.Duration(i)*time.Second)
+				clients[i] = c
+				evicted, added := h.add(c)
+				if added != tt.wantAdded[i] {
+					t.Errorf("connection %d added = %v, want %v", i, added, tt.wantAdded[i])
+				}
+				switch {
+				case tt.wantEvicted[i] < 0 && len(evicted) > 0:
+					t.Errorf("connection %d evicted %v, want none", i, evicted)
+				case tt.wantEvicted[i] >= 0 && (len(evicted) != 1 || evicted[0] != clients[tt.wantEvicted[i]]):
+					t.Errorf("connection %d evicted %v, want connection %d", i, evicted, tt.wantEvicted[i])
+				}
+			}
+			// evict_oldest leaves the closing of the evicted connections to Register
+			if live := len(h.Clients("7")); live != tt.wantLive {
+				t.Errorf("live connections = %d, want %d", live, tt.wantLive)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	config "github.com/smartpet/websocket/utils/clientconfigs"
+	"github.com/smartpet/websocket/utils/configs"
+	"github.com/smartpet/websocket/utils/flags"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const defaultOriginsEnv = "default"
+
+// originAllowlist holds the origins browsers can open sockets from, an origin is a scheme and a host with its port
+type originAllowlist struct {
+	mu    sync.RWMutex
+	exact map[string]struct{}
+	// scheme and parent domain of the *. entries, matching every subdomain at any depth but not the domain itself
+	wildcards []wildcardOrigin
+}
+
+// wildcardOrigin matches the subdomains on any port, or only on port when the entry names one
+type wildcardOrigin struct {
+	scheme string
+	suffix string
+	port   string
+}
+
+var origins = &originAllowlist{exact: make(map[string]struct{})}
+
+// initOrigins loads the allowlist of white_list_origin_urls and reloads it whenever the application config changes.
+// When the config client does not serve the application config, e.g. its profile is missing from AppConfig, the
+// static allowlist of application.yml is used and never reloaded.
+func initOrigins() error {
+	if err := origins.load(allowedOrigins()); err != nil {
+		return err
+	}
+	client := configs.GetClient()
+	if client == nil {
+		return nil
+	}
+	err := client.AddChangeListener(constant.ApplicationConfig, func(params ...interface{}) {
+		if err := origins.load(allowedOrigins()); err != nil {
+			log.ApplicationError(context.Background()).Err(err).Msg("error reloading origin allowlist, keeping the previous one")
+		}
+	})
+	if errors.Is(err, config.ErrConfigNotAdded) {
+		log.ApplicationWarn(context.Background()).Msg("application config not served by the config client, using the static origin allowlist")
+		return nil
+	}
+	return err
+}
+
+// allowedOrigins returns the origins of the env of the process, or the default ones when the env has none
+func allowedOrigins() []string {
+	client := configs.GetClient()
+	for _, env := range []string{flags.Env(), defaultOriginsEnv} {
+		key := constant.WhiteListOriginUrl + "." + env
+		if client != nil {
+			if list, err := client.GetStringSlice(constant.ApplicationConfig, key); err == nil {
+				return list
+			}
+		}
+		if list := configs.GetAppConfigStringsD(key, nil); list != nil {
+			return list
+		}
+	}
+	return nil
+}
+
+// load replaces the allowlist, nothing is replaced when one of the entries is invalid
+func (o *originAllowlist) load(entries []string) error {
+	exact := make(map[string]struct{}, len(entries))
+	var wildcards []wildcardOrigin
+	for _, entry := range entries {
+		scheme, host, err := parseOrigin(entry)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(host, "*.") {
+			name, port := splitPort(host)
+			wildcards = append(wildcards, wildcardOrigin{scheme: scheme, suffix: name[1:], port: port})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return errors.New("wildcard only allowed as the first label of the host: " + entry)
+		}
+		exact[scheme+"://"+host] = struct{}{}
+	}
+	o.mu.Lock()
+	o.exact, o.wildcards = exact, wildcards
+	o.mu.Unlock()
+	log.ApplicationInfo(context.Background()).Strs("origins", entries).Msg("origin allowlist loaded")
+	return nil
+}
+
+// allows tells if the origin is in the allowlist, an empty allowlist only allows the host the request was sent to
+func (o *originAllowlist) allows(scheme, host string, r *http.Request) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if len(o.exact) == 0 && len(o.wildcards) == 0 {
+		return strings.EqualFold(host, r.Host)
+	}
+	if _, ok := o.exact[scheme+"://"+host]; ok {
+		return true
+	}
+	name, port := splitPort(host)
+	for _, w := range o.wildcards {
+		if w.scheme == scheme && strings.HasSuffix(name, w.suffix) && len(name) > len(w.suffix) && (w.port == "" || w.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPort splits the host of an origin into its name and its port, empty when it has none
+func splitPort(host string) (string, string) {
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// parseOrigin returns the lower cased scheme and host of the origin, the host keeps its port
+func parseOrigin(origin string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", "", errors.New("invalid origin: " + origin)
+	}
+	return strings.ToLower(u.Scheme), strings.ToLower(u.Host), nil
+}
+
+// checkOrigin is the origin check of the upgrader, it keeps pages of other sites from opening sockets with the
+// cookies or tickets of the user. Requests without an origin do not come from a browser and are let through.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	reason := constant.OriginNotAllowed
+	if scheme, host, err := parseOrigin(origin); err != nil {
+		reason = constant.OriginMalformed
+	} else if origins.allows(scheme, host, r) {
+		return true
+	}
+	metrics.IncSocketOriginRejected(reason)
+	log.ApplicationWarn(r.Context()).Str("origin", origin).Str("reason", reason).Str(constant.ClientIPLogParam, r.RemoteAddr).Msg("socket origin rejected")
+	return false
+}
@@ -0,0 +1,95 @@
+package business
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withOrigins replaces the origin allowlist for the test
+func withOrigins(t *testing.T, entries ...string) {
+	t.Helper()
+	previous := origins
+	origins = &originAllowlist{}
+	if err := origins.load(entries); err != nil {
+		t.Fatalf("load origins: %v", err)
+	}
+	t.Cleanup(func() { origins = previous })
+}
+
+func TestOriginAllowlistLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr bool
+	}{
+		{name: "exact and wildcard", entries: []string{"https://smartpet.com", "https://*.smartpet.com", "http://localhost:3000/"}},
+		{name: "wildcard inside the host", entries: []string{"https://app.*.smartpet.com"}, wantErr: true},
+		{name: "wildcard in a label", entries: []string{"https://app*.smartpet.com"}, wantErr: true},
+		{name: "no scheme", entries: []string{"smartpet.com"}, wantErr: true},
+		{name: "with a path", entries: []string{"https://smartpet.com/app"}, wantErr: true},
+		{name: "one invalid entry", entries: []string{"https://smartpet.com", "smartpet.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &originAllowlist{}
+			o.load([]string{"https://previous.com"})
+			err := o.load(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			// an invalid list leaves the previous one in place
+			_, kept := o.exact["https://previous.com"]
+			if kept != tt.wantErr {
+				t.Errorf("previous allowlist kept = %v, want %v", kept, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		host    string
+		origin  string
+		allowed bool
+	}{
+		{name: "no origin", entries: []string{"https://smartpet.com"}, allowed: true},
+		{name: "exact", entries: []string{"https://smartpet.com"}, origin: "https://smartpet.com", allowed: true},
+		{name: "exact without case", entries: []string{"https://SmartPet.com"}, origin: "HTTPS://smartpet.COM", allowed: true},
+		{name: "other scheme", entries: []string{"https://smartpet.com"}, origin: "http://smartpet.com"},
+		{name: "other port", entries: []string{"http://localhost:3000"}, origin: "http://localhost:3001"},
+		{name: "port listed", entries: []string{"http://localhost:3000"}, origin: "http://localhost:3000", allowed: true},
+		{name: "subdomain of a wildcard", entries: []string{"https://*.smartpet.com"}, origin: "https://app.smartpet.com", allowed: true},
+		{name: "nested subdomain of a wildcard", entries: []string{"https://*.smartpet.com"}, origin: "https://a.b.smartpet.com", allowed: true},
+		{name: "domain of a wildcard", entries: []string{"https://*.smartpet.com"}, origin: "https://smartpet.com"},
+		{name: "lookalike domain", entries: []string{"https://*.smartpet.com"}, origin: "https://evilsmartpet.com"},
+		{name: "suffix of another domain", entries: []string{"https://*.smartpet.com"}, origin: "https://smartpet.com.evil.com"},
+		{name: "subdomain of a wildcard on a port", entries: []string{"https://*.smartpet.com"}, origin: "https://app.smartpet.com:8443", allowed: true},
+		{name: "subdomain on the port of the wildcard", entries: []string{"https://*.smartpet.com:8443"}, origin: "https://app.smartpet.com:8443",
+			allowed: true},
+		{name: "subdomain on another port than the wildcard", entries: []string{"https://*.smartpet.com:8443"}, origin: "https://app.smartpet.com:9443"},
+		{name: "subdomain without the port of the wildcard", entries: []string{"https://*.smartpet.com:8443"}, origin: "https://app.smartpet.com"},
+		{name: "lookalike domain on a port", entries: []string{"https://*.smartpet.com"}, origin: "https://evilsmartpet.com:8443"},
+		{name: "wildcard of another scheme", entries: []string{"https://*.smartpet.com"}, origin: "http://app.smartpet.com"},
+		{name: "malformed origin", entries: []string{"https://smartpet.com"}, origin: "null"},
+		{name: "empty allowlist same host", host: "socket.smartpet.com", origin: "https://socket.smartpet.com", allowed: true},
+		{name: "empty allowlist other host", host: "socket.smartpet.com", origin: "https://evil.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withOrigins(t, tt.entries...)
+			r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(r); got != tt.allowed {
+				t.Errorf("allowed = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package business
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+const defaultPresenceMaxSubscriptions = 200
+
+// presenceTracker keeps the last published presence of users and the connections watching them
+type presenceTracker struct {
+	hub      *Hub // the live connections the presence of this node is worked out from
+	mu       sync.Mutex
+	current  map[string]models.Presence      // user key to last published presence
+	watchers map[string]map[*Client]struct{} // user key to the connections watching it
+	watching map[*Client]map[string]struct{} // connection to the user keys it watches
+}
+
+func newPresenceTracker(h *Hub) *presenceTracker {
+	return &presenceTracker{
+		hub:      h,
+		current:  make(map[string]models.Presence),
+		watchers: make(map[string]map[*Client]struct{}),
+		watching: make(map[*Client]map[string]struct{}),
+	}
+}
+
+var presence = newPresenceTracker(hub)
+
+// aggregate works out the presence of the user from its live connections,
+// a user is online when any device is in the foreground and offline only when the last device disconnects
+func (h *Hub) aggregate(userID string) models.Presence {
+	p := models.Presence{UserID: userID, Status: constant.PresenceOffline}
+	for _, c := range h.Clients(userID) {
+		if !c.away.Load() {
+			p.Status = constant.PresenceOnline
+			return p
+		}
+		p.Status = constant.PresenceAway
+	}
+	return p
+}
+
+// mergePresence combines the presence of a user on several nodes the same way as on several devices
+func mergePresence(status string, others ...string) string {
+	for _, other := range others {
+		if other == constant.PresenceOnline || (other == constant.PresenceAway && status == constant.PresenceOffline) {
+			status = other
+		}
+	}
+	return status
+}
+
+// refresh tells the other nodes about the presence of the user on this node and notifies the watchers
+func (t *presenceTracker) refresh(userID string) {
+	cluster.announce(userID, func() string { return t.hub.aggregate(userID).Status })
+	// published only by the node where the change happened, the others merely follow it
+	if p, changed := t.notify(userID); changed {
+		emitActivity(models.ActivityEvent{Type: constant.ActivityPresenceChanged, UserID: userID, Status: p.Status})
+	}
+}
+
+// notify recomputes the presence of the user over every node and pushes it to the watchers when it changed
+func (t *presenceTracker) notify(userID string) (models.Presence, bool) {
+	p := t.hub.aggregate(userID)
+	p.Status = mergePresence(p.Status, cluster.presence(userID)...)
+	key := userKey(userID)
+
+	t.mu.Lock()
+	last, known := t.current[key]
+	if known && last.Status == p.Status {
+		t.mu.Unlock()
+		return p, false
+	}
+	if p.Status == constant.PresenceOffline {
+		p.LastSeen = time.Now().UnixMilli()
+	}
+	t.current[key] = p
+	watchers := make([]*Client, 0, len(t.watchers[key]))
+	for c := range t.watchers[key] {
+		watchers = append(watchers, c)
+	}
+	t.mu.Unlock()
+
+	env, err := NewEnvelope(constant.MessageTypePresenceUpdate, p)
+	if err != nil {
+		return p, true
+	}
+	for _, c := range watchers {
+		c.SendEnvelope(env)
+	}
+	return p, true
+}
+
+// get returns the presence of the user, users never seen by this process are offline without a last seen
+func (t *presenceTracker) get(userID string) models.Presence {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.current[userKey(userID)]; ok {
+		p.UserID = userID
+		return p
+	}
+	return models.Presence{UserID: userID, Status: constant.PresenceOffline}
+}
+
+// watch subscribes the connection to the presence of the users, within the limit of subscriptions per connection
+func (t *presenceTracker) watch(c *Client, userIDs []string, limit int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a connection is closed before it is forgotten, a watch racing its unregistration must not outlive it
+	if c.closed() {
+		return ErrClientClosed
+	}
+	watching, ok := t.watching[c]
+	if !ok {
+		watching = make(map[string]struct{})
+	}
+	added := make(map[string]struct{}, len(userIDs))
+	for _, id := range userIDs {
+		if _, ok := watching[userKey(id)]; !ok {
+			added[userKey(id)] = struct{}{}
+		}
+	}
+	if len(watching)+len(added) > limit {
+		return NewProtocolError("ABP11004", errors.New("too many presence subscriptions"))
+	}
+	t.watching[c] = watching
+	for _, id := range userIDs {
+		key := userKey(id)
+		watching[key] = struct{}{}
+		if t.watchers[key] == nil {
+			t.watchers[key] = make(map[*Client]struct{})
+		}
+		t.watchers[key][c] = struct{}{}
+	}
+	return nil
+}
+
+func (t *presenceTracker) unwatch(c *Client, userIDs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range userIDs {
+		t.unwatchLocked(c, userKey(id))
+	}
+}
+
+func (t *presenceTracker) unwatchLocked(c *Client, key string) {
+	delete(t.watching[c], key)
+	if len(t.watching[c]) == 0 {
+		delete(t.watching, c)
+	}
+	delete(t.watchers[key], c)
+	if len(t.watchers[key]) == 0 {
+		delete(t.watchers, key)
+	}
+}
+
+// forget drops every subscription of the closed connection
+func (t *presenceTracker) forget(c *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.watching[c] {
+		t.unwatchLocked(c, key)
+	}
+}
+
+// handlePresenceSet marks the device as away or back online
+func handlePresenceSet(mc *MessageContext) error {
+	req := models.PresenceSet{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	switch req.Status {
+	case constant.PresenceOnline:
+		mc.Client.away.Store(false)
+	case constant.PresenceAway:
+		mc.Client.away.Store(true)
+	default:
+		return NewProtocolError("ABP11004", errors.New("status should be online or away"))
+	}
+	presence.refresh(mc.Client.UserID)
+	return nil
+}
+
+// handlePresenceSubscribe watches the presence of users the connected user is allowed to chat with
+func handlePresenceSubscribe(mc *MessageContext) error {
+	req := models.PresenceSubscribe{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.UserIDs) == 0 {
+		return NewProtocolError("ABP11004", errors.New("user_ids are required"))
+	}
+	// refused before asking the chat policy about every one of them
+	limit := configs.GetAppConfigIntD(constant.PresenceMaxSubscriptionsKey, defaultPresenceMaxSubscriptions)
+	if len(req.UserIDs) > limit {
+		return NewProtocolError("ABP11004", errors.New("too many presence subscriptions"))
+	}
+	denied, err := deniedRecipient(mc, mc.Client.UserID, req.UserIDs)
+	if err != nil {
+		return err
+	}
+	if denied != "" {
+		return NewProtocolError("ABP11012", errors.New(denied))
+	}
+	if err := presence.watch(mc.Client, req.UserIDs, limit); err != nil {
+		return err
+	}
+
+	state := models.PresenceState{Users: make([]models.Presence, 0, len(req.UserIDs))}
+	for _, id := range req.UserIDs {
+		state.Users = append(state.Users, presence.get(id))
+	}
+	return mc.Reply(constant.MessageTypePresenceState, state)
+}
+
+// handlePresenceUnsubscribe stops watching the presence of users
+func handlePresenceUnsubscribe(mc *MessageContext) error {
+	req := models.PresenceSubscribe{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	presence.unwatch(mc.Client, req.UserIDs)
+	return nil
+}
@@ -0,0 +1,139 @@
+package business
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestHubAggregate(t *testing.T) {
+	tests := []struct {
+		name       string
+		away       []bool // one per device
+		wantStatus string
+	}{
+		{name: "no device", wantStatus: constant.PresenceOffline},
+		{name: "foreground device", away: []bool{false}, wantStatus: constant.PresenceOnline},
+		{name: "every device away", away: []bool{true, true}, wantStatus: constant.PresenceAway},
+		{name: "one device in the foreground", away: []bool{true, false, true}, wantStatus: constant.PresenceOnline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub()
+			for i, away := range tt.away {
+				c := newTestClient("7", "parent")
+				c.DeviceID = string(rune('a' + i))
+				c.away.Store(away)
+				h.add(c)
+			}
+			if got := h.aggregate("7"); got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMergePresence(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  string
+		others []string
+		want   string
+	}{
+		{name: "no other node", local: constant.PresenceAway, want: constant.PresenceAway},
+		{name: "online elsewhere", local: constant.PresenceOffline, others: []string{constant.PresenceAway, constant.PresenceOnline},
+			want: constant.PresenceOnline},
+		{name: "away elsewhere", local: constant.PresenceOffline, others: []string{constant.PresenceAway}, want: constant.PresenceAway},
+		{name: "online here", local: constant.PresenceOnline, others: []string{constant.PresenceAway}, want: constant.PresenceOnline},
+		{name: "offline elsewhere", local: constant.PresenceAway, others: []string{constant.PresenceOffline}, want: constant.PresenceAway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergePresence(tt.local, tt.others...); got != tt.want {
+				t.Errorf("merged = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPresenceWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches [][]string
+		wantErr []bool
+		want    int // users watched at the end
+	}{
+		{name: "within the limit", batches: [][]string{{"1", "2"}, {"3"}}, wantErr: []bool{false, false}, want: 3},
+		{name: "over the limit", batches: [][]string{{"1", "2"}, {"3", "4"}}, wantErr: []bool{false, true}, want: 2},
+		{name: "users watched already count once", batches: [][]string{{"1", "2"}, {"2", "3", "3"}}, wantErr: []bool{false, false}, want: 3},
+		{name: "ids matched without case", batches: [][]string{{"a", "b", "c"}, {"A"}}, wantErr: []bool{false, false}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPresenceTracker(NewHub())
+			c := newTestClient("9", "parent")
+			for i, ids := range tt.batches {
+				if err := p.watch(c, ids, 3); (err != nil) != tt.wantErr[i] {
+					t.Errorf("watch %v: err = %v, want error %v", ids, err, tt.wantErr[i])
+				}
+			}
+			if got := len(p.watching[c]); got != tt.want {
+				t.Errorf("watching %d users, want %d", got, tt.want)
+			}
+			p.forget(c)
+			if len(p.watching) != 0 || len(p.watchers) != 0 {
+				t.Errorf("subscriptions left after forget: %v %v", p.watching, p.watchers)
+			}
+		})
+	}
+}
+
+func TestPresenceNotify(t *testing.T) {
+	h := NewHub()
+	tracker := newPresenceTracker(h)
+	watcher := newTestClient("9", "parent")
+	if err := tracker.watch(watcher, []string{"7"}, 10); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	phone := newTestClient("7", "provider")
+	tablet := newTestClient("7", "provider")
+	tablet.DeviceID = "tablet"
+
+	steps := []struct {
+		name       string
+		change     func()
+		wantUpdate string // status pushed to the watcher, empty for none
+	}{
+		{name: "first device connects", change: func() { h.add(phone) }, wantUpdate: constant.PresenceOnline},
+		{name: "second device connects", change: func() { h.add(tablet) }},
+		{name: "one device goes away", change: func() { phone.away.Store(true) }},
+		{name: "foreground device leaves", change: func() { h.remove(tablet) }, wantUpdate: constant.PresenceAway},
+		{name: "last device leaves", change: func() { h.remove(phone) }, wantUpdate: constant.PresenceOffline},
+	}
+	for _, step := range steps {
+		step.change()
+		_, changed := tracker.notify("7")
+		if changed != (step.wantUpdate != "") {
+			t.Fatalf("%s: changed = %v, want %v", step.name, changed, step.wantUpdate != "")
+		}
+		if step.wantUpdate == "" {
+			if len(watcher.send) > 0 {
+				t.Fatalf("%s: update pushed without a change", step.name)
+			}
+			continue
+		}
+		env := nextFrame(t, watcher)
+		got := models.Presence{}
+		if err := json.Unmarshal(env.Payload, &got); err != nil {
+			t.Fatalf("decoding update: %v", err)
+		}
+		if env.Type != constant.MessageTypePresenceUpdate || got.Status != step.wantUpdate {
+			t.Fatalf("%s: got %s %+v, want %s", step.name, env.Type, got, step.wantUpdate)
+		}
+		if (got.LastSeen != 0) != (got.Status == constant.PresenceOffline) {
+			t.Errorf("%s: last seen %d for %s", step.name, got.LastSeen, got.Status)
+		}
+	}
+}
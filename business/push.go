@@ -0,0 +1,248 @@
+package business
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+var errPushInProgress = errors.New(constant.ErrorCodeMap["ABP11014"])
+
+// value of the idempotency key of a push being processed, so a retry racing the original is refused instead of
+// pushed twice
+var pushPending = []byte("pending")
+
+// PushEndpoint lets the other backend services push a message to users, devices, topic subscribers or every connection.
+// Calls are authenticated with service to service tokens, bound to the client certificate of the service when
+// mTLS is on, and pushes carrying an idempotency key are done only once,
+// retries get the results of the first call. Pushes are not stored: a user that is offline only gets them replayed
+// when it holds a session to resume on this node, otherwise they are dropped, and the nodes they are forwarded to
+// deliver them without reporting back.
+func PushEndpoint(w http.ResponseWriter, r *http.Request) {
+	reqStartTime := time.Now()
+	reqID := utils.GetRequestID(r, "s2s")
+
+	if r.Method != http.MethodPost {
+		utils.JSONErrorResponder(r, w, http.StatusMethodNotAllowed, reqID, "", constant.ErrorCodeMap["ABP11001"], reqStartTime, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	claims, err := utils.AuthorizeService(r, configs.GetAppConfigD(constant.PushAudienceKey, "ms-pet-socket"),
+		configs.GetAppConfigStringsD(constant.PushAllowedIssuersKey, nil))
+	if err == nil {
+		err = verifyServiceCertificate(r, claims.Issuer)
+	}
+	if err != nil {
+		log.ApplicationWarn(context.WithValue(r.Context(), constant.IDLogParam, reqID)).Err(err).Msg("push rejected")
+		utils.JSONErrorResponder(r, w, http.StatusUnauthorized, reqID, "", constant.ErrorCodeMap["ABP11013"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11013"]))
+		return
+	}
+	ctx := context.WithValue(context.WithValue(r.Context(), constant.IDLogParam, reqID), constant.S2SIssuerLogParam, claims.Issuer)
+
+	req := models.PushRequest{}
+	body := http.MaxBytesReader(w, r.Body, int64(configs.GetAppConfigIntD(constant.PushMaxBodyBytesKey, 1<<20)))
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, claims.Issuer, constant.ErrorCodeMap["ABP11004"], reqStartTime, err)
+		return
+	}
+	if key := r.Header.Get(constant.IdempotencyKeyHeader); key != "" {
+		req.IdempotencyKey = key
+	}
+	if err := validatePush(&req, configs.GetAppConfigIntD(constant.PushMaxTargetsKey, 500)); err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, claims.Issuer, constant.ErrorCodeMap["ABP11004"], reqStartTime, err)
+		return
+	}
+
+	if req.IdempotencyKey == "" {
+		utils.JSONResponder(r, w, http.StatusOK, reqID, claims.Issuer, "pushed", reqStartTime, push(ctx, &req))
+		return
+	}
+	// keys are scoped to the calling service
+	key := cluster.prefix + ":push:idempotency:" + claims.Issuer + ":" + req.IdempotencyKey
+	ttl := time.Duration(configs.GetAppConfigIntD(constant.PushIdempotencyTtlInSecondsKey, 86400)) * time.Second
+	resp, replayed, err := pushOnce(ctx, key, ttl, func() models.PushResponse { return push(ctx, &req) })
+	if errors.Is(err, errPushInProgress) {
+		utils.JSONErrorResponder(r, w, http.StatusConflict, reqID, claims.Issuer, constant.ErrorCodeMap["ABP11014"], reqStartTime, err)
+		return
+	}
+	if err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusServiceUnavailable, reqID, claims.Issuer, constant.ErrorCodeMap["ABP11000"], reqStartTime, err)
+		return
+	}
+	description := "pushed"
+	if replayed {
+		description = "already pushed"
+	}
+	utils.JSONResponder(r, w, http.StatusOK, reqID, claims.Issuer, description, reqStartTime, resp)
+}
+
+func validatePush(req *models.PushRequest, maxTargets int) error {
+	req.Type = strings.TrimSpace(req.Type)
+	if req.Type == "" {
+		return errors.New("type is required")
+	}
+	if _, reserved := messageTypes[req.Type]; reserved {
+		return fmt.Errorf("type %s is reserved by the protocol", req.Type)
+	}
+	if len(req.Targets) == 0 {
+		return errors.New("targets are required")
+	}
+	if len(req.Targets) > maxTargets {
+		return fmt.Errorf("at most %d targets are allowed", maxTargets)
+	}
+	for i, t := range req.Targets {
+		switch {
+		case t.Broadcast && (t.UserID != "" || t.DeviceID != "" || t.Topic != ""):
+			return fmt.Errorf("target %d: broadcast cannot have a user, device or topic", i)
+		case t.Topic != "" && (t.UserID != "" || t.DeviceID != ""):
+			return fmt.Errorf("target %d: topic cannot have a user or device", i)
+		case t.Topic != "":
+			if err := validTopic(t.Topic, false); err != nil {
+				return fmt.Errorf("target %d: %v", i, err)
+			}
+		case !t.Broadcast && strings.TrimSpace(t.UserID) == "":
+			return fmt.Errorf("target %d: user_id is required", i)
+		}
+	}
+	if len(req.Payload) > 0 && !json.Valid(req.Payload) {
+		return errors.New("payload is not valid json")
+	}
+	return nil
+}
+
+// verifyServiceCertificate checks the client certificate of the call belongs to the service the token was issued to
+func verifyServiceCertificate(r *http.Request, issuer string) error {
+	mode := configs.GetAppConfigD(constant.PushMTLSModeKey, constant.MTLSOff)
+	switch mode {
+	case constant.MTLSOff:
+		return nil
+	case constant.MTLSOptional, constant.MTLSRequired:
+	default:
+		return fmt.Errorf("unknown mtls mode %s", mode)
+	}
+	// only verified chains count, the listener asks for certificates without requiring them
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if mode == constant.MTLSRequired {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.String()
+	var identities []models.ServiceIdentity
+	if err := configs.UnmarshalAppConfig(constant.PushMTLSIdentitiesKey, &identities); err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if identity.Subject != subject {
+			continue
+		}
+		if identity.Service != issuer {
+			return fmt.Errorf("token of %s sent with the certificate of %s", issuer, identity.Service)
+		}
+		return nil
+	}
+	return fmt.Errorf("no service for client certificate %s", subject)
+}
+
+// pushOnce runs the push unless a push with the same key already ran within the ttl, in which case its results are
+// returned. The key is claimed on the backplane, so retries landing on another node are not pushed again; it expires
+// ttl after the first call whatever the number of retries.
+func pushOnce(ctx context.Context, key string, ttl time.Duration, fn func() models.PushResponse) (models.PushResponse, bool, error) {
+	claimed, err := cluster.backplane.SetNX(ctx, key, pushPending, ttl)
+	if err != nil {
+		return models.PushResponse{}, false, err
+	}
+	if !claimed {
+		data, err := cluster.backplane.Get(ctx, key)
+		if err != nil {
+			return models.PushResponse{}, false, err
+		}
+		// a key expiring between the two calls is reported as in progress, the retry of the caller claims it
+		if data == nil || bytes.Equal(data, pushPending) {
+			return models.PushResponse{}, false, errPushInProgress
+		}
+		resp := models.PushResponse{}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return models.PushResponse{}, false, err
+		}
+		return resp, true, nil
+	}
+	resp := fn()
+	data, err := json.Marshal(resp)
+	if err == nil {
+		// stored even when the caller went away meanwhile, its retry gets the results
+		storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), clusterPublishTimeout)
+		err = cluster.backplane.Replace(storeCtx, key, data)
+		cancel()
+	}
+	if err != nil {
+		// the key stays pending until it expires, retries are refused rather than pushed again
+		log.ApplicationError(ctx).Err(err).Str("messageID", resp.MessageID).Msg("error storing push results")
+	}
+	return resp, false, nil
+}
+
+// push sends the message to every target, all copies share the same message id
+func push(ctx context.Context, req *models.PushRequest) models.PushResponse {
+	resp := models.PushResponse{
+		MessageID: uuid.New().String(),
+		Results:   make([]models.PushTargetResult, 0, len(req.Targets)),
+	}
+	newEnvelope := func() *models.Envelope {
+		return &models.Envelope{
+			Version:   models.APIVersion_V1,
+			Type:      req.Type,
+			ID:        resp.MessageID,
+			Timestamp: time.Now().UnixMilli(),
+			Payload:   req.Payload,
+		}
+	}
+
+	for _, t := range req.Targets {
+		result := models.PushTargetResult{PushTarget: t}
+		// the status when the push reached no connection of this node and no other node
+		undelivered := ""
+		switch {
+		case t.Broadcast:
+			data, _ := json.Marshal(newEnvelope())
+			result.Connections, result.Nodes = hub.deliverBroadcast(req.Type, data)
+			undelivered = constant.PushNoConnections
+		case t.Topic != "":
+			result.Connections, result.Nodes = hub.deliverToTopic(t.Topic, newEnvelope())
+			undelivered = constant.PushNoSubscribers
+		case t.DeviceID != "":
+			data, _ := json.Marshal(newEnvelope())
+			result.Connections, result.Nodes = hub.deliverToDevice(t.UserID, t.DeviceID, req.Type, data)
+			undelivered = constant.PushNotConnected
+		default:
+			result.Connections, result.Nodes = hub.deliverEnvelope(t.UserID, newEnvelope())
+			undelivered = constant.PushDroppedOffline
+			if sessions.stream(t.UserID) != nil {
+				undelivered = constant.PushQueuedForResume
+			}
+		}
+		switch {
+		case result.Connections > 0:
+			result.Status = constant.PushDelivered
+		case result.Nodes > 0:
+			result.Status = constant.PushForwarded
+		default:
+			result.Status = undelivered
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	log.ApplicationInfo(ctx).Str(constant.ActionLogParam, req.Type).Str("messageID", resp.MessageID).
+		Int("targets", len(req.Targets)).Msg("push sent")
+	return resp
+}
@@ -0,0 +1,196 @@
+package business
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/backplane"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestValidatePush(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     models.PushRequest
+		wantErr string
+	}{
+		{name: "user target", req: models.PushRequest{Type: " booking.updated ", Targets: []models.PushTarget{{UserID: "1"}}}},
+		{name: "every kind of target", req: models.PushRequest{Type: "notice", Payload: json.RawMessage(`{"a":1}`), Targets: []models.PushTarget{
+			{UserID: "1", DeviceID: "phone"}, {Topic: "city:rome:alerts"}, {Broadcast: true}}}},
+		{name: "missing type", req: models.PushRequest{Targets: []models.PushTarget{{UserID: "1"}}}, wantErr: "type is required"},
+		{name: "protocol type", req: models.PushRequest{Type: " chat.message ", Targets: []models.PushTarget{{UserID: "1"}}},
+			wantErr: "type chat.message is reserved"},
+		{name: "no targets", req: models.PushRequest{Type: "notice"}, wantErr: "targets are required"},
+		{name: "too many targets", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{UserID: "1"}, {UserID: "2"}, {UserID: "3"}, {UserID: "4"}}},
+			wantErr: "at most 3 targets"},
+		{name: "broadcast with a user", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{Broadcast: true, UserID: "1"}}},
+			wantErr: "target 0: broadcast"},
+		{name: "broadcast with a device", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{UserID: "1"}, {Broadcast: true, DeviceID: "phone"}}},
+			wantErr: "target 1: broadcast"},
+		{name: "topic with a device", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{UserID: "1"}, {Topic: "a", DeviceID: "phone"}}},
+			wantErr: "target 1: topic"},
+		{name: "invalid topic", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{Topic: "a:*"}}}, wantErr: "target 0:"},
+		{name: "device without user", req: models.PushRequest{Type: "notice", Targets: []models.PushTarget{{DeviceID: "phone"}}},
+			wantErr: "target 0: user_id is required"},
+		{name: "invalid payload", req: models.PushRequest{Type: "notice", Payload: json.RawMessage(`{`), Targets: []models.PushTarget{{UserID: "1"}}},
+			wantErr: "payload is not valid json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePush(&tt.req, 3)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				if tt.req.Type != strings.TrimSpace(tt.req.Type) {
+					t.Errorf("type %q not trimmed", tt.req.Type)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPushOnce(t *testing.T) {
+	previous := cluster
+	t.Cleanup(func() { cluster = previous })
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		pending      bool // another call holds the key
+		calls        int
+		wantRuns     int
+		wantReplayed bool
+		wantErr      error
+	}{
+		{name: "first call", calls: 1, wantRuns: 1},
+		{name: "retries get the results", calls: 3, wantRuns: 1, wantReplayed: true},
+		{name: "retry racing the first call", pending: true, calls: 1, wantErr: errPushInProgress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster = newClusterNode(backplane.NewMemoryBackplane(), "test")
+			t.Cleanup(func() { cluster.backplane.Close() })
+			if tt.pending {
+				cluster.backplane.SetNX(ctx, "key", pushPending, time.Minute)
+			}
+			runs := 0
+			fn := func() models.PushResponse {
+				runs++
+				return models.PushResponse{MessageID: "m" + string(rune('0'+runs))}
+			}
+			var resp models.PushResponse
+			var replayed bool
+			var err error
+			for i := 0; i < tt.calls; i++ {
+				resp, replayed, err = pushOnce(ctx, "key", time.Minute, fn)
+			}
+			if runs != tt.wantRuns || replayed != tt.wantReplayed || err != tt.wantErr {
+				t.Fatalf("runs %d replayed %v err %v, want %d %v %v", runs, replayed, err, tt.wantRuns, tt.wantReplayed, tt.wantErr)
+			}
+			if err == nil && resp.MessageID != "m1" {
+				t.Errorf("message id = %s, want the one of the first call", resp.MessageID)
+			}
+		})
+	}
+}
+
+func TestPushStatus(t *testing.T) {
+	previous, previousCluster := sessions, cluster
+	sessions = newSessionRegistry()
+	b := backplane.NewMemoryBackplane()
+	cluster = newClusterNode(b, "test")
+	t.Cleanup(func() {
+		sessions, cluster = previous, previousCluster
+		b.Close()
+	})
+	online := newTestClient("push-online", "parent")
+	withClient(t, online)
+	if _, _, err := sessions.open(newTestClient("push-offline", "parent"), "", time.Now()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	// another node with a connection of a user and a subscriber of a topic
+	cluster.seen("node-b", time.Now())
+	cluster.setRoute("push-remote", "node-b", constant.PresenceOnline)
+	cluster.setTopicRoute("push:remote", "node-b", true)
+
+	tests := []struct {
+		name            string
+		target          models.PushTarget
+		wantStatus      string
+		wantConnections int
+		wantNodes       int
+	}{
+		{name: "user connected", target: models.PushTarget{UserID: "Push-Online"}, wantStatus: constant.PushDelivered, wantConnections: 1},
+		{name: "user connected to another node", target: models.PushTarget{UserID: "push-remote"}, wantStatus: constant.PushForwarded, wantNodes: 1},
+		{name: "user with a session to resume", target: models.PushTarget{UserID: "push-offline"}, wantStatus: constant.PushQueuedForResume},
+		{name: "user offline", target: models.PushTarget{UserID: "push-nobody"}, wantStatus: constant.PushDroppedOffline},
+		{name: "device connected", target: models.PushTarget{UserID: "push-online", DeviceID: online.DeviceID},
+			wantStatus: constant.PushDelivered, wantConnections: 1},
+		{name: "device connected to another node", target: models.PushTarget{UserID: "push-remote", DeviceID: "phone"},
+			wantStatus: constant.PushForwarded, wantNodes: 1},
+		{name: "device not connected", target: models.PushTarget{UserID: "push-online", DeviceID: "tablet"}, wantStatus: constant.PushNotConnected},
+		{name: "topic without subscribers", target: models.PushTarget{Topic: "push:nobody"}, wantStatus: constant.PushNoSubscribers},
+		{name: "topic with subscribers on another node", target: models.PushTarget{Topic: "push:remote"}, wantStatus: constant.PushForwarded,
+			wantNodes: 1},
+		{name: "broadcast", target: models.PushTarget{Broadcast: true}, wantStatus: constant.PushDelivered, wantConnections: 1, wantNodes: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := push(context.Background(), &models.PushRequest{Type: "notice", Targets: []models.PushTarget{tt.target}})
+			result := resp.Results[0]
+			if result.Status != tt.wantStatus || result.Connections != tt.wantConnections || result.Nodes != tt.wantNodes {
+				t.Fatalf("result %s on %d connections and %d nodes, want %s on %d and %d", result.Status, result.Connections, result.Nodes,
+					tt.wantStatus, tt.wantConnections, tt.wantNodes)
+			}
+			if tt.wantConnections == 0 {
+				return
+			}
+			if env := nextFrame(t, online); env.Type != "notice" || env.ID != resp.MessageID {
+				t.Errorf("frame %s %s, want notice %s", env.Type, env.ID, resp.MessageID)
+			}
+		})
+	}
+}
+
+func TestVerifyServiceCertificate(t *testing.T) {
+	// the tests run with the optional mode
+	tests := []struct {
+		name    string
+		subject *pkix.Name // of the verified client certificate, none when nil
+		issuer  string
+		wantErr bool
+	}{
+		{name: "no certificate", issuer: "payments"},
+		{name: "certificate of the service", subject: &pkix.Name{CommonName: "payments", OrganizationalUnit: []string{"services"},
+			Organization: []string{"SmartPet"}}, issuer: "payments"},
+		{name: "token of another service", subject: &pkix.Name{CommonName: "payments", OrganizationalUnit: []string{"services"},
+			Organization: []string{"SmartPet"}}, issuer: "login", wantErr: true},
+		{name: "unknown certificate", subject: &pkix.Name{CommonName: "login", OrganizationalUnit: []string{"services"},
+			Organization: []string{"SmartPet"}}, issuer: "login", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/internal/push", nil)
+			if tt.subject != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: *tt.subject}}}}
+			}
+			if err := verifyServiceCertificate(r, tt.issuer); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
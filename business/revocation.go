@@ -0,0 +1,244 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const (
+	defaultRevocationTTL   = 24 * time.Hour
+	revocationCachePrefix  = "revoked:"
+	revocationCloseReason  = "access revoked"
+	maxRevocationBodyBytes = 1 << 16
+)
+
+var errRevoked = errors.New(constant.ErrorCodeMap["ABP11020"])
+
+// revocationKey is the cache key of the revocation, a device revoked for every user has an empty user
+func revocationKey(r models.Revocation) string {
+	switch {
+	case r.TokenID != "":
+		return revocationCachePrefix + "token:" + r.TokenID
+	case r.DeviceID != "":
+		return revocationCachePrefix + "device:" + userKey(r.UserID) + ":" + r.DeviceID
+	default:
+		return revocationCachePrefix + "user:" + userKey(r.UserID)
+	}
+}
+
+// storeRevocation keeps the revocation, or its lift, in the cache of this node until it expires. It is dropped
+// when the one stored was made after it, as when another node hands it over late.
+func storeRevocation(r models.Revocation) bool {
+	ttl := time.Until(time.UnixMilli(r.ExpiresAt))
+	if ttl <= 0 {
+		return false
+	}
+	key := revocationKey(r)
+	if stored, ok := storedRevocation(key); ok && revocationTime(stored) > revocationTime(r) {
+		return false
+	}
+	utils.GetCache().Set(key, r, ttl)
+	return true
+}
+
+// storedRevocation returns the revocation stored under the key, without extending its life in the cache
+func storedRevocation(key string) (models.Revocation, bool) {
+	item := utils.GetCache().Get(key, ttlcache.WithDisableTouchOnHit[string, interface{}]())
+	if item == nil {
+		return models.Revocation{}, false
+	}
+	r, ok := item.Value().(models.Revocation)
+	return r, ok
+}
+
+// revocationTime is the time the revocation was made, or lifted
+func revocationTime(r models.Revocation) int64 {
+	if r.LiftedAt != 0 {
+		return r.LiftedAt
+	}
+	return r.RevokedAt
+}
+
+// revokes tells if the revocation denies a token issued at issuedAt, in unix seconds. Token and device revocations
+// deny whenever the token was issued, until they expire or an admin lifts them, or a stolen device would connect
+// again with a new token. A user revocation only denies the tokens issued before it, those issued in the second
+// of the revocation included, so the user can log in again. Tokens without an issue time, and revocations of nodes
+// not recording the time, cannot be compared and stay denied until the revocation expires.
+func revokes(r models.Revocation, issuedAt int64) bool {
+	switch {
+	case r.LiftedAt != 0:
+		return false
+	case r.TokenID != "" || r.DeviceID != "":
+		return true
+	case issuedAt == 0 || r.RevokedAt == 0:
+		return true
+	default:
+		return issuedAt*1000 <= r.RevokedAt
+	}
+}
+
+// revoked tells if the token, the device of the user, the device or the user is revoked for a token issued at issuedAt
+func revoked(tokenID, userID, deviceID string, issuedAt int64) bool {
+	keys := []models.Revocation{{UserID: userID}}
+	if tokenID != "" {
+		keys = append(keys, models.Revocation{TokenID: tokenID})
+	}
+	if deviceID != "" {
+		keys = append(keys, models.Revocation{UserID: userID, DeviceID: deviceID}, models.Revocation{DeviceID: deviceID})
+	}
+	for _, key := range keys {
+		if r, ok := storedRevocation(revocationKey(key)); ok && revokes(r, issuedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// revocations returns every revocation and lift known to this node, to hand to a node joining the cluster
+func revocations() []models.Revocation {
+	var result []models.Revocation
+	for key, item := range utils.GetCache().Items() {
+		if !strings.HasPrefix(key, revocationCachePrefix) {
+			continue
+		}
+		if r, ok := item.Value().(models.Revocation); ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// matchesRevocation tells if the connection is denied by the revocation
+func (c *Client) matchesRevocation(r models.Revocation) bool {
+	if !revokes(r, c.IssuedAt()) {
+		return false
+	}
+	switch {
+	case r.TokenID != "":
+		return r.TokenID == c.TokenID()
+	case r.DeviceID != "":
+		return r.DeviceID == c.DeviceID && (r.UserID == "" || userKey(r.UserID) == userKey(c.UserID))
+	default:
+		return userKey(r.UserID) == userKey(c.UserID)
+	}
+}
+
+// enforceRevocation closes the connections of this node denied by the revocation and returns their number
+func enforceRevocation(r models.Revocation) int {
+	candidates := hub.all()
+	if r.TokenID == "" && r.UserID != "" {
+		candidates = hub.Clients(r.UserID)
+	}
+	closed := 0
+	for _, c := range candidates {
+		if !c.matchesRevocation(r) {
+			continue
+		}
+		log.ApplicationInfo(c.ctx).Str("reason", r.Reason).Msg("closing revoked connection")
+		c.closeWithReason(websocket.ClosePolicyViolation, revocationCloseReason)
+		hub.Unregister(c)
+		closed++
+	}
+	return closed
+}
+
+// revoke stores the revocation, closes the connections it denies and hands it to the other nodes
+func revoke(r models.Revocation) int {
+	storeRevocation(r)
+	cluster.publish("", &models.ClusterMessage{Kind: constant.ClusterKindRevoke, Revocation: &r})
+	return enforceRevocation(r)
+}
+
+// lift stores the lift of the revocation and hands it to the other nodes, it lasts as long as the revocation
+// would have so the revocation cannot come back
+func lift(r models.Revocation, admin string) models.Revocation {
+	now := time.Now()
+	r.LiftedAt, r.LiftedBy = now.UnixMilli(), admin
+	r.ExpiresAt = now.Add(revocationTTL()).UnixMilli()
+	if stored, ok := storedRevocation(revocationKey(r)); ok && stored.ExpiresAt > r.ExpiresAt {
+		r.ExpiresAt = stored.ExpiresAt
+	}
+	storeRevocation(r)
+	cluster.publish("", &models.ClusterMessage{Kind: constant.ClusterKindRevoke, Revocation: &r})
+	return r
+}
+
+// revocationTTL is how long revocations last when the admin does not tell
+func revocationTTL() time.Duration {
+	return time.Duration(configs.GetAppConfigIntD(constant.RevocationTtlInSecondsKey, int(defaultRevocationTTL.Seconds()))) * time.Second
+}
+
+func validateRevocation(r *models.Revocation) error {
+	r.TokenID, r.UserID, r.DeviceID = strings.TrimSpace(r.TokenID), strings.TrimSpace(r.UserID), strings.TrimSpace(r.DeviceID)
+	switch {
+	case r.TokenID != "" && (r.UserID != "" || r.DeviceID != ""):
+		return errors.New("token_id cannot have a user or device")
+	case r.TokenID == "" && r.UserID == "" && r.DeviceID == "":
+		return errors.New("token_id, user_id or device_id is required")
+	case r.TTLSeconds < 0:
+		return errors.New("ttl_seconds cannot be negative")
+	}
+	return nil
+}
+
+// RevokeEndpoint lets admins revoke a token, a device or a user. Upgrades are refused from then on and live
+// connections are closed on every node. DELETE with the same token, device or user lifts the revocation.
+func RevokeEndpoint(w http.ResponseWriter, r *http.Request) {
+	reqStartTime := time.Now()
+	reqID := utils.GetRequestID(r, "revoke")
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		utils.JSONErrorResponder(r, w, http.StatusMethodNotAllowed, reqID, "", constant.ErrorCodeMap["ABP11001"], reqStartTime, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	claims, err := utils.AuthenticateUser(r)
+	if err != nil || !strings.EqualFold(claims.UserType, constant.UserTypeAdmin) {
+		w.Header().Add("Unauthorized", "true")
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, "", constant.ErrorCodeMap["ABP11003"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11003"]))
+		return
+	}
+	admin := claims.UserData.UserID
+	ctx := log.WithPartyCode(context.WithValue(r.Context(), constant.IDLogParam, reqID), admin)
+
+	req := models.Revocation{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRevocationBodyBytes)).Decode(&req); err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, admin, constant.ErrorCodeMap["ABP11004"], reqStartTime, err)
+		return
+	}
+	if err := validateRevocation(&req); err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, admin, constant.ErrorCodeMap["ABP11004"], reqStartTime, err)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		lifted := lift(req, admin)
+		log.AuditInfo(ctx).Str(constant.ActionLogParam, "lift revocation").Str("tokenID", req.TokenID).Str("userID", req.UserID).
+			Str(constant.DeviceLogParam, req.DeviceID).Str("reason", req.Reason).Msg("revocation lifted")
+		utils.JSONResponder(r, w, http.StatusOK, reqID, admin, "lifted", reqStartTime, models.RevokeResponse{Revocation: lifted})
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = revocationTTL()
+	}
+	now := time.Now()
+	req.RevokedAt = now.UnixMilli()
+	req.ExpiresAt = now.Add(ttl).UnixMilli()
+	req.RevokedBy = admin
+
+	closed := revoke(req)
+	log.AuditInfo(ctx).Str(constant.ActionLogParam, "revoke").Str("tokenID", req.TokenID).Str("userID", req.UserID).
+		Str(constant.DeviceLogParam, req.DeviceID).Str("reason", req.Reason).Int("closed", closed).Msg("access revoked")
+	utils.JSONResponder(r, w, http.StatusOK, reqID, admin, "revoked", reqStartTime, models.RevokeResponse{Revocation: req, Connections: closed})
+}
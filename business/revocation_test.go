@@ -0,0 +1,268 @@
+package business
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+)
+
+func TestRevoked(t *testing.T) {
+	now := time.Now()
+	expiresAt, revokedAt := now.Add(time.Hour).UnixMilli(), now.UnixMilli()
+	before, after := now.Add(-time.Hour).Unix(), now.Add(time.Minute).Unix()
+	tests := []struct {
+		name       string
+		revocation models.Revocation
+		tokenID    string
+		userID     string
+		deviceID   string
+		issuedAt   int64
+		want       bool
+	}{
+		{name: "token", revocation: models.Revocation{TokenID: "rv-t1"}, tokenID: "rv-t1", userID: "rv-u1", issuedAt: before, want: true},
+		{name: "token issued after the revocation", revocation: models.Revocation{TokenID: "rv-t13"}, tokenID: "rv-t13", userID: "rv-u13",
+			issuedAt: after, want: true},
+		{name: "other token of the user", revocation: models.Revocation{TokenID: "rv-t2"}, tokenID: "rv-t3", userID: "rv-u2", issuedAt: before},
+		{name: "user", revocation: models.Revocation{UserID: "rv-u4"}, tokenID: "rv-t4", userID: "RV-U4", deviceID: "phone", issuedAt: before, want: true},
+		{name: "user logged in again", revocation: models.Revocation{UserID: "rv-u14"}, userID: "rv-u14", issuedAt: after},
+		{name: "token issued in the second of the revocation", revocation: models.Revocation{UserID: "rv-u15"}, userID: "rv-u15",
+			issuedAt: now.Unix(), want: true},
+		{name: "token without issue time", revocation: models.Revocation{UserID: "rv-u16"}, userID: "rv-u16", want: true},
+		{name: "other user", revocation: models.Revocation{UserID: "rv-u5"}, userID: "rv-u6", issuedAt: before},
+		{name: "device of the user", revocation: models.Revocation{UserID: "rv-u7", DeviceID: "rv-d7"}, userID: "rv-u7", deviceID: "rv-d7",
+			issuedAt: before, want: true},
+		{name: "device of the user with a new token", revocation: models.Revocation{UserID: "rv-u17", DeviceID: "rv-d17"}, userID: "rv-u17",
+			deviceID: "rv-d17", issuedAt: after, want: true},
+		{name: "other device of the user", revocation: models.Revocation{UserID: "rv-u8", DeviceID: "rv-d8"}, userID: "rv-u8", deviceID: "rv-d9",
+			issuedAt: before},
+		{name: "same device of another user", revocation: models.Revocation{UserID: "rv-u10", DeviceID: "rv-d10"}, userID: "rv-u11",
+			deviceID: "rv-d10", issuedAt: before},
+		{name: "device of every user", revocation: models.Revocation{DeviceID: "rv-d12"}, userID: "rv-u12", deviceID: "rv-d12", issuedAt: before, want: true},
+		{name: "device of every user with a new token", revocation: models.Revocation{DeviceID: "rv-d18"}, userID: "rv-u18", deviceID: "rv-d18",
+			issuedAt: after, want: true},
+		{name: "lifted", revocation: models.Revocation{UserID: "rv-u19", DeviceID: "rv-d19", LiftedAt: revokedAt}, userID: "rv-u19",
+			deviceID: "rv-d19", issuedAt: before},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.revocation.RevokedAt, tt.revocation.ExpiresAt = revokedAt, expiresAt
+			if !storeRevocation(tt.revocation) {
+				t.Fatal("revocation not stored")
+			}
+			if got := revoked(tt.tokenID, tt.userID, tt.deviceID, tt.issuedAt); got != tt.want {
+				t.Errorf("revoked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokes(t *testing.T) {
+	revokedAt := time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+	tests := []struct {
+		name       string
+		revocation models.Revocation
+		issuedAt   time.Time
+		want       bool
+	}{
+		{name: "user token issued before", revocation: models.Revocation{UserID: "1", RevokedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(-time.Second), want: true},
+		{name: "user token issued after", revocation: models.Revocation{UserID: "1", RevokedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(time.Second)},
+		{name: "user token issued in the same second", revocation: models.Revocation{UserID: "1", RevokedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(-100 * time.Millisecond), want: true},
+		{name: "revocation without a time", revocation: models.Revocation{UserID: "1"}, issuedAt: revokedAt.Add(time.Hour), want: true},
+		{name: "user token without issue time", revocation: models.Revocation{UserID: "1", RevokedAt: revokedAt.UnixMilli()}, want: true},
+		{name: "device token issued after", revocation: models.Revocation{UserID: "1", DeviceID: "phone", RevokedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(time.Hour), want: true},
+		{name: "lifted", revocation: models.Revocation{UserID: "1", RevokedAt: revokedAt.UnixMilli(), LiftedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(-time.Hour)},
+		{name: "token issued after", revocation: models.Revocation{TokenID: "t1", RevokedAt: revokedAt.UnixMilli()},
+			issuedAt: revokedAt.Add(time.Hour), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revokes(tt.revocation, tt.issuedAt.Unix()); got != tt.want {
+				t.Errorf("revokes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientMatchesRevocation(t *testing.T) {
+	issuedAt := time.Now().Add(-time.Hour)
+	c := newTestClient("rv-1", "parent")
+	c.DeviceID = "phone"
+	c.setToken(&models.JWTLoginToken{StandardClaims: jwt.StandardClaims{Id: "rv-token", IssuedAt: issuedAt.Unix()}})
+	revokedAt := time.Now().UnixMilli()
+	earlier := issuedAt.Add(-time.Minute).UnixMilli()
+
+	tests := []struct {
+		name       string
+		revocation models.Revocation
+		want       bool
+	}{
+		{name: "token of the connection", revocation: models.Revocation{TokenID: "rv-token", RevokedAt: earlier}, want: true},
+		{name: "other token", revocation: models.Revocation{TokenID: "rv-other", RevokedAt: revokedAt}},
+		{name: "user matched without case", revocation: models.Revocation{UserID: "RV-1", RevokedAt: revokedAt}, want: true},
+		{name: "user revoked before the token", revocation: models.Revocation{UserID: "rv-1", RevokedAt: earlier}},
+		{name: "other user", revocation: models.Revocation{UserID: "rv-2", RevokedAt: revokedAt}},
+		{name: "device of the user", revocation: models.Revocation{UserID: "rv-1", DeviceID: "phone", RevokedAt: revokedAt}, want: true},
+		{name: "device of the user revoked before the token", revocation: models.Revocation{UserID: "rv-1", DeviceID: "phone", RevokedAt: earlier},
+			want: true},
+		{name: "device of the user lifted", revocation: models.Revocation{UserID: "rv-1", DeviceID: "phone", RevokedAt: revokedAt, LiftedAt: revokedAt}},
+		{name: "other device of the user", revocation: models.Revocation{UserID: "rv-1", DeviceID: "tablet", RevokedAt: revokedAt}},
+		{name: "device of every user", revocation: models.Revocation{DeviceID: "phone", RevokedAt: revokedAt}, want: true},
+		{name: "device of another user", revocation: models.Revocation{UserID: "rv-2", DeviceID: "phone", RevokedAt: revokedAt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.matchesRevocation(tt.revocation); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokedUserLogsInAgain(t *testing.T) {
+	// a token issued in the second of the revocation is denied, the revocation is made a bit earlier
+	revokedAt := time.Now().Add(-2 * time.Second).UnixMilli()
+	storeRevocation(models.Revocation{UserID: "rv-again", RevokedAt: revokedAt, ExpiresAt: time.Now().Add(time.Hour).UnixMilli()})
+	old := &models.JWTLoginToken{StandardClaims: jwt.StandardClaims{Id: "rv-old", IssuedAt: time.UnixMilli(revokedAt).Add(-time.Minute).Unix()}}
+	if !revoked(old.Id, "rv-again", "phone", old.IssuedAt) {
+		t.Fatal("token issued before the revocation not denied")
+	}
+
+	token, err := utils.GenerateJWTAccessToken(models.TokenUserData{UserID: "rv-again"}, "parent")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	claims, err := utils.DecodeUserTokenClaims(token)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if revoked(claims.Id, "rv-again", "phone", claims.IssuedAt) {
+		t.Error("token issued after the revocation denied")
+	}
+
+	// revoking the new token alone denies it, whatever the revocation of the user
+	storeRevocation(models.Revocation{TokenID: claims.Id, RevokedAt: time.Now().UnixMilli(), ExpiresAt: time.Now().Add(time.Hour).UnixMilli()})
+	if !revoked(claims.Id, "rv-again", "phone", claims.IssuedAt) {
+		t.Error("revoked token not denied")
+	}
+}
+
+func TestStoreRevocationOrder(t *testing.T) {
+	now := time.Now()
+	expiresAt := now.Add(time.Hour).UnixMilli()
+	revocation := models.Revocation{DeviceID: "rv-order", RevokedAt: now.Add(-time.Minute).UnixMilli(), ExpiresAt: expiresAt}
+	lifted := revocation
+	lifted.LiftedAt = now.UnixMilli()
+	again := models.Revocation{DeviceID: "rv-order", RevokedAt: now.Add(time.Minute).UnixMilli(), ExpiresAt: expiresAt}
+
+	steps := []struct {
+		name        string
+		revocation  models.Revocation
+		wantStored  bool
+		wantRevoked bool
+	}{
+		{name: "revoked", revocation: revocation, wantStored: true, wantRevoked: true},
+		{name: "lifted", revocation: lifted, wantStored: true},
+		{name: "revocation handed over late", revocation: revocation},
+		{name: "revoked again", revocation: again, wantStored: true, wantRevoked: true},
+		{name: "lift handed over late", revocation: lifted, wantRevoked: true},
+	}
+	for _, step := range steps {
+		if stored := storeRevocation(step.revocation); stored != step.wantStored {
+			t.Errorf("%s: stored = %v, want %v", step.name, stored, step.wantStored)
+		}
+		if got := revoked("", "rv-user", "rv-order", now.Unix()); got != step.wantRevoked {
+			t.Errorf("%s: revoked = %v, want %v", step.name, got, step.wantRevoked)
+		}
+	}
+}
+
+func TestRevokeEndpointLift(t *testing.T) {
+	token, err := utils.GenerateJWTAccessToken(models.TokenUserData{UserID: "rv-admin"}, constant.UserTypeAdmin)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	call := func(method string) int {
+		r := httptest.NewRequest(method, constant.AdminRevokeRoute, strings.NewReader(`{"user_id":"rv-lift","device_id":"rv-stolen"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		RevokeEndpoint(w, r)
+		return w.Code
+	}
+	issuedAt := time.Now().Add(time.Minute).Unix()
+
+	if code := call(http.MethodPost); code != http.StatusOK {
+		t.Fatalf("revoke status = %d", code)
+	}
+	if !revoked("", "rv-lift", "rv-stolen", issuedAt) {
+		t.Fatal("device not denied a new token")
+	}
+	if code := call(http.MethodDelete); code != http.StatusOK {
+		t.Fatalf("lift status = %d", code)
+	}
+	if revoked("", "rv-lift", "rv-stolen", issuedAt) {
+		t.Error("device still denied once the revocation was lifted")
+	}
+}
+
+func TestRevocationExpiry(t *testing.T) {
+	if storeRevocation(models.Revocation{UserID: "rv-expired", ExpiresAt: time.Now().Add(-time.Second).UnixMilli()}) {
+		t.Error("expired revocation stored")
+	}
+	if revoked("", "rv-expired", "", 0) {
+		t.Error("user denied by an expired revocation")
+	}
+
+	storeRevocation(models.Revocation{UserID: "rv-expiring", ExpiresAt: time.Now().Add(50 * time.Millisecond).UnixMilli()})
+	if !revoked("", "rv-expiring", "", 0) {
+		t.Fatal("user not denied before the revocation expires")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if revoked("", "rv-expiring", "", 0) {
+		t.Error("user still denied once the revocation expired")
+	}
+	for _, r := range revocations() {
+		if strings.HasPrefix(r.UserID, "rv-expir") {
+			t.Errorf("expired revocation %+v handed to other nodes", r)
+		}
+	}
+}
+
+func TestValidateRevocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		revocation models.Revocation
+		wantErr    string
+	}{
+		{name: "token", revocation: models.Revocation{TokenID: " t1 "}},
+		{name: "device of the user", revocation: models.Revocation{UserID: "1", DeviceID: "phone"}},
+		{name: "token with a user", revocation: models.Revocation{TokenID: "t1", UserID: "1"}, wantErr: "token_id cannot have a user or device"},
+		{name: "nothing to revoke", revocation: models.Revocation{UserID: " "}, wantErr: "token_id, user_id or device_id is required"},
+		{name: "negative ttl", revocation: models.Revocation{UserID: "1", TTLSeconds: -1}, wantErr: "ttl_seconds cannot be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRevocation(&tt.revocation)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("err = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
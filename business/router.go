@@ -0,0 +1,197 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// HandlerFunc handles one message type received over the socket
+type HandlerFunc func(mc *MessageContext) error
+
+// MessageContext is handed to the handler of every received message
+type MessageContext struct {
+	context.Context
+	Client  *Client
+	Message *models.Envelope
+}
+
+// Bind decodes the payload of the message into v
+func (mc *MessageContext) Bind(v interface{}) error {
+	if len(mc.Message.Payload) == 0 {
+		return NewProtocolError("ABP11004", errors.New("payload is missing"))
+	}
+	if err := json.Unmarshal(mc.Message.Payload, v); err != nil {
+		return NewProtocolError("ABP11004", err)
+	}
+	return nil
+}
+
+// Reply sends a message of the given type correlated to the received message
+func (mc *MessageContext) Reply(msgType string, payload interface{}) error {
+	env, err := NewEnvelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	env.CorrelationID = mc.Message.ID
+	return mc.Client.SendEnvelope(env)
+}
+
+// ReplyError sends an error frame correlated to the received message
+func (mc *MessageContext) ReplyError(err error) error {
+	return mc.Client.sendError(mc.Message.ID, err)
+}
+
+// ProtocolError is the error surfaced to the client in an error frame, the code is a key of constant.ErrorCodeMap
+type ProtocolError struct {
+	Code    string
+	Details interface{}
+	Err     error
+}
+
+// NewProtocolError is used to create a protocol error for the error code
+func NewProtocolError(code string, err error) *ProtocolError {
+	return &ProtocolError{Code: code, Err: err}
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err == nil {
+		return constant.ErrorCodeMap[e.Code]
+	}
+	return e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ProtocolError) payload() models.ErrorPayload {
+	details := e.Details
+	if details == nil && e.Err != nil {
+		details = e.Err.Error()
+	}
+	return models.ErrorPayload{
+		Code:    e.Code,
+		Message: constant.ErrorCodeMap[e.Code],
+		Details: details,
+	}
+}
+
+// NewEnvelope is used to create a server message with a fresh id and timestamp
+func NewEnvelope(msgType string, payload interface{}) (*models.Envelope, error) {
+	env := &models.Envelope{
+		Version:   models.APIVersion_V1,
+		Type:      msgType,
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return env, nil
+}
+
+// Router dispatches received messages to the handler registered for their type
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+}
+
+// NewRouter is used to create a router without any handlers
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+var router = NewRouter()
+
+// Handle registers the handler for the message type, replacing any earlier one
+func (r *Router) Handle(msgType string, handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = handler
+}
+
+func (r *Router) handler(msgType string) (HandlerFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[msgType]
+	return h, ok
+}
+
+// Dispatch decodes the frame and runs the handler of its type when the connection is allowed to send it,
+// every failure is answered with an error frame
+func (r *Router) Dispatch(c *Client, data []byte) {
+	env := &models.Envelope{}
+	if err := json.Unmarshal(data, env); err != nil || env.Type == "" {
+		if err == nil {
+			err = errors.New("message type is missing")
+		}
+		metrics.AddSocketMessage(constant.MetricsDirectionIn, constant.MetricsTypeInvalid, len(data))
+		c.sendError(env.ID, NewProtocolError("ABP11009", err))
+		return
+	}
+	h, ok := r.handler(env.Type)
+	if !ok {
+		metrics.AddSocketMessage(constant.MetricsDirectionIn, constant.MetricsTypeUnknown, len(data))
+		c.sendError(env.ID, NewProtocolError("ABP11010", errors.New(env.Type)))
+		return
+	}
+	metrics.AddSocketMessage(constant.MetricsDirectionIn, env.Type, len(data))
+	// the actor comes from the token, never from the client
+	env.Actor = c.Actor
+	mc := &MessageContext{
+		Context: context.WithValue(c.ctx, constant.CorrelationLogParam, env.ID),
+		Client:  c,
+		Message: env,
+	}
+	if err := authz.authorizeMessage(mc, c, env.Type); err != nil {
+		mc.ReplyError(err)
+		return
+	}
+	if err := h(mc); err != nil {
+		log.ApplicationError(mc).Err(err).Str(constant.ActionLogParam, env.Type).Msg("error handling message")
+		mc.ReplyError(err)
+	}
+}
+
+// messageTypes are the message types of the protocol, the types pushed by other services are counted as other
+var messageTypes = map[string]struct{}{
+	constant.MessageTypeError: {}, constant.MessageTypePing: {}, constant.MessageTypePong: {},
+	constant.MessageTypeGoingAway: {}, constant.MessageTypeSessionWelcome: {}, constant.MessageTypeSessionResync: {},
+	constant.MessageTypeAuthExpiring: {}, constant.MessageTypeAuthRefresh: {}, constant.MessageTypeAuthRefreshed: {},
+	constant.MessageTypeChatSend: {}, constant.MessageTypeChatSent: {}, constant.MessageTypeChatMessage: {},
+	constant.MessageTypeHistoryFetch: {}, constant.MessageTypeHistoryResult: {},
+	constant.MessageTypeAck: {}, constant.MessageTypeReceipt: {},
+	constant.MessageTypePresenceSet: {}, constant.MessageTypePresenceSubscribe: {}, constant.MessageTypePresenceUnsubscribe: {},
+	constant.MessageTypePresenceState: {}, constant.MessageTypePresenceUpdate: {},
+	constant.MessageTypeTypingStart: {}, constant.MessageTypeTypingStop: {},
+	constant.MessageTypeSubscribe: {}, constant.MessageTypeUnsubscribe: {}, constant.MessageTypeSubscribed: {},
+	constant.MessageTypePublish: {}, constant.MessageTypeTopicMessage: {},
+}
+
+// metricsMessageType is the label of the message type, bounded to the types of the protocol
+func metricsMessageType(msgType string) string {
+	if _, ok := messageTypes[msgType]; ok {
+		return msgType
+	}
+	return constant.MetricsTypeOther
+}
+
+// RegisterHandler registers the handler for the message type on the socket router
+func RegisterHandler(msgType string, handler HandlerFunc) {
+	router.Handle(msgType, handler)
+}
@@ -0,0 +1,287 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/store"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+const testApplicationConfig = `
+jwt_key: "${JWTKEY}"
+push:
+    mtls:
+        mode: "optional"
+        identities:
+            - subject: "CN=payments,OU=services,O=SmartPet"
+              service: "payments"
+`
+
+func TestMain(m *testing.M) {
+	// only the key signing the user tokens and the client certificates of the push api, every other setting
+	// takes its default
+	dir, err := os.MkdirTemp("", "configs")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "application.yml"), []byte(testApplicationConfig), 0o600); err != nil {
+		panic(err)
+	}
+	os.Setenv("JWTKEY", "secret")
+	configs.Init(dir)
+	metrics.Init(metrics.BucketConfig{Start: 0.01, Width: 0.03, Count: 4})
+	utils.InitCache()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestClient is used to create a connection of the user without a socket, the frames it is sent stay in its queue
+func newTestClient(userID, userType string, scopes ...string) *Client {
+	c := newClient(context.Background(), nil, userID, "device")
+	c.setToken(&models.JWTLoginToken{TokenClaims: models.TokenClaims{UserType: userType, Scope: scopes}})
+	return c
+}
+
+// nextFrame returns the next frame queued on the connection
+func nextFrame(t *testing.T, c *Client) models.Envelope {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		env := models.Envelope{}
+		if err := json.Unmarshal(msg.data, &env); err != nil {
+			t.Fatalf("decoding frame: %v", err)
+		}
+		if env.Type != msg.msgType {
+			t.Fatalf("queued type %s, envelope type %s", msg.msgType, env.Type)
+		}
+		return env
+	case <-time.After(time.Second):
+		t.Fatal("no frame queued")
+	}
+	return models.Envelope{}
+}
+
+// errorCode returns the code of an error frame, empty for other frames
+func errorCode(t *testing.T, env models.Envelope) string {
+	t.Helper()
+	if env.Type != constant.MessageTypeError {
+		return ""
+	}
+	payload := models.ErrorPayload{}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		t.Fatalf("decoding error payload: %v", err)
+	}
+	return payload.Code
+}
+
+// withPolicy replaces the authorization policy for the test
+func withPolicy(t *testing.T, policy models.AuthzPolicy) {
+	t.Helper()
+	previous := authz
+	authz = &authorizer{policy: policy}
+	t.Cleanup(func() { authz = previous })
+}
+
+func TestRouterDispatch(t *testing.T) {
+	withPolicy(t, models.AuthzPolicy{
+		DefaultAction: constant.AuthzAllow,
+		Messages: []models.MessageRule{
+			{Types: []string{"guarded"}, UserTypes: []string{"provider"}, Scopes: []string{"guarded.send"}},
+		},
+	})
+	r := NewRouter()
+	r.Handle("echo", func(mc *MessageContext) error {
+		return mc.Reply("echoed", nil)
+	})
+	r.Handle("bind", func(mc *MessageContext) error {
+		v := struct {
+			Text string `json:"text"`
+		}{}
+		if err := mc.Bind(&v); err != nil {
+			return err
+		}
+		return mc.Reply("bound", v)
+	})
+	r.Handle("fail", func(mc *MessageContext) error {
+		return errors.New("database down")
+	})
+	r.Handle("guarded", func(mc *MessageContext) error {
+		return mc.Reply("guarded", nil)
+	})
+
+	tests := []struct {
+		name          string
+		userType      string
+		scopes        []string
+		frame         string
+		wantType      string
+		wantCode      string
+		wantCorrelate string
+	}{
+		{name: "malformed json", frame: `{"type":`, wantType: constant.MessageTypeError, wantCode: "ABP11009"},
+		{name: "missing type", frame: `{"id":"1"}`, wantType: constant.MessageTypeError, wantCode: "ABP11009", wantCorrelate: "1"},
+		{name: "unknown type", frame: `{"type":"nope","id":"2"}`, wantType: constant.MessageTypeError, wantCode: "ABP11010", wantCorrelate: "2"},
+		{name: "reply correlated", frame: `{"type":"echo","id":"3"}`, wantType: "echoed", wantCorrelate: "3"},
+		{name: "payload bound", frame: `{"type":"bind","id":"4","payload":{"text":"hi"}}`, wantType: "bound", wantCorrelate: "4"},
+		{name: "payload missing", frame: `{"type":"bind","id":"5"}`, wantType: constant.MessageTypeError, wantCode: "ABP11004", wantCorrelate: "5"},
+		{name: "payload invalid", frame: `{"type":"bind","id":"6","payload":{"text":1}}`,
+			wantType: constant.MessageTypeError, wantCode: "ABP11004", wantCorrelate: "6"},
+		{name: "internal errors are not surfaced", frame: `{"type":"fail","id":"7"}`,
+			wantType: constant.MessageTypeError, wantCode: "ABP11000", wantCorrelate: "7"},
+		{name: "wrong user type", userType: "parent", scopes: []string{"guarded.send"}, frame: `{"type":"guarded","id":"8"}`,
+			wantType: constant.MessageTypeError, wantCode: "ABP11016", wantCorrelate: "8"},
+		{name: "missing scope", userType: "provider", frame: `{"type":"guarded","id":"9"}`,
+			wantType: constant.MessageTypeError, wantCode: "ABP11016", wantCorrelate: "9"},
+		{name: "user type matched without case", userType: "Provider", scopes: []string{"guarded.send"},
+			frame: `{"type":"guarded","id":"10"}`, wantType: "guarded", wantCorrelate: "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", tt.userType, tt.scopes...)
+			r.Dispatch(c, []byte(tt.frame))
+			env := nextFrame(t, c)
+			if env.Type != tt.wantType {
+				t.Fatalf("type = %s, want %s", env.Type, tt.wantType)
+			}
+			if code := errorCode(t, env); code != tt.wantCode {
+				t.Errorf("code = %s, want %s", code, tt.wantCode)
+			}
+			if env.CorrelationID != tt.wantCorrelate {
+				t.Errorf("correlation id = %s, want %s", env.CorrelationID, tt.wantCorrelate)
+			}
+			if env.ID == "" || env.Version != models.APIVersion_V1 {
+				t.Errorf("envelope id %q version %q, want a fresh id and %s", env.ID, env.Version, models.APIVersion_V1)
+			}
+		})
+	}
+}
+
+func TestHandleHistoryFetch(t *testing.T) {
+	previous := messageStore
+	messageStore = store.NewMemoryStore()
+	t.Cleanup(func() { messageStore = previous })
+	conversation := conversationID("1", "2")
+	for i := 0; i < 5; i++ {
+		msg := &models.ChatMessage{ID: string(rune('a' + i)), ConversationID: conversation, From: "1", To: "2", Text: "hi"}
+		if err := messageStore.Save(context.Background(), msg); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		payload    string
+		wantCode   string
+		wantIDs    []string
+		wantCursor int64
+	}{
+		{name: "missing with", payload: `{}`, wantCode: "ABP11004"},
+		{name: "first page", payload: `{"with":"2","limit":2}`, wantIDs: []string{"e", "d"}, wantCursor: 4},
+		{name: "next page", payload: `{"with":"2","limit":2,"before":4}`, wantIDs: []string{"c", "b"}, wantCursor: 2},
+		{name: "last page has no cursor", payload: `{"with":"2","limit":2,"before":2}`, wantIDs: []string{"a"}},
+		{name: "empty conversation", payload: `{"with":"3"}`, wantIDs: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", "parent")
+			mc := &MessageContext{
+				Context: context.Background(),
+				Client:  c,
+				Message: &models.Envelope{Type: constant.MessageTypeHistoryFetch, ID: "h", Payload: json.RawMessage(tt.payload)},
+			}
+			err := handleHistoryFetch(mc)
+			if tt.wantCode != "" {
+				if perr, ok := err.(*ProtocolError); !ok || perr.Code != tt.wantCode {
+					t.Fatalf("err = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			env := nextFrame(t, c)
+			result := models.HistoryResult{}
+			if err := json.Unmarshal(env.Payload, &result); err != nil {
+				t.Fatalf("decoding result: %v", err)
+			}
+			ids := []string{}
+			for _, msg := range result.Messages {
+				ids = append(ids, msg.ID)
+			}
+			if len(ids) != len(tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			for i := range ids {
+				if ids[i] != tt.wantIDs[i] {
+					t.Fatalf("ids = %v, want %v", ids, tt.wantIDs)
+				}
+			}
+			if result.NextCursor != tt.wantCursor {
+				t.Errorf("next cursor = %d, want %d", result.NextCursor, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestRouterActor(t *testing.T) {
+	withPolicy(t, models.AuthzPolicy{DefaultAction: constant.AuthzAllow})
+	r := NewRouter()
+	var handled *models.Envelope
+	r.Handle("echo", func(mc *MessageContext) error {
+		handled = mc.Message
+		return mc.Reply("echoed", nil)
+	})
+
+	tests := []struct {
+		name      string
+		actor     string
+		frame     string
+		wantActor string
+	}{
+		{name: "actor of the connection", actor: "support-7", frame: `{"type":"echo","id":"1"}`, wantActor: "support-7"},
+		{name: "actor of the frame ignored", actor: "support-7", frame: `{"type":"echo","id":"2","actor":"spoofed"}`, wantActor: "support-7"},
+		{name: "no actor", frame: `{"type":"echo","id":"3","actor":"spoofed"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			c := newTestClient("1", "provider")
+			c.Actor = tt.actor
+			r.Dispatch(c, []byte(tt.frame))
+			nextFrame(t, c)
+			if handled == nil || handled.Actor != tt.wantActor {
+				t.Errorf("actor = %v, want %q", handled, tt.wantActor)
+			}
+		})
+	}
+}
+
+func TestMetricsMessageType(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgType string
+		want    string
+	}{
+		{name: "type of the protocol", msgType: constant.MessageTypeChatSend, want: constant.MessageTypeChatSend},
+		{name: "type pushed by another service", msgType: "booking.created", want: constant.MetricsTypeOther},
+		{name: "empty type", msgType: "", want: constant.MetricsTypeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricsMessageType(tt.msgType); got != tt.want {
+				t.Errorf("label = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
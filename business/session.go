@@ -0,0 +1,277 @@
+package business
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// replayEvent is an event pushed to a user, kept for the devices reconnecting after missing it
+type replayEvent struct {
+	seq     int64
+	msgType string
+	data    []byte
+	// set for chat messages, replayed ones are tracked until acked like any delivery
+	messageID string
+	// the device the event was not meant for, as it originated there
+	exceptDevice string
+}
+
+// eventStream sequences the events pushed to one user and keeps the last ones for replay
+type eventStream struct {
+	mu     sync.Mutex
+	seq    int64
+	events []replayEvent
+}
+
+// resumeSession is the logical session of a device, it outlives its connections for the resume ttl
+type resumeSession struct {
+	user      string
+	deviceID  string
+	attached  int
+	expiresAt time.Time
+}
+
+// sessionRegistry keeps the sessions of the devices connected to this node. Sessions, the sequence numbers of
+// the events of their users and the replay buffers are not shared with the other nodes: a client can only resume
+// on the node that issued its resume token, which is named in the token, and is told to resync with other_node
+// anywhere else. The events of a user are numbered separately on every node the user is connected to.
+type sessionRegistry struct {
+	mu      sync.Mutex
+	tokens  map[string]*resumeSession
+	streams map[string]*eventStream // user key to the events of the user
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		tokens:  make(map[string]*resumeSession),
+		streams: make(map[string]*eventStream),
+	}
+}
+
+var sessions = newSessionRegistry()
+
+// newResumeToken returns a token naming the node, so a resume landing on another node is told apart from an
+// unknown session
+func newResumeToken(node string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return node + resumeTokenSeparator + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// separates the node from the random part of a resume token, it is not in the base64 url alphabet
+const resumeTokenSeparator = "."
+
+// resumeTokenNode returns the node that issued the resume token, empty when the token does not name one
+func resumeTokenNode(token string) string {
+	if i := strings.LastIndex(token, resumeTokenSeparator); i > 0 {
+		return token[:i]
+	}
+	return ""
+}
+
+// stream returns the events of the user, nil when no session of the user is alive as nobody could resume them
+func (r *sessionRegistry) stream(userID string) *eventStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[userKey(userID)]
+}
+
+// open resumes the session of the token when it belongs to the device, otherwise it starts a new one
+func (r *sessionRegistry) open(c *Client, token string, now time.Time) (*eventStream, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user := userKey(c.UserID)
+	sess, ok := r.tokens[token]
+	resumed := ok && sess.user == user && sess.deviceID == c.DeviceID && (sess.attached > 0 || now.Before(sess.expiresAt))
+	if !resumed {
+		var err error
+		if token, err = newResumeToken(cluster.id); err != nil {
+			return nil, false, err
+		}
+		sess = &resumeSession{user: user, deviceID: c.DeviceID}
+		r.tokens[token] = sess
+	}
+	sess.attached++
+	c.resumeToken = token
+
+	stream, ok := r.streams[user]
+	if !ok {
+		stream = &eventStream{}
+		r.streams[user] = stream
+	}
+	return stream, resumed, nil
+}
+
+// attach registers the connection and opens its session. The welcome goes out first, followed by the events
+// missed since lastSeq when the session is resumed, or by a resync when they are no longer buffered.
+// A negative lastSeq means the client sent one that could not be read. It returns false when the hub refused
+// the connection for going over the connection limits.
+func (r *sessionRegistry) attach(c *Client, token string, lastSeq int64) bool {
+	stream, resumed, err := r.open(c, token, time.Now())
+	if err != nil {
+		log.ApplicationError(c.ctx).Err(err).Msg("error creating resume token")
+		return hub.Register(c)
+	}
+
+	// registering under the lock of the stream keeps live events from overtaking the replayed ones
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if !hub.Register(c) {
+		return false
+	}
+
+	reason := ""
+	var replay []replayEvent
+	switch {
+	case token != "" && !resumed:
+		reason = constant.ResyncUnknownSession
+		if node := resumeTokenNode(token); node != "" && node != cluster.id {
+			reason = constant.ResyncOtherNode
+			log.ApplicationInfo(c.ctx).Str("node", node).Msg("session of another node, resync needed")
+		}
+	case !resumed:
+	case lastSeq < 0 || lastSeq > stream.seq:
+		reason = constant.ResyncInvalidSeq
+	default:
+		replay = stream.since(lastSeq, c.DeviceID)
+		// the first missed event is gone from the buffer, or the missed events would not fit in the send queue
+		if (lastSeq < stream.seq && (len(stream.events) == 0 || stream.events[0].seq > lastSeq+1)) || len(replay) >= cap(c.send) {
+			reason = constant.ResyncGapTooLarge
+			replay = nil
+		}
+	}
+
+	if env, err := NewEnvelope(constant.MessageTypeSessionWelcome, models.SessionWelcome{
+		ResumeToken: c.resumeToken,
+		Seq:         stream.seq,
+		Resumed:     resumed && reason == "",
+	}); err == nil {
+		c.SendEnvelope(env)
+	}
+	if reason != "" {
+		if env, err := NewEnvelope(constant.MessageTypeSessionResync, models.SessionResync{
+			Reason:  reason,
+			LastSeq: lastSeq,
+			Seq:     stream.seq,
+		}); err == nil {
+			c.SendEnvelope(env)
+		}
+		return true
+	}
+	for _, e := range replay {
+		if err := c.Send(e.msgType, e.data); err != nil {
+			return true
+		}
+		if e.messageID != "" {
+			c.track(e.messageID, e.data)
+		}
+	}
+	if len(replay) > 0 {
+		log.ApplicationInfo(c.ctx).Int64(constant.LastSeqQueryParam, lastSeq).Int("replayed", len(replay)).Msg("session resumed")
+	}
+	return true
+}
+
+// detach starts the resume ttl of the session once its last connection is gone
+func (r *sessionRegistry) detach(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.tokens[c.resumeToken]
+	if !ok {
+		return
+	}
+	sess.attached--
+	if sess.attached <= 0 {
+		sess.attached = 0
+		sess.expiresAt = time.Now().Add(settings.resumeTTL)
+	}
+}
+
+// sweep forgets the expired sessions and the events of users left without any session
+func (r *sessionRegistry) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	alive := make(map[string]struct{}, len(r.streams))
+	for token, sess := range r.tokens {
+		if sess.attached == 0 && now.After(sess.expiresAt) {
+			delete(r.tokens, token)
+			continue
+		}
+		alive[sess.user] = struct{}{}
+	}
+	for user := range r.streams {
+		if _, ok := alive[user]; !ok {
+			delete(r.streams, user)
+		}
+	}
+}
+
+// since returns the buffered events after seq meant for the device, the stream has to be locked
+func (s *eventStream) since(seq int64, deviceID string) []replayEvent {
+	var result []replayEvent
+	for _, e := range s.events {
+		if e.seq > seq && (e.exceptDevice == "" || e.exceptDevice != deviceID) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// append buffers the event, dropping the oldest one when the buffer is full, the stream has to be locked
+func (s *eventStream) append(e replayEvent) {
+	if len(s.events) >= settings.replayBufferSize {
+		copy(s.events, s.events[1:])
+		s.events = s.events[:len(s.events)-1]
+	}
+	s.events = append(s.events, e)
+}
+
+// pushToUser gives the event the next sequence number of the user, buffers it for replay and queues it
+// on the connections of the user, except those of exceptDevice. It returns the connections it was queued on
+// and the frame, so chat messages can be tracked until acked.
+func pushToUser(userID string, env *models.Envelope, messageID, exceptDevice string) ([]*Client, []byte, error) {
+	stream := sessions.stream(userID)
+	if stream == nil {
+		data, err := json.Marshal(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sendExcept(hub.Clients(userID), exceptDevice, env.Type, data), data, nil
+	}
+
+	// sequencing and queueing under the same lock keeps every connection in sequence order
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	env.Seq = stream.seq + 1
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream.seq = env.Seq
+	stream.append(replayEvent{seq: env.Seq, msgType: env.Type, data: data, messageID: messageID, exceptDevice: exceptDevice})
+	return sendExcept(hub.Clients(userID), exceptDevice, env.Type, data), data, nil
+}
+
+func sendExcept(clients []*Client, exceptDevice, msgType string, data []byte) []*Client {
+	sent := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		if exceptDevice != "" && c.DeviceID == exceptDevice {
+			continue
+		}
+		if err := c.Send(msgType, data); err != nil {
+			continue
+		}
+		sent = append(sent, c)
+	}
+	return sent
+}
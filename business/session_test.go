@@ -0,0 +1,154 @@
+package business
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestSessionAttach(t *testing.T) {
+	previous, previousSessions := settings, sessions
+	t.Cleanup(func() { settings, sessions = previous, previousSessions })
+	settings.sendQueueSize = 16
+
+	tests := []struct {
+		name         string
+		bufferSize   int
+		resumeTTL    time.Duration
+		exceptPhone  bool // the second event originated on the phone
+		device       string
+		token        string // of the first connection when empty
+		newSession   bool
+		lastSeq      int64
+		wantResumed  bool
+		wantNewToken bool
+		wantReason   string
+		wantReplayed []int64
+	}{
+		{name: "new session", newSession: true, wantNewToken: true},
+		{name: "missed events replayed", lastSeq: 1, wantResumed: true, wantReplayed: []int64{2, 3}},
+		{name: "nothing missed", lastSeq: 3, wantResumed: true},
+		{name: "events of the device skipped", exceptPhone: true, lastSeq: 1, wantResumed: true, wantReplayed: []int64{3}},
+		{name: "unknown token", token: "bogus", lastSeq: 1, wantNewToken: true, wantReason: constant.ResyncUnknownSession},
+		{name: "unknown token of this node", token: cluster.id + ".bogus", lastSeq: 1, wantNewToken: true, wantReason: constant.ResyncUnknownSession},
+		{name: "token of another node", token: "other-node.bogus", lastSeq: 1, wantNewToken: true, wantReason: constant.ResyncOtherNode},
+		{name: "token of another device", device: "tablet", lastSeq: 1, wantNewToken: true, wantReason: constant.ResyncUnknownSession},
+		{name: "session expired", resumeTTL: -time.Second, lastSeq: 1, wantNewToken: true, wantReason: constant.ResyncUnknownSession},
+		{name: "seq ahead of the stream", lastSeq: 4, wantReason: constant.ResyncInvalidSeq},
+		{name: "unreadable seq", lastSeq: -1, wantReason: constant.ResyncInvalidSeq},
+		{name: "missed events no longer buffered", bufferSize: 2, lastSeq: 0, wantReason: constant.ResyncGapTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.replayBufferSize = 10
+			if tt.bufferSize > 0 {
+				settings.replayBufferSize = tt.bufferSize
+			}
+			settings.resumeTTL = time.Minute
+			if tt.resumeTTL != 0 {
+				settings.resumeTTL = tt.resumeTTL
+			}
+			sessions = newSessionRegistry()
+
+			first := newTestClient("5", "parent")
+			if !sessions.attach(first, "", 0) {
+				t.Fatal("first connection refused")
+			}
+			nextFrame(t, first)
+			for i := 0; i < 3; i++ {
+				exceptDevice := ""
+				if i == 1 && tt.exceptPhone {
+					exceptDevice = first.DeviceID
+				}
+				env, _ := NewEnvelope("event", nil)
+				if _, _, err := pushToUser("5", env, "", exceptDevice); err != nil {
+					t.Fatalf("push: %v", err)
+				}
+			}
+			hub.remove(first)
+			sessions.detach(first)
+
+			c := newTestClient("5", "parent")
+			if tt.device != "" {
+				c.DeviceID = tt.device
+			}
+			token := first.resumeToken
+			switch {
+			case tt.newSession:
+				token = ""
+			case tt.token != "":
+				token = tt.token
+			}
+			if !sessions.attach(c, token, tt.lastSeq) {
+				t.Fatal("connection refused")
+			}
+			t.Cleanup(func() { hub.remove(c) })
+
+			env := nextFrame(t, c)
+			welcome := models.SessionWelcome{}
+			if err := json.Unmarshal(env.Payload, &welcome); err != nil || env.Type != constant.MessageTypeSessionWelcome {
+				t.Fatalf("first frame %s %v, want %s", env.Type, err, constant.MessageTypeSessionWelcome)
+			}
+			if welcome.Resumed != tt.wantResumed || welcome.Seq != 3 || welcome.ResumeToken == "" {
+				t.Errorf("welcome = %+v, want resumed %v at seq 3", welcome, tt.wantResumed)
+			}
+			if newToken := welcome.ResumeToken != first.resumeToken; newToken != tt.wantNewToken {
+				t.Errorf("new resume token = %v, want %v", newToken, tt.wantNewToken)
+			}
+			if tt.wantReason != "" {
+				env := nextFrame(t, c)
+				resync := models.SessionResync{}
+				if err := json.Unmarshal(env.Payload, &resync); err != nil || env.Type != constant.MessageTypeSessionResync {
+					t.Fatalf("second frame %s %v, want %s", env.Type, err, constant.MessageTypeSessionResync)
+				}
+				if resync.Reason != tt.wantReason || resync.LastSeq != tt.lastSeq || resync.Seq != 3 {
+					t.Errorf("resync = %+v, want %s from %d to 3", resync, tt.wantReason, tt.lastSeq)
+				}
+			}
+			var replayed []int64
+			for len(c.send) > 0 {
+				replayed = append(replayed, nextFrame(t, c).Seq)
+			}
+			if len(replayed) != len(tt.wantReplayed) {
+				t.Fatalf("replayed %v, want %v", replayed, tt.wantReplayed)
+			}
+			for i := range replayed {
+				if replayed[i] != tt.wantReplayed[i] {
+					t.Fatalf("replayed %v, want %v", replayed, tt.wantReplayed)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionSweep(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.resumeTTL = time.Minute
+	r := newSessionRegistry()
+	attached, detached := newTestClient("1", "parent"), newTestClient("2", "parent")
+	for _, c := range []*Client{attached, detached} {
+		if _, _, err := r.open(c, "", time.Now()); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+	}
+	r.detach(detached)
+
+	r.sweep(time.Now())
+	if r.stream("1") == nil || r.stream("2") == nil {
+		t.Fatal("session dropped within the resume ttl")
+	}
+	r.sweep(time.Now().Add(2 * time.Minute))
+	if r.stream("1") == nil {
+		t.Error("attached session dropped")
+	}
+	if r.stream("2") != nil {
+		t.Error("events of an expired session kept")
+	}
+	if _, resumed, _ := r.open(newTestClient("2", "parent"), detached.resumeToken, time.Now()); resumed {
+		t.Error("expired session resumed")
+	}
+}
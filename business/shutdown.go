@@ -0,0 +1,69 @@
+package business
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// Draining tells if the hub stopped accepting new connections
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// Shutdown stops accepting new connections, tells every client to reconnect after a jittered delay,
+// waits for their send queues to drain and closes them with CloseGoingAway, all within the context deadline
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.draining.Store(true)
+	clients := h.all()
+	log.ApplicationInfo(ctx).Int("connections", len(clients)).Msg("draining socket connections")
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.goAway(ctx)
+			h.Unregister(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func reconnectAfter() time.Duration {
+	delay := settings.reconnectDelay
+	if settings.reconnectJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(settings.reconnectJitter)))
+	}
+	return delay
+}
+
+// goAway sends the going away message and waits for the writer to flush the queue and close the connection
+func (c *Client) goAway(ctx context.Context) {
+	env, err := NewEnvelope(constant.MessageTypeGoingAway, models.GoingAway{
+		Reason:           "server shutdown",
+		ReconnectAfterMs: reconnectAfter().Milliseconds(),
+	})
+	if err == nil {
+		c.SendEnvelope(env)
+	}
+	c.drainOnce.Do(func() { close(c.drain) })
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		log.ApplicationWarn(c.ctx).Int("pending", len(c.send)).Msg("shutdown deadline reached before the send queue drained")
+		c.closeWithReason(websocket.CloseGoingAway, "server shutdown")
+	}
+}
+
+// Shutdown drains the connections of the hub of this process
+func Shutdown(ctx context.Context) {
+	hub.Shutdown(ctx)
+}
@@ -0,0 +1,125 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+func TestClientGoAway(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+	settings.reconnectDelay = time.Second
+	settings.reconnectJitter = 2 * time.Second
+
+	tests := []struct {
+		name      string
+		writer    bool
+		timeout   time.Duration
+		wantTypes []string
+	}{
+		{name: "queue flushed before the close", writer: true, timeout: time.Second,
+			wantTypes: []string{"queued", constant.MessageTypeGoingAway}},
+		// without a writer nothing drains the queue, the deadline closes the connection
+		{name: "closed at the deadline", timeout: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", "parent")
+			peer := withSocket(t, c)
+			env, err := NewEnvelope("queued", nil)
+			if err != nil {
+				t.Fatalf("envelope: %v", err)
+			}
+			c.SendEnvelope(env)
+			if tt.writer {
+				go c.writer()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			c.goAway(ctx)
+			if !c.closed() {
+				t.Fatal("connection still open")
+			}
+
+			var types []string
+			for {
+				peer.SetReadDeadline(time.Now().Add(time.Second))
+				_, data, err := peer.ReadMessage()
+				if err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+						t.Errorf("peer got %v, want a going away close", err)
+					}
+					break
+				}
+				got := models.Envelope{}
+				if err := json.Unmarshal(data, &got); err != nil {
+					t.Fatalf("decoding frame: %v", err)
+				}
+				types = append(types, got.Type)
+				if got.Type != constant.MessageTypeGoingAway {
+					continue
+				}
+				goingAway := models.GoingAway{}
+				if err := json.Unmarshal(got.Payload, &goingAway); err != nil {
+					t.Fatalf("decoding going away: %v", err)
+				}
+				if goingAway.ReconnectAfterMs < 1000 || goingAway.ReconnectAfterMs >= 3000 {
+					t.Errorf("reconnect after = %dms, want within [1000, 3000)", goingAway.ReconnectAfterMs)
+				}
+			}
+			if len(types) != len(tt.wantTypes) {
+				t.Fatalf("frames = %v, want %v", types, tt.wantTypes)
+			}
+			for i := range types {
+				if types[i] != tt.wantTypes[i] {
+					t.Fatalf("frames = %v, want %v", types, tt.wantTypes)
+				}
+			}
+		})
+	}
+}
+
+func TestHubShutdownRefusesConnections(t *testing.T) {
+	h := NewHub()
+	if h.Draining() {
+		t.Fatal("new hub draining")
+	}
+	h.Shutdown(context.Background())
+	if !h.Draining() {
+		t.Error("hub not draining after shutdown")
+	}
+}
+
+func TestReconnectAfter(t *testing.T) {
+	previous := settings
+	t.Cleanup(func() { settings = previous })
+
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		jitter  time.Duration
+		wantMax time.Duration // exclusive
+	}{
+		{name: "no jitter", delay: time.Second, wantMax: time.Second + 1},
+		{name: "jitter", delay: time.Second, jitter: 5 * time.Second, wantMax: 6 * time.Second},
+		{name: "jitter only", jitter: time.Second, wantMax: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.reconnectDelay = tt.delay
+			settings.reconnectJitter = tt.jitter
+			for i := 0; i < 100; i++ {
+				got := reconnectAfter()
+				if got < tt.delay || got >= tt.wantMax {
+					t.Fatalf("reconnect after = %v, want within [%v, %v)", got, tt.delay, tt.wantMax)
+				}
+			}
+		})
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
 	"github.com/smartpet/websocket/utils"
 
 	"net/http"
@@ -20,59 +23,175 @@ func WsEndpoint(w http.ResponseWriter, r *http.Request) {
 
 	reqStartTime := time.Now()
 	userId := r.Header.Get(constant.USERID)
+	var (
+		device string
+		claims *models.JWTLoginToken
+	)
+
+	// checked before anything else so pages of other sites cannot even burn the tickets of the user, the upgrader
+	// checks the origin again on upgrade
+	if !checkOrigin(r) {
+		metrics.IncSocketUpgrades(constant.UpgradeOriginRejected)
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, utils.GetRequestID(r, userId), userId, constant.ErrorCodeMap["ABP11024"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11024"]))
+		return
+	}
+
+	// browsers connect with a ticket, the user is the one of the token it was traded for
+	if ticket := socketTicket(r); ticket != "" {
+		reqID = utils.GetRequestID(r, "ticket")
+		t, ok := redeemTicket(r.Context(), ticket)
+		if !ok {
+			w.Header().Add("Unauthorized", "true")
+			metrics.IncSocketUpgrades(constant.UpgradeInvalidTicket)
+			utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, "", constant.ErrorCodeMap["ABP11017"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11017"]))
+			return
+		}
+		// the device was bound when the ticket was issued, the upgrade cannot claim another one
+		if d := r.Header.Get(constant.DEVICEID); d != "" && d != t.DeviceID {
+			w.Header().Add("Unauthorized", "true")
+			metrics.IncSocketUpgrades(constant.UpgradeDeviceMismatch)
+			utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, t.UserID, constant.ErrorCodeMap["ABP11022"], reqStartTime, errDeviceMismatch)
+			return
+		}
+		userId, device, claims = t.UserID, t.DeviceID, t.Claims
+	} else {
+		reqID = utils.GetRequestID(r, userId)
 
-	reqID = utils.GetRequestID(r, userId)
+		if utils.IsBlank(userId) {
 
-	if utils.IsBlank(userId) {
+			metrics.IncSocketUpgrades(constant.UpgradeBadRequest)
+			utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, userId, constant.ErrorCodeMap["ABP11001"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11001"]))
+			return
+		}
 
-		utils.JSONErrorResponder(r, w, http.StatusBadRequest, reqID, userId, constant.ErrorCodeMap["ABP11001"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11001"]))
-		return
-	}
+		log.Debug(r.Context()).Str(constant.IDLogParam, reqID).Str(constant.UserId, userId).Msg("authorizing socket upgrade")
 
-	fmt.Println(userId)
+		var err error
+		claims, err = utils.AuthorizeUser(r, userId)
+		if err != nil {
 
-	if !utils.ValidateJwtAndMatchClientIdCtx(r, userId) {
+			w.Header().Add("Unauthorized", "true")
+			metrics.IncSocketUpgrades(constant.UpgradeUnauthorized)
+			utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userId, constant.ErrorCodeMap["ABP11008"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11008"]))
+			return
+		}
+		//validate token
+		if device, err = deviceID(r, claims); err != nil {
+			w.Header().Add("Unauthorized", "true")
+			metrics.IncSocketUpgrades(constant.UpgradeDeviceMismatch)
+			utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userId, constant.ErrorCodeMap["ABP11022"], reqStartTime, err)
+			return
+		}
+	}
 
+	if revoked(claims.Id, userId, device, claims.IssuedAt) {
 		w.Header().Add("Unauthorized", "true")
-		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userId, constant.ErrorCodeMap["ABP11008"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11008"]))
+		metrics.IncSocketUpgrades(constant.UpgradeRevoked)
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userId, constant.ErrorCodeMap["ABP11020"], reqStartTime, errRevoked)
+		return
+	}
+
+	if hub.Draining() {
+		metrics.IncSocketUpgrades(constant.UpgradeDraining)
+		utils.JSONErrorResponder(r, w, http.StatusServiceUnavailable, reqID, userId, constant.ErrorCodeMap["ABP11011"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11011"]))
+		return
+	}
+	if !hub.admits(userId, device) {
+		metrics.IncSocketUpgrades(constant.UpgradeLimited)
+		utils.JSONErrorResponder(r, w, http.StatusTooManyRequests, reqID, userId, constant.ErrorCodeMap["ABP11023"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11023"]))
 		return
 	}
-	//validate token
 
 	// upgrade this connection to a WebSocket
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		metrics.IncSocketUpgrades(constant.UpgradeFailed)
 		log.ApplicationError(context.Background()).Msg(err.Error())
+		return
 	}
-	log.ApplicationInfo(context.Background()).Msg("Client connected")
+	metrics.IncSocketUpgrades(constant.UpgradeAccepted)
 
-	if err != nil {
-		log.ApplicationError(context.Background()).Msg(err.Error())
+	ctx := context.WithValue(log.WithPartyCode(context.Background(), userId), constant.IDLogParam, reqID)
+	actor := tokenActor(claims)
+	if actor != "" {
+		ctx = context.WithValue(ctx, constant.ActorLogParam, actor)
+	}
+	client := newClient(ctx, ws, userId, device)
+	client.Actor = actor
+	client.setToken(claims)
+	client.trackTokenExpiry(tokenExpiresAt(claims))
+	// labelled with the values of the token at connect, a refreshed token does not move the connection
+	userType, app := metricsLabel(claims.UserType), metricsLabel(claims.UserData.AppID)
+	metrics.AddSocketActiveConnections(userType, app, 1)
+	defer metrics.AddSocketActiveConnections(userType, app, -1)
+	go client.writer()
+	token, lastSeq := resumeParams(r)
+	if !sessions.attach(client, token, lastSeq) {
+		// a concurrent upgrade of the user took the last place within the connection limits
+		sessions.detach(client)
+		return
 	}
-	reader(ws)
+	defer requeueUnacked(client)
+	defer hub.Unregister(client)
+	defer sessions.detach(client)
+	defer emitConnectionActivity(client, constant.ActivityConnectionClosed)
+	defer auditImpersonation(client, false)
+	emitConnectionActivity(client, constant.ActivityConnectionOpened)
+	auditImpersonation(client, true)
+	log.ApplicationInfo(client.ctx).Str(constant.DeviceLogParam, client.DeviceID).Msg("Client connected")
+
+	// shutdown may have started while this connection was being upgraded
+	if hub.Draining() {
+		client.goAway(r.Context())
+		return
+	}
+	go flushOffline(client)
+	client.reader()
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+// metricsLabel stands in for the claims a token does not have
+func metricsLabel(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
 }
 
-func reader(conn *websocket.Conn) {
-	for {
-		// read in a message
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			log.ApplicationError(context.Background()).Msg(err.Error())
-			return
-		}
-		// print out that message for clarity
+var errDeviceMismatch = errors.New(constant.ErrorCodeMap["ABP11022"])
 
-		log.ApplicationInfo(context.Background()).Msg(string(p))
+// deviceID returns the device of the connection. A token bound to a device only connects that device, the
+// device sent by the client has to be the one of the token when both are given.
+func deviceID(r *http.Request, claims *models.JWTLoginToken) (string, error) {
+	device := r.Header.Get(constant.DEVICEID)
+	if claims == nil || utils.IsBlank(claims.DeviceId) {
+		return device, nil
+	}
+	if device != "" && device != claims.DeviceId {
+		return "", fmt.Errorf("%w: %v", errDeviceMismatch, device)
+	}
+	return claims.DeviceId, nil
+}
 
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.ApplicationError(context.Background()).Msg(err.Error())
-			return
-		}
+// resumeParams reads the resume token and the sequence number of the last event the client got,
+// the sequence number is negative when it cannot be read
+func resumeParams(r *http.Request) (string, int64) {
+	query := r.URL.Query()
+	token := query.Get(constant.ResumeQueryParam)
+	lastSeq := query.Get(constant.LastSeqQueryParam)
+	if token == "" || lastSeq == "" {
+		return token, 0
+	}
+	seq, err := strconv.ParseInt(lastSeq, 10, 64)
+	if err != nil || seq < 0 {
+		return token, -1
 	}
+	return token, seq
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+	// browsers fail the connection unless one of the subprotocols they offered is picked
+	Subprotocols: []string{constant.SocketSubprotocol},
 }
@@ -0,0 +1,21 @@
+package business
+
+import "testing"
+
+func TestMetricsLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "claim given", value: "parent", want: "parent"},
+		{name: "claim missing", value: "", want: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricsLabel(tt.value); got != tt.want {
+				t.Errorf("label = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/store"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// number of queued messages read from the store at a time when flushing the offline queue
+const offlineFlushBatchSize = 100
+
+var messageStore = store.NewMemoryStore()
+
+// SetMessageStore replaces the store of the chat messages
+func SetMessageStore(s store.MessageStore) {
+	messageStore = s
+}
+
+// CloseMessageStore releases the message store
+func CloseMessageStore() error {
+	return messageStore.Close()
+}
+
+// initMessageStore sets up the message store configured in application.yml
+func initMessageStore(ctx context.Context) error {
+	switch storeType := configs.GetAppConfigD(constant.ChatStoreKey, constant.ChatStoreMySQL); storeType {
+	case constant.ChatStoreMemory:
+		SetMessageStore(store.NewMemoryStore())
+	case constant.ChatStoreMySQL:
+		s, err := store.NewMySQLStore(ctx, constant.MySqlserverDB)
+		if err != nil {
+			return err
+		}
+		SetMessageStore(s)
+	default:
+		return fmt.Errorf("unknown chat store %s", storeType)
+	}
+	return nil
+}
+
+// conversationID is the same for both users of a conversation
+func conversationID(a, b string) string {
+	a, b = userKey(a), userKey(b)
+	if a > b {
+		a, b = b, a
+	}
+	return strings.Join([]string{a, b}, ":")
+}
+
+// flushOffline delivers the messages queued while the user was offline to the new connection
+func flushOffline(c *Client) {
+	user := userKey(c.UserID)
+	for {
+		pending, err := messageStore.Pending(c.ctx, user, offlineFlushBatchSize)
+		if err != nil {
+			log.ApplicationError(c.ctx).Err(err).Msg("error reading offline queue")
+			return
+		}
+		if len(pending) == 0 {
+			return
+		}
+		// dequeued messages stay tracked on the connection, and go back to the queue if it closes before the ack
+		delivered := make([]string, 0, len(pending))
+		for _, msg := range pending {
+			// already replayed on resume
+			if c.tracked(msg.ID) {
+				delivered = append(delivered, msg.ID)
+				continue
+			}
+			env, err := NewEnvelope(constant.MessageTypeChatMessage, msg)
+			if err != nil {
+				continue
+			}
+			data, err := json.Marshal(env)
+			if err != nil {
+				continue
+			}
+			if err := c.Send(env.Type, data); err != nil {
+				break
+			}
+			c.track(msg.ID, data)
+			delivered = append(delivered, msg.ID)
+		}
+		if err := messageStore.Dequeue(c.ctx, user, delivered); err != nil {
+			log.ApplicationError(c.ctx).Err(err).Msg("error removing delivered messages from offline queue")
+			return
+		}
+		// the connection went away while flushing, the rest stays queued
+		if len(delivered) < len(pending) {
+			return
+		}
+	}
+}
+
+// handleHistoryFetch serves a page of the conversation of the connected user with another user
+func handleHistoryFetch(mc *MessageContext) error {
+	req := models.HistoryFetch{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	if strings.TrimSpace(req.With) == "" {
+		return NewProtocolError("ABP11004", fmt.Errorf("with is required"))
+	}
+	pageSize := configs.GetAppConfigIntD(constant.ChatHistoryPageSizeKey, 50)
+	if req.Limit <= 0 || req.Limit > pageSize {
+		req.Limit = pageSize
+	}
+
+	conversation := conversationID(mc.Client.UserID, req.With)
+	messages, err := messageStore.History(mc, conversation, req.Before, req.Limit)
+	if err != nil {
+		return err
+	}
+	result := models.HistoryResult{
+		ConversationID: conversation,
+		Messages:       messages,
+	}
+	if result.Messages == nil {
+		result.Messages = []models.ChatMessage{}
+	}
+	if len(messages) == req.Limit {
+		result.NextCursor = messages[len(messages)-1].Cursor
+	}
+	return mc.Reply(constant.MessageTypeHistoryResult, result)
+}
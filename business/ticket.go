@@ -0,0 +1,147 @@
+package business
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const (
+	defaultTicketTTL = 30 * time.Second
+	// headers the browser may send on the ticket request, the token headers read by utils.AuthenticateUser
+	ticketAllowedHeaders = "Authorization, AccessToken, Token, " + constant.DEVICEID + ", " + constant.RequestIDHeader
+	// seconds browsers cache the preflight answer
+	ticketPreflightMaxAge = "600"
+)
+
+func ticketKey(ticket string) string {
+	return cluster.prefix + ":ticket:" + ticket
+}
+
+// TicketEndpoint trades the token of the request headers for a short-lived, single-use connection ticket,
+// for the browsers that cannot set headers on the upgrade request. Tickets are kept on the backplane, so the
+// upgrade can land on any node.
+func TicketEndpoint(w http.ResponseWriter, r *http.Request) {
+	reqStartTime := time.Now()
+	reqID := utils.GetRequestID(r, "ticket")
+
+	// browsers call it cross-origin from the pages of the origin allowlist, the same pages that open the socket
+	if !checkOrigin(r) {
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, "", constant.ErrorCodeMap["ABP11024"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11024"]))
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+		w.Header().Set("Access-Control-Allow-Headers", ticketAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", ticketPreflightMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		utils.JSONErrorResponder(r, w, http.StatusMethodNotAllowed, reqID, "", constant.ErrorCodeMap["ABP11001"], reqStartTime, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	claims, err := utils.AuthenticateUser(r)
+	if err != nil {
+		w.Header().Add("Unauthorized", "true")
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, "", constant.ErrorCodeMap["ABP11008"], reqStartTime, errors.New(constant.ErrorCodeMap["ABP11008"]))
+		return
+	}
+	userID := claims.UserData.UserID
+	device, err := deviceID(r, claims)
+	if err != nil {
+		w.Header().Add("Unauthorized", "true")
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userID, constant.ErrorCodeMap["ABP11022"], reqStartTime, err)
+		return
+	}
+	if revoked(claims.Id, userID, device, claims.IssuedAt) {
+		w.Header().Add("Unauthorized", "true")
+		utils.JSONErrorResponder(r, w, http.StatusForbidden, reqID, userID, constant.ErrorCodeMap["ABP11020"], reqStartTime, errRevoked)
+		return
+	}
+
+	ticket, err := newTicket()
+	if err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusInternalServerError, reqID, userID, constant.ErrorCodeMap["ABP11000"], reqStartTime, err)
+		return
+	}
+	ttl := millis(configs.GetAppConfigIntD(constant.SocketTicketTtlInMillisKey, int(defaultTicketTTL.Milliseconds())))
+	if err := storeTicket(r.Context(), ticket, models.SocketTicket{UserID: userID, DeviceID: device, Claims: claims}, ttl); err != nil {
+		utils.JSONErrorResponder(r, w, http.StatusInternalServerError, reqID, userID, constant.ErrorCodeMap["ABP11000"], reqStartTime, err)
+		return
+	}
+	utils.JSONResponder(r, w, http.StatusOK, reqID, userID, "ticket issued", reqStartTime, models.TicketResponse{
+		Ticket:    ticket,
+		ExpiresIn: int64(ttl.Seconds()),
+	})
+}
+
+func newTicket() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// socketTicket reads the connection ticket of the upgrade request, from the query or the subprotocols
+func socketTicket(r *http.Request) string {
+	if ticket := r.URL.Query().Get(constant.TicketQueryParam); ticket != "" {
+		return ticket
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, constant.TicketSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, constant.TicketSubprotocolPrefix)
+		}
+	}
+	return ""
+}
+
+// storeTicket keeps what the ticket stands for on the backplane for the ttl
+func storeTicket(ctx context.Context, ticket string, t models.SocketTicket, ttl time.Duration) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	stored, err := cluster.backplane.SetNX(ctx, ticketKey(ticket), data, ttl)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return errors.New("ticket already issued")
+	}
+	return nil
+}
+
+// redeemTicket returns what the ticket stands for and invalidates it on every node
+func redeemTicket(ctx context.Context, ticket string) (models.SocketTicket, bool) {
+	data, err := cluster.backplane.GetDel(ctx, ticketKey(ticket))
+	if err != nil {
+		log.ApplicationError(ctx).Err(err).Msg("error redeeming ticket")
+		return models.SocketTicket{}, false
+	}
+	if data == nil {
+		return models.SocketTicket{}, false
+	}
+	t := models.SocketTicket{}
+	if err := json.Unmarshal(data, &t); err != nil || t.Claims == nil {
+		return models.SocketTicket{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,180 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/backplane"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils"
+)
+
+func TestRedeemTicket(t *testing.T) {
+	ticket, err := newTicket()
+	if err != nil {
+		t.Fatalf("new ticket: %v", err)
+	}
+	claims := &models.JWTLoginToken{UserData: models.TokenUserData{UserID: "42"}}
+	if err := storeTicket(context.Background(), ticket, models.SocketTicket{UserID: "42", DeviceID: "phone", Claims: claims}, time.Minute); err != nil {
+		t.Fatalf("store ticket: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		ticket string
+		wantOK bool
+	}{
+		{name: "first use", ticket: ticket, wantOK: true},
+		{name: "used again", ticket: ticket},
+		{name: "unknown ticket", ticket: "bogus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := redeemTicket(context.Background(), tt.ticket)
+			if ok != tt.wantOK {
+				t.Fatalf("redeemed = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (got.UserID != "42" || got.DeviceID != "phone") {
+				t.Errorf("ticket stands for %+v, want user 42 on phone", got)
+			}
+		})
+	}
+}
+
+func TestTicketOtherNode(t *testing.T) {
+	previous := cluster
+	t.Cleanup(func() { cluster = previous })
+	b := backplane.NewMemoryBackplane()
+	t.Cleanup(func() { b.Close() })
+	nodeA, nodeB := newClusterNode(b, "test"), newClusterNode(b, "test")
+	token, err := utils.GenerateJWTAccessToken(models.TokenUserData{UserID: "42"}, "parent")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+
+	// issued on node A
+	cluster = nodeA
+	r := httptest.NewRequest(http.MethodPost, "/socket/ticket", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set(constant.DEVICEID, "browser")
+	w := httptest.NewRecorder()
+	TicketEndpoint(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	ticket := models.TicketResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &models.Response{Response: &ticket}); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	// redeemed on node B, with the claims of the token
+	cluster = nodeB
+	got, ok := redeemTicket(context.Background(), ticket.Ticket)
+	if !ok || got.UserID != "42" || got.DeviceID != "browser" || got.Claims == nil || got.Claims.UserType != "parent" {
+		t.Fatalf("ticket stands for %+v %v, want user 42 on browser", got, ok)
+	}
+	// and gone for every node
+	for _, node := range []*clusterNode{nodeA, nodeB} {
+		cluster = node
+		if _, ok := redeemTicket(context.Background(), ticket.Ticket); ok {
+			t.Error("ticket redeemed twice")
+		}
+	}
+}
+
+func TestSocketTicket(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		protocols string
+		want      string
+	}{
+		{name: "query", query: "?ticket=abc", want: "abc"},
+		{name: "subprotocol", protocols: constant.SocketSubprotocol + ", ticket.abc", want: "abc"},
+		{name: "query first", query: "?ticket=abc", protocols: "ticket.def", want: "abc"},
+		{name: "none", protocols: constant.SocketSubprotocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/socket"+tt.query, nil)
+			if tt.protocols != "" {
+				r.Header.Set("Sec-WebSocket-Protocol", tt.protocols)
+			}
+			if got := socketTicket(r); got != tt.want {
+				t.Errorf("ticket = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTicketEndpoint(t *testing.T) {
+	withOrigins(t, "https://smartpet.com", "https://*.smartpet.com")
+	token, err := utils.GenerateJWTAccessToken(models.TokenUserData{UserID: "42"}, "parent")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		token         string
+		wantStatus    int
+		wantCORS      bool
+		wantPreflight bool
+	}{
+		{name: "preflight", method: http.MethodOptions, origin: "https://app.smartpet.com", wantStatus: http.StatusNoContent,
+			wantCORS: true, wantPreflight: true},
+		{name: "preflight of another site", method: http.MethodOptions, origin: "https://evil.com", wantStatus: http.StatusForbidden},
+		{name: "ticket of another site", method: http.MethodPost, origin: "https://evil.com", token: token, wantStatus: http.StatusForbidden},
+		{name: "wrong method", method: http.MethodGet, origin: "https://smartpet.com", wantStatus: http.StatusMethodNotAllowed, wantCORS: true},
+		{name: "no token", method: http.MethodPost, origin: "https://smartpet.com", wantStatus: http.StatusForbidden, wantCORS: true},
+		{name: "invalid token", method: http.MethodPost, origin: "https://smartpet.com", token: token + "x", wantStatus: http.StatusForbidden,
+			wantCORS: true},
+		{name: "ticket of the allowlist", method: http.MethodPost, origin: "https://smartpet.com", token: token,
+			wantStatus: http.StatusOK, wantCORS: true},
+		{name: "ticket without origin", method: http.MethodPost, token: token, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/socket/ticket", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.Header.Set(constant.DEVICEID, "browser")
+			w := httptest.NewRecorder()
+			TicketEndpoint(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if cors := w.Header().Get("Access-Control-Allow-Origin") == tt.origin && tt.origin != ""; cors != tt.wantCORS {
+				t.Errorf("allowed origin %q, want cors %v", w.Header().Get("Access-Control-Allow-Origin"), tt.wantCORS)
+			}
+			if preflight := strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") &&
+				w.Header().Get("Access-Control-Allow-Methods") == http.MethodPost; preflight != tt.wantPreflight {
+				t.Errorf("preflight headers %v, want %v", w.Header(), tt.wantPreflight)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			ticket := models.TicketResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &models.Response{Response: &ticket}); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			got, ok := redeemTicket(context.Background(), ticket.Ticket)
+			if !ok || got.UserID != "42" || got.DeviceID != "browser" {
+				t.Errorf("ticket stands for %+v %v, want user 42 on browser", got, ok)
+			}
+		})
+	}
+}
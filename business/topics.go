@@ -0,0 +1,273 @@
+package business
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+const (
+	defaultTopicsMaxSubscriptions = 100
+	maxTopicLength                = 200
+)
+
+// segments of topic names, like the ids and names in provider:42:slots
+var topicSegment = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// topicRegistry keeps the topic patterns the connections of this node are subscribed to
+type topicRegistry struct {
+	mu            sync.RWMutex
+	subscribers   map[string]map[*Client]struct{} // pattern to the connections subscribed to it
+	subscriptions map[*Client]map[string]struct{} // connection to the patterns it is subscribed to
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		subscribers:   make(map[string]map[*Client]struct{}),
+		subscriptions: make(map[*Client]map[string]struct{}),
+	}
+}
+
+var topics = newTopicRegistry()
+
+// validTopic checks the topic name, patterns can also have wildcard segments
+func validTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return errors.New("topic is required")
+	}
+	if len(topic) > maxTopicLength {
+		return fmt.Errorf("topic is longer than %d characters", maxTopicLength)
+	}
+	segments := strings.Split(topic, constant.TopicSeparator)
+	for i, segment := range segments {
+		switch {
+		case pattern && segment == constant.TopicWildcard:
+		case pattern && segment == constant.TopicWildcardRest && i == len(segments)-1:
+		case !topicSegment.MatchString(segment):
+			return fmt.Errorf("invalid topic %s", topic)
+		}
+	}
+	return nil
+}
+
+// topicMatches tells if the topic is matched by the pattern
+func topicMatches(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, constant.TopicSeparator)
+	topicSegments := strings.Split(topic, constant.TopicSeparator)
+	for i, segment := range patternSegments {
+		if segment == constant.TopicWildcardRest && i == len(patternSegments)-1 {
+			return len(topicSegments) > i
+		}
+		if i >= len(topicSegments) || (segment != constant.TopicWildcard && segment != topicSegments[i]) {
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
+
+// subscribe adds the patterns to the subscriptions of the connection, within the limit of subscriptions per connection.
+// It returns the patterns nobody on this node was subscribed to before.
+func (r *topicRegistry) subscribe(c *Client, patterns []string, limit int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a connection is closed before it is forgotten, a subscribe racing its unregistration must not outlive it
+	if c.closed() {
+		return nil, ErrClientClosed
+	}
+	subscriptions, ok := r.subscriptions[c]
+	if !ok {
+		subscriptions = make(map[string]struct{})
+	}
+	// a pattern repeated in the request only counts once
+	added := make(map[string]struct{}, len(patterns))
+	for _, pattern := range patterns {
+		if _, ok := subscriptions[pattern]; !ok {
+			added[pattern] = struct{}{}
+		}
+	}
+	if len(subscriptions)+len(added) > limit {
+		return nil, NewProtocolError("ABP11004", errors.New("too many topic subscriptions"))
+	}
+	r.subscriptions[c] = subscriptions
+	var first []string
+	for _, pattern := range patterns {
+		subscriptions[pattern] = struct{}{}
+		if r.subscribers[pattern] == nil {
+			r.subscribers[pattern] = make(map[*Client]struct{})
+			first = append(first, pattern)
+		}
+		r.subscribers[pattern][c] = struct{}{}
+	}
+	return first, nil
+}
+
+// unsubscribe removes the patterns from the subscriptions of the connection.
+// It returns the patterns nobody on this node is subscribed to anymore.
+func (r *topicRegistry) unsubscribe(c *Client, patterns []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last []string
+	for _, pattern := range patterns {
+		if r.unsubscribeLocked(c, pattern) {
+			last = append(last, pattern)
+		}
+	}
+	return last
+}
+
+func (r *topicRegistry) unsubscribeLocked(c *Client, pattern string) bool {
+	if _, ok := r.subscriptions[c][pattern]; !ok {
+		return false
+	}
+	delete(r.subscriptions[c], pattern)
+	if len(r.subscriptions[c]) == 0 {
+		delete(r.subscriptions, c)
+	}
+	delete(r.subscribers[pattern], c)
+	if len(r.subscribers[pattern]) > 0 {
+		return false
+	}
+	delete(r.subscribers, pattern)
+	return true
+}
+
+// forget drops every subscription of the closed connection and returns the patterns nobody on this node is subscribed to anymore
+func (r *topicRegistry) forget(c *Client) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last []string
+	for pattern := range r.subscriptions[c] {
+		if r.unsubscribeLocked(c, pattern) {
+			last = append(last, pattern)
+		}
+	}
+	return last
+}
+
+// subscribed tells if a connection of this node is subscribed to the pattern
+func (r *topicRegistry) subscribed(pattern string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.subscribers[pattern]) > 0
+}
+
+// patterns returns the patterns the connection is subscribed to, or every pattern of this node when c is nil
+func (r *topicRegistry) patterns(c *Client) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var patterns []string
+	if c == nil {
+		for pattern := range r.subscribers {
+			patterns = append(patterns, pattern)
+		}
+	} else {
+		for pattern := range r.subscriptions[c] {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// matching returns the connections of this node subscribed to the topic, once each even when several of their patterns match
+func (r *topicRegistry) matching(topic string) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[*Client]struct{})
+	var clients []*Client
+	for pattern, subscribers := range r.subscribers {
+		if !topicMatches(pattern, topic) {
+			continue
+		}
+		for c := range subscribers {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				clients = append(clients, c)
+			}
+		}
+	}
+	return clients
+}
+
+// PublishToTopic sends the message to the subscribers of the topic on every node.
+// It returns the number of connections of this node it was queued on plus the number of other nodes it was forwarded to.
+func (h *Hub) PublishToTopic(topic string, env *models.Envelope) int {
+	connections, nodes := h.deliverToTopic(topic, env)
+	return connections + nodes
+}
+
+// deliverToTopic is PublishToTopic returning apart the connections of this node and the other nodes
+func (h *Hub) deliverToTopic(topic string, env *models.Envelope) (int, int) {
+	env.Topic = topic
+	data, err := json.Marshal(env)
+	if err != nil {
+		return 0, 0
+	}
+	return send(topics.matching(topic), env.Type, data), cluster.forwardTopic(topic, env.Type, data)
+}
+
+// handleSubscribe subscribes the connection to topics, wildcard patterns included, and replies with all of its subscriptions
+func handleSubscribe(mc *MessageContext) error {
+	req := models.Subscribe{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.Topics) == 0 {
+		return NewProtocolError("ABP11004", errors.New("topics are required"))
+	}
+	for _, topic := range req.Topics {
+		if err := validTopic(topic, true); err != nil {
+			return NewProtocolError("ABP11004", err)
+		}
+		if err := authz.authorizeTopic(mc, mc.Client, constant.AuthzActionSubscribe, topic); err != nil {
+			return err
+		}
+	}
+	limit := configs.GetAppConfigIntD(constant.TopicsMaxSubscriptionsKey, defaultTopicsMaxSubscriptions)
+	first, err := topics.subscribe(mc.Client, req.Topics, limit)
+	if err != nil {
+		return err
+	}
+	cluster.announceTopics(first, topics.subscribed)
+	return mc.Reply(constant.MessageTypeSubscribed, models.Subscribed{Topics: topics.patterns(mc.Client)})
+}
+
+// handleUnsubscribe unsubscribes the connection from topics and replies with the subscriptions left
+func handleUnsubscribe(mc *MessageContext) error {
+	req := models.Subscribe{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	cluster.announceTopics(topics.unsubscribe(mc.Client, req.Topics), topics.subscribed)
+	return mc.Reply(constant.MessageTypeSubscribed, models.Subscribed{Topics: topics.patterns(mc.Client)})
+}
+
+// handlePublish sends the payload to the subscribers of the topic, connections may only publish to the
+// topics the authorization policy lets them
+func handlePublish(mc *MessageContext) error {
+	req := models.Publish{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	if err := validTopic(req.Topic, false); err != nil {
+		return NewProtocolError("ABP11004", err)
+	}
+	if err := authz.authorizeTopic(mc, mc.Client, constant.AuthzActionPublish, req.Topic); err != nil {
+		return err
+	}
+	env, err := NewEnvelope(constant.MessageTypeTopicMessage, nil)
+	if err != nil {
+		return err
+	}
+	env.Payload, env.Actor = req.Payload, mc.Client.Actor
+	hub.PublishToTopic(req.Topic, env)
+	return nil
+}
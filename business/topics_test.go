@@ -0,0 +1,154 @@
+package business
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic   string
+		pattern bool
+		valid   bool
+	}{
+		{topic: "provider:42:slots", valid: true},
+		{topic: "user.mail@example-1_a", valid: true},
+		{topic: ""},
+		{topic: strings.Repeat("a", maxTopicLength+1)},
+		{topic: "provider::slots"},
+		{topic: "provider:4 2"},
+		{topic: "provider:*:slots"},
+		{topic: "provider:*:slots", pattern: true, valid: true},
+		{topic: "provider:#", pattern: true, valid: true},
+		{topic: "provider:#:slots", pattern: true},
+		{topic: "provider:4*", pattern: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			if err := validTopic(tt.topic, tt.pattern); (err == nil) != tt.valid {
+				t.Errorf("err = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{pattern: "provider:42:slots", topic: "provider:42:slots", want: true},
+		{pattern: "provider:42:slots", topic: "provider:43:slots"},
+		{pattern: "provider:*:slots", topic: "provider:42:slots", want: true},
+		{pattern: "provider:*:slots", topic: "provider:42:news"},
+		{pattern: "provider:*", topic: "provider:42:slots"},
+		{pattern: "provider:#", topic: "provider:42:slots", want: true},
+		{pattern: "provider:#", topic: "provider:42", want: true},
+		{pattern: "provider:#", topic: "provider"},
+		{pattern: "provider:42:slots", topic: "provider:42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.topic, func(t *testing.T) {
+			if got := topicMatches(tt.pattern, tt.topic); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicSubscribe(t *testing.T) {
+	tests := []struct {
+		name      string
+		batches   [][]string
+		wantErr   []bool
+		wantFirst []string // patterns new to the node, over every batch
+		want      []string
+	}{
+		{name: "within the limit", batches: [][]string{{"a", "b"}, {"c"}}, wantErr: []bool{false, false},
+			wantFirst: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{name: "over the limit", batches: [][]string{{"a", "b"}, {"c", "d"}}, wantErr: []bool{false, true},
+			wantFirst: []string{"a", "b"}, want: []string{"a", "b"}},
+		{name: "repeated pattern counted once", batches: [][]string{{"a", "a", "b", "b", "c"}}, wantErr: []bool{false},
+			wantFirst: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{name: "subscribed pattern not counted again", batches: [][]string{{"a", "b", "c"}, {"c", "a"}}, wantErr: []bool{false, false},
+			wantFirst: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{name: "pattern of another connection", batches: [][]string{{"shared", "a"}}, wantErr: []bool{false},
+			wantFirst: []string{"a"}, want: []string{"a", "shared"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTopicRegistry()
+			other := newTestClient("2", "parent")
+			if _, err := r.subscribe(other, []string{"shared"}, 3); err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+			c := newTestClient("1", "parent")
+			var first []string
+			for i, patterns := range tt.batches {
+				added, err := r.subscribe(c, patterns, 3)
+				if (err != nil) != tt.wantErr[i] {
+					t.Errorf("subscribe %v: err = %v, want error %v", patterns, err, tt.wantErr[i])
+				}
+				first = append(first, added...)
+			}
+			if strings.Join(first, ",") != strings.Join(tt.wantFirst, ",") {
+				t.Errorf("first subscribed %v, want %v", first, tt.wantFirst)
+			}
+			if got := r.patterns(c); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("patterns = %v, want %v", got, tt.want)
+			}
+			// the shared pattern stays with the other connection
+			last := r.forget(c)
+			if strings.Contains(strings.Join(last, ","), "shared") || len(r.patterns(nil)) != 1 {
+				t.Errorf("forget dropped %v, left %v", last, r.patterns(nil))
+			}
+		})
+	}
+}
+
+func TestTopicMatching(t *testing.T) {
+	r := newTopicRegistry()
+	both := newTestClient("1", "parent")
+	one := newTestClient("2", "parent")
+	r.subscribe(both, []string{"provider:*:slots", "provider:#"}, 10)
+	r.subscribe(one, []string{"provider:42:slots"}, 10)
+
+	tests := []struct {
+		topic string
+		want  int
+	}{
+		{topic: "provider:42:slots", want: 2},
+		{topic: "provider:43:slots", want: 1},
+		{topic: "provider:42:news", want: 1},
+		{topic: "booking:1", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			if got := len(r.matching(tt.topic)); got != tt.want {
+				t.Errorf("matching %d connections, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeClosed(t *testing.T) {
+	c := newTestClient("1", "parent")
+	withSocket(t, c)
+	c.Close()
+
+	r := newTopicRegistry()
+	if _, err := r.subscribe(c, []string{"a"}, 3); err != ErrClientClosed {
+		t.Errorf("topic subscribe err = %v, want %v", err, ErrClientClosed)
+	}
+	if got := r.patterns(c); len(got) != 0 {
+		t.Errorf("closed connection subscribed to %v", got)
+	}
+	p := newPresenceTracker(NewHub())
+	if err := p.watch(c, []string{"2"}, 3); err != ErrClientClosed {
+		t.Errorf("presence watch err = %v, want %v", err, ErrClientClosed)
+	}
+	if _, ok := p.watching[c]; ok {
+		t.Error("closed connection kept by the presence tracker")
+	}
+}
@@ -0,0 +1,68 @@
+package business
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+const defaultTypingMinInterval = time.Second
+
+// allowTyping rate limits the typing events of the connection per recipient and event type. Entries older than
+// the interval no longer limit anything and are dropped, so the map only holds the recipients typed to lately.
+func (c *Client) allowTyping(key string, now time.Time) bool {
+	minInterval := millis(configs.GetAppConfigIntD(constant.TypingMinIntervalInMillisKey, int(defaultTypingMinInterval.Milliseconds())))
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+	if last, ok := c.lastTyping[key]; ok && now.Sub(last) < minInterval {
+		return false
+	}
+	for k, last := range c.lastTyping {
+		if now.Sub(last) >= minInterval {
+			delete(c.lastTyping, k)
+		}
+	}
+	c.lastTyping[key] = now
+	return true
+}
+
+// handleTyping forwards typing.start and typing.stop to the devices of the recipient, these are never stored
+func handleTyping(mc *MessageContext) error {
+	req := models.Typing{}
+	if err := mc.Bind(&req); err != nil {
+		return err
+	}
+	req.To = strings.TrimSpace(req.To)
+	if req.To == "" {
+		return NewProtocolError("ABP11004", errors.New("to is required"))
+	}
+	// dropped silently, a client hammering the key should not get an error per keystroke
+	if !mc.Client.allowTyping(mc.Message.Type+":"+userKey(req.To), time.Now()) {
+		return nil
+	}
+	allowed, err := chatPolicy.CanChat(mc, mc.Client.UserID, req.To)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return NewProtocolError("ABP11012", nil)
+	}
+
+	// typing is transient, it is neither sequenced nor replayed
+	env, err := NewEnvelope(mc.Message.Type, models.Typing{From: mc.Client.UserID})
+	if err != nil {
+		return err
+	}
+	env.Actor = mc.Client.Actor
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	hub.SendToUser(req.To, env.Type, data)
+	return nil
+}
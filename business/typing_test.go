@@ -0,0 +1,64 @@
+package business
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientAllowTyping(t *testing.T) {
+	type event struct {
+		key   string
+		after time.Duration // since the first event
+		want  bool
+	}
+	tests := []struct {
+		name   string
+		events []event
+	}{
+		{name: "second event within the interval dropped", events: []event{
+			{key: "typing.start:2", want: true},
+			{key: "typing.start:2", after: 500 * time.Millisecond},
+		}},
+		{name: "event after the interval", events: []event{
+			{key: "typing.start:2", want: true},
+			{key: "typing.start:2", after: time.Second, want: true},
+		}},
+		{name: "dropped events do not extend the interval", events: []event{
+			{key: "typing.start:2", want: true},
+			{key: "typing.start:2", after: 900 * time.Millisecond},
+			{key: "typing.start:2", after: 1100 * time.Millisecond, want: true},
+		}},
+		{name: "other recipient", events: []event{
+			{key: "typing.start:2", want: true},
+			{key: "typing.start:3", want: true},
+		}},
+		{name: "stop right after start", events: []event{
+			{key: "typing.start:2", want: true},
+			{key: "typing.stop:2", after: 100 * time.Millisecond, want: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient("1", "parent")
+			start := time.Now()
+			for i, e := range tt.events {
+				if got := c.allowTyping(e.key, start.Add(e.after)); got != e.want {
+					t.Errorf("event %d %s: allowed = %v, want %v", i, e.key, got, e.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientTypingPruned(t *testing.T) {
+	c := newTestClient("1", "parent")
+	start := time.Now()
+	for _, key := range []string{"typing.start:2", "typing.start:3", "typing.stop:3"} {
+		c.allowTyping(key, start)
+	}
+	c.allowTyping("typing.start:4", start.Add(500*time.Millisecond))
+	c.allowTyping("typing.start:5", start.Add(time.Second))
+	if len(c.lastTyping) != 2 {
+		t.Errorf("kept %v, want the recipients of the last interval only", c.lastTyping)
+	}
+}
@@ -33,6 +33,7 @@ const (
 	DMATSqlserver201          = "dmatsqlserver201"
 	DMATSqlserver202          = "dmatsqlserver202"
 	MySqlserverDB             = "mysqlserver"
+	RedisserverDB             = "redisserver"
 	PgserverDB                = "postgres"
 	DatabaseServerConfigKey   = "server"
 	DatabaseUsernameConfigKey = "username"
@@ -58,4 +59,36 @@ const (
 	PortfolioService = "portfolio"
 	CNSService       = "sns"
 	CheckTPin        = "checkedis"
+	BookingService   = "booking"
+)
+
+// JWKS config keys in application.yml, for the keys verifying asymmetrically signed user tokens
+const (
+	JWKSSourceKey                  = "jwks.source"
+	JWKSRefreshIntervalInMillisKey = "jwks.refreshIntervalInMillis"
+	JWKSTimeoutInMillisKey         = "jwks.timeoutInMillis"
+	JWKSAllowInsecureKey           = "jwks.allowInsecure"
+)
+
+// InternalPortKey is the application.yml port of the internal listener, serving the routes of the other backend services
+const InternalPortKey = "internal.port"
+
+// TLS config keys in application.yml, for the optional TLS listener
+const (
+	TLSPortKey                   = "tls.port"
+	TLSCertFileKey               = "tls.certFile"
+	TLSKeyFileKey                = "tls.keyFile"
+	TLSClientCAFileKey           = "tls.clientCAFile"
+	TLSMinVersionKey             = "tls.minVersion"
+	TLSCipherPolicyKey           = "tls.cipherPolicy"
+	TLSReloadIntervalInMillisKey = "tls.reloadIntervalInMillis"
+)
+
+// MetricsBucketsKey is the application.yml key of the histogram buckets of the metrics
+const MetricsBucketsKey = "metrics.buckets"
+
+// Cipher policies of the TLS listener
+const (
+	TLSCipherPolicyModern     = "modern"
+	TLSCipherPolicyCompatible = "compatible"
 )
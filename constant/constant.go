@@ -36,9 +36,16 @@ const (
 	SMSSvcRetry       = 2
 	SMSSvcWaitTime    = 1 * time.Second
 	SMSSvcWaitTimeMax = 2 * time.Second
+
+	BookingSvcRetry       = 1
+	BookingSvcWaitTime    = 200 * time.Millisecond
+	BookingSvcWaitTimeMax = 500 * time.Millisecond
 )
 
 const (
 	USERID      = "userid"
+	DEVICEID    = "deviceid"
 	ACCESSTOKEN = "AccessToken"
+
+	IdempotencyKeyHeader = "Idempotency-Key"
 )
@@ -10,6 +10,22 @@ var ErrorCodeMap = map[string]string{
 	"ABP11006": "Failed to set the otp to inactive ",
 	"ABP11007": "failed to insert the generated otp to db ",
 	"ABP11008": "Invalid Session ID",
+	"ABP11009": "Malformed message",
+	"ABP11010": "Unknown message type",
+	"ABP11011": "Server is shutting down",
+	"ABP11012": "Not allowed to message this user",
+	"ABP11013": "Invalid service token",
+	"ABP11014": "Request with this idempotency key is in progress",
+	"ABP11015": "Not allowed to use this topic",
+	"ABP11016": "Not allowed to send this message type",
+	"ABP11017": "Invalid or expired connection ticket",
+	"ABP11018": "Invalid token",
+	"ABP11019": "Token belongs to another user",
+	"ABP11020": "Access revoked",
+	"ABP11021": "Token acts as another actor",
+	"ABP11022": "Device does not match the token",
+	"ABP11023": "Too many connections",
+	"ABP11024": "Origin not allowed",
 }
 
 var SMSErrorCodeMap = map[string]string{
@@ -41,6 +41,7 @@ const (
 	ClientIDLogParam    = "clientID"
 	ActionLogParam      = "action"
 	S2SIssuerLogParam   = "s2sIssuer"
+	ActorLogParam       = "actor"
 )
 
 // Other additional Log Params
@@ -55,4 +56,6 @@ const (
 	MessageLogParam    = "message"
 	DetailsLogParam    = "details"
 	TraceLogParam      = "trace"
+	ConnectionLogParam = "connectionID"
+	DeviceLogParam     = "deviceID"
 )
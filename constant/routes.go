@@ -17,3 +17,12 @@ const (
 	ProviderSessionsDetails = "/register/provider/addsessiondetails"
 	ProviderGetProfile      = "/register/provider/getprofile"
 )
+
+// Routes of the socket service
+const (
+	SocketRoute       = "/ws"
+	SocketTicketRoute = "/ws/ticket"
+	InternalPushRoute = "/internal/push"
+	AdminRevokeRoute  = "/admin/revoke"
+	MetricsRoute      = "/metrics"
+)
@@ -0,0 +1,348 @@
+package constant
+
+// Socket message types
+const (
+	MessageTypeError = "error"
+	MessageTypePing  = "ping"
+	MessageTypePong  = "pong"
+
+	MessageTypeGoingAway = "server.going_away"
+
+	MessageTypeSessionWelcome = "session.welcome"
+	MessageTypeSessionResync  = "session.resync"
+
+	MessageTypeAuthExpiring  = "auth.expiring"
+	MessageTypeAuthRefresh   = "auth.refresh"
+	MessageTypeAuthRefreshed = "auth.refreshed"
+
+	MessageTypeChatSend    = "chat.send"
+	MessageTypeChatSent    = "chat.sent"
+	MessageTypeChatMessage = "chat.message"
+
+	MessageTypeHistoryFetch  = "history.fetch"
+	MessageTypeHistoryResult = "history.result"
+
+	MessageTypeAck     = "ack"
+	MessageTypeReceipt = "receipt"
+
+	MessageTypePresenceSet         = "presence.set"
+	MessageTypePresenceSubscribe   = "presence.subscribe"
+	MessageTypePresenceUnsubscribe = "presence.unsubscribe"
+	MessageTypePresenceState       = "presence.state"
+	MessageTypePresenceUpdate      = "presence.update"
+
+	MessageTypeTypingStart = "typing.start"
+	MessageTypeTypingStop  = "typing.stop"
+
+	MessageTypeSubscribe    = "subscribe"
+	MessageTypeUnsubscribe  = "unsubscribe"
+	MessageTypeSubscribed   = "subscribed"
+	MessageTypePublish      = "publish"
+	MessageTypeTopicMessage = "topic.message"
+)
+
+// Presence of a user, aggregated over all of its devices
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Delivery status of a chat message for its recipient, a status only ever moves forward in this order
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// Socket config keys in application.yml
+const (
+	SocketSendQueueSizeKey         = "socket.sendQueueSize"
+	SocketOverflowPolicyKey        = "socket.overflowPolicy"
+	SocketWriteWaitInMillisKey     = "socket.writeWaitInMillis"
+	SocketPingPeriodInMillisKey    = "socket.pingPeriodInMillis"
+	SocketPongWaitInMillisKey      = "socket.pongWaitInMillis"
+	SocketMaxMessageSizeInBytesKey = "socket.maxMessageSizeInBytes"
+	SocketIdleTimeoutInMillisKey   = "socket.idleTimeoutInMillis"
+	SocketReapIntervalInMillisKey  = "socket.reapIntervalInMillis"
+
+	SocketShutdownTimeoutInMillisKey      = "socket.shutdownTimeoutInMillis"
+	SocketShutdownHooksTimeoutInMillisKey = "socket.shutdownHooksTimeoutInMillis"
+	SocketReconnectDelayInMillisKey       = "socket.reconnectDelayInMillis"
+	SocketReconnectJitterInMillisKey      = "socket.reconnectJitterInMillis"
+
+	SocketReplayBufferSizeKey  = "socket.replayBufferSize"
+	SocketResumeTtlInMillisKey = "socket.resumeTtlInMillis"
+
+	SocketTicketTtlInMillisKey = "socket.ticketTtlInMillis"
+
+	SocketMaxConnectionsPerUserKey   = "socket.maxConnectionsPerUser"
+	SocketMaxConnectionsPerDeviceKey = "socket.maxConnectionsPerDevice"
+	SocketConnectionLimitPolicyKey   = "socket.connectionLimitPolicy"
+)
+
+// Browsers cannot set headers on the upgrade request, they authenticate with a connection ticket instead,
+// passed in TicketQueryParam or as a TicketSubprotocolPrefix subprotocol next to SocketSubprotocol
+const (
+	TicketQueryParam        = "ticket"
+	TicketSubprotocolPrefix = "ticket."
+	SocketSubprotocol       = "smartpet.socket.v1"
+)
+
+// Query params of the socket endpoint used to resume a session
+const (
+	ResumeQueryParam  = "resume"
+	LastSeqQueryParam = "last_seq"
+)
+
+// Reasons sent with session.resync
+const (
+	ResyncUnknownSession = "unknown_session"
+	ResyncOtherNode      = "other_node" // the session lives on the node that issued the resume token
+	ResyncGapTooLarge    = "gap_too_large"
+	ResyncInvalidSeq     = "invalid_seq"
+)
+
+// Chat config keys in application.yml
+const (
+	ChatPolicyKey                     = "chat.policy"
+	ChatRelationshipCacheInSecondsKey = "chat.relationshipCacheInSeconds"
+	ChatMaxTextLengthKey              = "chat.maxTextLength"
+	ChatStoreKey                      = "chat.store"
+	ChatHistoryPageSizeKey            = "chat.historyPageSize"
+	ChatAckTimeoutInMillisKey         = "chat.ackTimeoutInMillis"
+	ChatMaxRetransmitsKey             = "chat.maxRetransmits"
+)
+
+// AuthExpiryWarningInMillisKey is the application.yml key of how long before its token expires a connection is warned
+const AuthExpiryWarningInMillisKey = "auth.expiryWarningInMillis"
+
+// ImpersonationScopesKey is the application.yml key of the scopes letting a token act as another user, one is enough
+const ImpersonationScopesKey = "impersonation.scopes"
+
+// Revocation config keys in application.yml
+const (
+	RevocationTtlInSecondsKey = "revocation.ttlInSeconds"
+)
+
+// Topic config keys in application.yml
+const (
+	TopicsMaxSubscriptionsKey = "topics.maxSubscriptions"
+)
+
+// AuthorizationPolicyKey is the application.yml key of the policy of the message types and topics users may use
+const AuthorizationPolicyKey = "authorization"
+
+// Actions of the authorization policy, sending a message type and using a topic, and its default actions
+const (
+	AuthzActionSend      = "send"
+	AuthzActionSubscribe = "subscribe"
+	AuthzActionPublish   = "publish"
+	AuthzAllow           = "allow"
+	AuthzDeny            = "deny"
+	// placeholder of the connected user id in the topic patterns of the policy
+	AuthzUserIDPlaceholder = "{user_id}"
+)
+
+// Types of the users in the tokens
+const (
+	UserTypeParent   = "parent"
+	UserTypeProvider = "provider"
+	UserTypeAdmin    = "admin"
+)
+
+// Topic names are segments separated by TopicSeparator, in subscriptions TopicWildcard matches any one segment
+// and TopicWildcardRest, as the last segment, one or more segments
+const (
+	TopicSeparator    = ":"
+	TopicWildcard     = "*"
+	TopicWildcardRest = "#"
+)
+
+// Presence and typing config keys in application.yml
+const (
+	PresenceMaxSubscriptionsKey  = "presence.maxSubscriptions"
+	TypingMinIntervalInMillisKey = "typing.minIntervalInMillis"
+)
+
+// Cluster config keys in application.yml
+const (
+	ClusterBackplaneKey                 = "cluster.backplane"
+	ClusterChannelPrefixKey             = "cluster.channelPrefix"
+	ClusterHeartbeatIntervalInMillisKey = "cluster.heartbeatIntervalInMillis"
+)
+
+// Backplanes carrying messages between the nodes
+const (
+	BackplaneRedis  = "redis"
+	BackplaneMemory = "memory"
+)
+
+// Kinds of the messages exchanged between the nodes over the backplane
+const (
+	ClusterKindHello       = "hello"       // a node started and wants the state of the others
+	ClusterKindState       = "state"       // presence of every user connected to the node, its topic patterns and revocations, in reply to hello and sync
+	ClusterKindSync        = "sync"        // a node missed changes of the state of another and wants it again
+	ClusterKindHeartbeat   = "heartbeat"   // the node is alive, with the version of its state
+	ClusterKindBye         = "bye"         // the node is shutting down
+	ClusterKindPresence    = "presence"    // presence of a user on the node changed
+	ClusterKindUser        = "user"        // frame for the connections of a user
+	ClusterKindEvent       = "event"       // event to sequence and send to the connections of a user
+	ClusterKindChat        = "chat"        // chat message to deliver to the connections of its recipient
+	ClusterKindDevice      = "device"      // frame for the connections of a device of a user
+	ClusterKindBroadcast   = "broadcast"   // frame for every connection
+	ClusterKindSubscribe   = "subscribe"   // the node has subscribers for a topic pattern
+	ClusterKindUnsubscribe = "unsubscribe" // the node has no subscribers left for a topic pattern
+	ClusterKindTopic       = "topic"       // frame for the subscribers of a topic
+	ClusterKindRevoke      = "revoke"      // a token, device or user was revoked
+)
+
+// Event bridge config keys in application.yml
+const (
+	EventsBrokerKey          = "events.broker"
+	EventsConsumerKey        = "events.consumer"
+	EventsDeadLetterTopicKey = "events.deadLetterTopic"
+	EventsOfflineTopicKey    = "events.offlineTopic"
+	EventsTypeFieldKey       = "events.typeField"
+	EventsPayloadFieldKey    = "events.payloadField"
+	EventsRoutesKey          = "events.routes"
+)
+
+// Brokers the domain events are read from
+const (
+	EventBrokerKafka  = "kafka"
+	EventBrokerMemory = "memory"
+)
+
+// Targets of the events of the bridge, the label of the undelivered events metric
+const (
+	BridgeTargetUser  = "user"
+	BridgeTargetTopic = "topic"
+)
+
+// Headers added to the events written to the dead letter and offline topics
+const (
+	OriginalTopicHeader     = "original_topic"
+	OriginalPartitionHeader = "original_partition"
+	OriginalOffsetHeader    = "original_offset"
+	// why the event written to the dead letter topic cannot be routed
+	DeadLetterReasonHeader = "dead_letter_reason"
+	// comma separated users the event written to the offline topic did not reach
+	OfflineUsersHeader = "offline_users"
+)
+
+// Activity config keys in application.yml
+const (
+	ActivityProducerKey              = "activity.producer"
+	ActivityTopicKey                 = "activity.topic"
+	ActivityKafkaKey                 = "activity.kafka"
+	ActivityQueueSizeKey             = "activity.queueSize"
+	ActivityBatchSizeKey             = "activity.batchSize"
+	ActivityLingerInMillisKey        = "activity.lingerInMillis"
+	ActivityBufferDirKey             = "activity.bufferDir"
+	ActivityBufferMaxBytesKey        = "activity.bufferMaxBytes"
+	ActivityRetryIntervalInMillisKey = "activity.retryIntervalInMillis"
+)
+
+// Producers the socket activity is published with
+const (
+	ActivityProducerKafka  = "kafka"
+	ActivityProducerMemory = "memory"
+	ActivityProducerNone   = "none"
+)
+
+// Types of the socket activity events
+const (
+	ActivityConnectionOpened = "connection.opened"
+	ActivityConnectionClosed = "connection.closed"
+	ActivityMessageSent      = "message.sent"
+	ActivityMessageDelivered = "message.delivered"
+	ActivityMessageRead      = "message.read"
+	ActivityPresenceChanged  = "presence.changed"
+)
+
+// Internal push api config keys in application.yml
+const (
+	PushAudienceKey                = "push.audience"
+	PushAllowedIssuersKey          = "push.allowedIssuers"
+	PushMaxTargetsKey              = "push.maxTargets"
+	PushIdempotencyTtlInSecondsKey = "push.idempotencyTtlInSeconds"
+	PushMaxBodyBytesKey            = "push.maxBodyBytes"
+	PushMTLSModeKey                = "push.mtls.mode"
+	PushMTLSIdentitiesKey          = "push.mtls.identities"
+)
+
+// Client certificate modes of the internal push api
+const (
+	MTLSOff      = "off"
+	MTLSOptional = "optional" // certificates sent are checked, calls without one are still accepted
+	MTLSRequired = "required"
+)
+
+// Outcome of a push for one of its targets
+const (
+	PushDelivered       = "delivered"         // queued on at least one connection of the node handling the push
+	PushForwarded       = "forwarded"         // only published to other nodes, which deliver it without reporting back
+	PushQueuedForResume = "queued_for_resume" // kept in memory by the resume session of the user on this node, lost if it restarts
+	PushDroppedOffline  = "dropped_offline"   // the user is neither connected nor has a session to resume, pushes are not stored
+	PushNotConnected    = "not_connected"     // the device is not connected, device pushes are not queued
+	PushNoSubscribers   = "no_subscribers"    // nobody is subscribed to the topic
+	PushNoConnections   = "no_connections"    // nobody is connected to this node and no other node was reached
+)
+
+// Chat policies deciding who may message whom
+const (
+	ChatPolicyBooking = "booking"
+	ChatPolicyOpen    = "open"
+)
+
+// Message stores
+const (
+	ChatStoreMySQL  = "mysql"
+	ChatStoreMemory = "memory"
+)
+
+// Overflow policies applied when the send queue of a connection is full
+const (
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+	OverflowDisconnect = "disconnect"
+)
+
+// Results of the socket upgrade requests, the label of the upgrades metric
+const (
+	UpgradeAccepted       = "accepted"
+	UpgradeBadRequest     = "bad_request"
+	UpgradeOriginRejected = "origin_rejected"
+	UpgradeInvalidTicket  = "invalid_ticket"
+	UpgradeUnauthorized   = "unauthorized"
+	UpgradeDeviceMismatch = "device_mismatch"
+	UpgradeRevoked        = "revoked"
+	UpgradeDraining       = "draining"
+	UpgradeLimited        = "limited"
+	UpgradeFailed         = "failed"
+)
+
+// Labels of the socket message metrics
+const (
+	MetricsDirectionIn  = "in"
+	MetricsDirectionOut = "out"
+	MetricsSideServer   = "server"
+	MetricsSideClient   = "client"
+	// message types of frames that could not be read, or that no handler knows, so clients cannot add label values
+	MetricsTypeInvalid = "invalid"
+	MetricsTypeUnknown = "unknown"
+	MetricsTypeOther   = "other"
+)
+
+// Reasons of the socket upgrades refused by the origin allowlist, the label of the rejected origins metric
+const (
+	OriginNotAllowed = "not_allowed"
+	OriginMalformed  = "malformed"
+)
+
+// Policies applied when a new connection would go over the connection limits of its user or device
+const (
+	ConnectionLimitRejectNew   = "reject_new"
+	ConnectionLimitEvictOldest = "evict_oldest"
+)
@@ -0,0 +1,34 @@
+package events
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned once the consumer or publisher is closed
+var ErrClosed = errors.New("closed")
+
+// Message is a record read from or written to a topic
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// Consumer reads the messages of the topics it subscribed to as a member of its consumer group
+type Consumer interface {
+	// Fetch blocks until the next message is available
+	Fetch(ctx context.Context) (*Message, error)
+	// Commit marks the message and every earlier message of its partition as processed
+	Commit(ctx context.Context, msg *Message) error
+	Close() error
+}
+
+// Publisher writes messages to topics
+type Publisher interface {
+	Publish(ctx context.Context, msgs ...Message) error
+	Close() error
+}
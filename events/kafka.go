@@ -0,0 +1,169 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/compress"
+	"github.com/segmentio/kafka-go/compress/gzip"
+	"github.com/segmentio/kafka-go/compress/zstd"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+// consumer strategies of models.KafkaConsumerConfig
+const (
+	StrategyRange      = "range"
+	StrategyRoundRobin = "roundrobin"
+)
+
+type kafkaConsumer struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaConsumer is used to create a consumer group member reading the topics of the config
+func NewKafkaConsumer(cfg models.KafkaConsumerConfig) (Consumer, error) {
+	servers := expandServers(cfg.Servers)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers in kafka consumer config %s", cfg.Name)
+	}
+	if len(cfg.Topics) == 0 {
+		return nil, fmt.Errorf("no topics in kafka consumer config %s", cfg.Name)
+	}
+	if cfg.ConsumerGroup == "" {
+		return nil, fmt.Errorf("no consumer group in kafka consumer config %s", cfg.Name)
+	}
+	var balancer kafka.GroupBalancer
+	switch cfg.ConsumerStrategy {
+	case "", StrategyRange:
+		balancer = kafka.RangeGroupBalancer{}
+	case StrategyRoundRobin:
+		balancer = kafka.RoundRobinGroupBalancer{}
+	default:
+		return nil, fmt.Errorf("unknown consumer strategy %s", cfg.ConsumerStrategy)
+	}
+	readerConfig := kafka.ReaderConfig{
+		Brokers:        servers,
+		GroupID:        cfg.ConsumerGroup,
+		GroupTopics:    cfg.Topics,
+		GroupBalancers: []kafka.GroupBalancer{balancer},
+		StartOffset:    kafka.FirstOffset,
+	}
+	if cfg.ChannelBufferSize > 0 {
+		readerConfig.QueueCapacity = cfg.ChannelBufferSize
+	}
+	return &kafkaConsumer{reader: kafka.NewReader(readerConfig)}, nil
+}
+
+func (c *kafkaConsumer) Fetch(ctx context.Context) (*Message, error) {
+	m, err := c.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Headers:   make(map[string]string, len(m.Headers)),
+	}
+	for _, h := range m.Headers {
+		msg.Headers[h.Key] = string(h.Value)
+	}
+	return msg, nil
+}
+
+func (c *kafkaConsumer) Commit(ctx context.Context, msg *Message) error {
+	return c.reader.CommitMessages(ctx, kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+}
+
+func (c *kafkaConsumer) Close() error {
+	return c.reader.Close()
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher is used to create a publisher writing synchronously to the servers
+func NewKafkaPublisher(servers []string) (Publisher, error) {
+	servers = expandServers(servers)
+	if len(servers) == 0 {
+		return nil, errors.New("no kafka servers to publish to")
+	}
+	return &kafkaPublisher{writer: newKafkaWriter(servers)}, nil
+}
+
+// NewKafkaProducerPublisher is used to create a publisher for the producer config, with its compression
+func NewKafkaProducerPublisher(cfg models.KafkaProducerConfig) (Publisher, error) {
+	servers := cfg.ServerList
+	if len(servers) == 0 && cfg.Servers != "" {
+		servers = strings.Split(cfg.Servers, ",")
+	}
+	servers = expandServers(servers)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers in kafka producer config %s", cfg.Name)
+	}
+	compression := kafka.Compression(cfg.Compression)
+	if compression.Codec() == nil && compression != 0 {
+		return nil, fmt.Errorf("unknown compression %d in kafka producer config %s", cfg.Compression, cfg.Name)
+	}
+	// the codecs are shared by every writer of the process, so is their level
+	if cfg.CompressionLevel != 0 {
+		switch compression {
+		case kafka.Gzip:
+			compress.Codecs[kafka.Gzip] = &gzip.Codec{Level: cfg.CompressionLevel}
+		case kafka.Zstd:
+			compress.Codecs[kafka.Zstd] = &zstd.Codec{Level: cfg.CompressionLevel}
+		}
+	}
+	writer := newKafkaWriter(servers)
+	writer.Compression = compression
+	return &kafkaPublisher{writer: writer}, nil
+}
+
+func newKafkaWriter(servers []string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(servers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// callers hand over whole batches, there is nothing to wait for
+		BatchTimeout: 10 * time.Millisecond,
+	}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	return p.writer.WriteMessages(ctx, toKafkaMessages(msgs)...)
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+func toKafkaMessages(msgs []Message) []kafka.Message {
+	result := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		m := kafka.Message{Topic: msg.Topic, Key: msg.Key, Value: msg.Value}
+		for k, v := range msg.Headers {
+			m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// expandServers resolves the env references of the servers, dropping the ones left empty
+func expandServers(servers []string) []string {
+	result := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server = configs.GetStringWithEnv(server); server != "" {
+			result = append(result, server)
+		}
+	}
+	return result
+}
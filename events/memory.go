@@ -0,0 +1,132 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBroker is an in-process stand-in for kafka, with one partition per topic.
+// Committed offsets are kept per consumer group, so a new consumer of a group resumes after the last commit.
+type MemoryBroker struct {
+	mu      sync.Mutex
+	changed chan struct{}
+	closed  bool
+	topics  map[string][]Message
+	// consumer group to topic to the offset of the next message to process
+	committed map[string]map[string]int64
+}
+
+// NewMemoryBroker is used to create an empty in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		changed:   make(chan struct{}),
+		topics:    make(map[string][]Message),
+		committed: make(map[string]map[string]int64),
+	}
+}
+
+// notify wakes up the consumers waiting for messages, the broker has to be locked
+func (b *MemoryBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Publish appends the messages to their topics
+func (b *MemoryBroker) Publish(ctx context.Context, msgs ...Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, msg := range msgs {
+		msg.Partition = 0
+		msg.Offset = int64(len(b.topics[msg.Topic]))
+		b.topics[msg.Topic] = append(b.topics[msg.Topic], msg)
+	}
+	b.notify()
+	return nil
+}
+
+// Messages returns the messages published to the topic
+func (b *MemoryBroker) Messages(topic string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.topics[topic]...)
+}
+
+// Consumer is used to create a member of the consumer group reading the topics
+func (b *MemoryBroker) Consumer(group string, topics ...string) Consumer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &memoryConsumer{broker: b, group: group, topics: topics, position: make(map[string]int64)}
+	for _, topic := range topics {
+		c.position[topic] = b.committed[group][topic]
+	}
+	return c
+}
+
+// Close wakes up and stops every consumer of the broker
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.notify()
+	}
+	return nil
+}
+
+type memoryConsumer struct {
+	broker *MemoryBroker
+	group  string
+	topics []string
+	// offset of the next message to fetch per topic
+	position map[string]int64
+	closed   bool
+}
+
+func (c *memoryConsumer) Fetch(ctx context.Context) (*Message, error) {
+	for {
+		c.broker.mu.Lock()
+		if c.closed || c.broker.closed {
+			c.broker.mu.Unlock()
+			return nil, ErrClosed
+		}
+		for _, topic := range c.topics {
+			if offset := c.position[topic]; offset < int64(len(c.broker.topics[topic])) {
+				msg := c.broker.topics[topic][offset]
+				c.position[topic] = offset + 1
+				c.broker.mu.Unlock()
+				return &msg, nil
+			}
+		}
+		changed := c.broker.changed
+		c.broker.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *memoryConsumer) Commit(ctx context.Context, msg *Message) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.broker.committed[c.group] == nil {
+		c.broker.committed[c.group] = make(map[string]int64)
+	}
+	if next := msg.Offset + 1; next > c.broker.committed[c.group][msg.Topic] {
+		c.broker.committed[c.group][msg.Topic] = next
+	}
+	return nil
+}
+
+func (c *memoryConsumer) Close() error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.closed = true
+	c.broker.notify()
+	return nil
+}
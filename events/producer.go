@@ -0,0 +1,331 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smartpet/websocket/metrics"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// ProducerConfig tunes the batching and the disk buffer of a Producer
+type ProducerConfig struct {
+	QueueSize int
+	BatchSize int
+	// a batch is published once it is full or its first message waited this long
+	Linger time.Duration
+	// directory keeping the batches that could not be published, retried every RetryInterval
+	BufferDir      string
+	BufferMaxBytes int64
+	RetryInterval  time.Duration
+}
+
+// Producer publishes messages asynchronously in batches. Batches that cannot be published, because the broker
+// is unavailable, are written to a local disk buffer and published again once the broker is back. Until then
+// the following batches go straight to the disk buffer, keeping their order and not waiting on the broker.
+// Only the goroutine of the producer touches the disk, callers of Emit never wait for it.
+type Producer struct {
+	publisher Publisher
+	cfg       ProducerConfig
+	queue     chan Message
+	buffer    *diskBuffer
+	// messages dropped by Emit since the last report
+	dropped atomic.Int64
+	// set by the goroutine of the producer when a publish failed, until the disk buffer is replayed
+	failing bool
+
+	// cancelled when Close runs out of time, what is left is then written to the disk buffer
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewProducer is used to create a producer publishing through the publisher
+func NewProducer(publisher Publisher, cfg ProducerConfig) (*Producer, error) {
+	if cfg.QueueSize <= 0 || cfg.BatchSize <= 0 || cfg.Linger <= 0 || cfg.RetryInterval <= 0 {
+		return nil, fmt.Errorf("invalid producer config %+v", cfg)
+	}
+	buffer, err := newDiskBuffer(cfg.BufferDir, cfg.BufferMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	p := &Producer{
+		publisher: publisher,
+		cfg:       cfg,
+		queue:     make(chan Message, cfg.QueueSize),
+		buffer:    buffer,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	go p.run()
+	return p, nil
+}
+
+// Emit queues the message without blocking, it is dropped and counted when the queue is full
+func (p *Producer) Emit(msg Message) {
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		p.dropped.Add(1)
+		metrics.IncProducerMessagesDropped(msg.Topic)
+	}
+}
+
+// Close publishes the queued messages, writing to the disk buffer what cannot be published before the deadline
+func (p *Producer) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		// stops the publish in flight, the goroutine of the producer writes the rest to the disk buffer
+		p.cancel()
+		<-p.done
+		p.publisher.Close()
+		return ctx.Err()
+	}
+	p.cancel()
+	return p.publisher.Close()
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+	retry := time.NewTicker(p.cfg.RetryInterval)
+	defer retry.Stop()
+	linger := time.NewTimer(p.cfg.Linger)
+	linger.Stop()
+
+	batch := make([]Message, 0, p.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			p.publish(batch)
+			batch = make([]Message, 0, p.cfg.BatchSize)
+		}
+		linger.Stop()
+	}
+	for {
+		select {
+		case msg := <-p.queue:
+			if len(batch) == 0 {
+				linger.Reset(p.cfg.Linger)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= p.cfg.BatchSize {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		case <-retry.C:
+			p.reportDropped()
+			p.replay()
+		case <-p.stop:
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+				if len(batch) >= p.cfg.BatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// reportDropped logs the messages dropped since the last report, once per retry interval at most
+func (p *Producer) reportDropped() {
+	if dropped := p.dropped.Swap(0); dropped > 0 {
+		log.ApplicationWarn(context.Background()).Int64("messages", dropped).Msg("producer queue full, messages dropped")
+	}
+}
+
+// publish publishes the batch, or writes it to the disk buffer while the broker is failing or the producer
+// ran out of time to close
+func (p *Producer) publish(batch []Message) {
+	if p.failing || p.ctx.Err() != nil {
+		p.spill(batch)
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, p.cfg.RetryInterval)
+	defer cancel()
+	if err := p.publisher.Publish(ctx, batch...); err != nil {
+		log.ApplicationWarn(ctx).Err(err).Int("messages", len(batch)).Msg("error publishing, buffering to disk until the broker is back")
+		p.failing = true
+		p.spill(batch)
+	}
+}
+
+func (p *Producer) spill(batch []Message) {
+	if err := p.buffer.write(batch); err != nil {
+		log.ApplicationError(context.Background()).Err(err).Int("messages", len(batch)).Msg("error buffering to disk, messages dropped")
+	}
+}
+
+// replay publishes the buffered batches, oldest first, until one fails. Batches are published again once
+// the whole buffer went through.
+func (p *Producer) replay() {
+	for _, file := range p.buffer.files() {
+		batch, err := p.buffer.read(file.name)
+		if err != nil {
+			log.ApplicationError(context.Background()).Err(err).Str("file", file.name).Msg("error reading disk buffer, batch dropped")
+			p.buffer.remove(file)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, p.cfg.RetryInterval)
+		err = p.publisher.Publish(ctx, batch...)
+		cancel()
+		if err != nil {
+			return
+		}
+		p.buffer.remove(file)
+		log.ApplicationInfo(context.Background()).Int("messages", len(batch)).Msg("published buffered messages")
+	}
+	p.failing = false
+}
+
+// diskBuffer keeps batches as files of json lines, dropping the oldest ones beyond its size limit.
+// The files and their total size are tracked in memory, the directory is only listed when the buffer opens.
+type diskBuffer struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	seq      atomic.Int64
+	// buffered batches oldest first
+	entries []bufferFile
+	total   int64
+}
+
+type bufferFile struct {
+	name string
+	size int64
+}
+
+func newDiskBuffer(dir string, maxBytes int64) (*diskBuffer, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no producer buffer directory")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	b := &diskBuffer{dir: dir, maxBytes: maxBytes}
+	// batches left by a previous run
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			b.entries = append(b.entries, bufferFile{name: file, size: info.Size()})
+			b.total += info.Size()
+		}
+	}
+	return b, nil
+}
+
+func (b *diskBuffer) write(batch []Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// names sort in write order, also across restarts
+	name := filepath.Join(b.dir, fmt.Sprintf("%020d-%06d.jsonl", time.Now().UnixNano(), b.seq.Add(1)%1000000))
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range batch {
+		if err := enc.Encode(&batch[i]); err != nil {
+			f.Close()
+			os.Remove(name + ".tmp")
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	b.entries = append(b.entries, bufferFile{name: name, size: info.Size()})
+	b.total += info.Size()
+	b.trim()
+	return nil
+}
+
+// trim removes the oldest batches while the buffer is over its size limit, the buffer has to be locked
+func (b *diskBuffer) trim() {
+	if b.maxBytes <= 0 {
+		return
+	}
+	for len(b.entries) > 1 && b.total > b.maxBytes {
+		oldest := b.entries[0]
+		log.ApplicationWarn(context.Background()).Str("file", oldest.name).Msg("disk buffer full, oldest batch dropped")
+		os.Remove(oldest.name)
+		b.entries = b.entries[1:]
+		b.total -= oldest.size
+	}
+}
+
+func (b *diskBuffer) files() []bufferFile {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]bufferFile(nil), b.entries...)
+}
+
+func (b *diskBuffer) read(file string) ([]Message, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var batch []Message
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		msg := Message{}
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+func (b *diskBuffer) remove(file bufferFile) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	os.Remove(file.name)
+	for i, e := range b.entries {
+		if e.name == file.name {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			b.total -= e.size
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher records the batches published, failing them while down and holding them until the deadline while hung
+type fakePublisher struct {
+	mu        sync.Mutex
+	down      bool
+	hung      bool
+	published []string
+	closed    bool
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, msgs ...Message) error {
+	f.mu.Lock()
+	hung, down := f.hung, f.down
+	f.mu.Unlock()
+	if hung {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if down {
+		return errors.New("broker down")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, values(msgs))
+	return nil
+}
+
+func (f *fakePublisher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakePublisher) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// values joins the values of the batch, a batch of a and b is "a,b"
+func values(batch []Message) string {
+	v := make([]string, 0, len(batch))
+	for _, msg := range batch {
+		v = append(v, string(msg.Value))
+	}
+	return strings.Join(v, ",")
+}
+
+func batchOf(v ...string) []Message {
+	batch := make([]Message, 0, len(v))
+	for _, value := range v {
+		batch = append(batch, Message{Topic: "activity", Key: []byte("k"), Value: []byte(value), Headers: map[string]string{"h": value}})
+	}
+	return batch
+}
+
+// buffered returns the batches in the disk buffer, oldest first
+func buffered(t *testing.T, b *diskBuffer) []string {
+	t.Helper()
+	var batches []string
+	for _, file := range b.files() {
+		batch, err := b.read(file.name)
+		if err != nil {
+			t.Fatalf("read %s: %v", file.name, err)
+		}
+		batches = append(batches, values(batch))
+	}
+	return batches
+}
+
+func TestDiskBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		batches  [][]string
+		want     []string
+	}{
+		{name: "kept in write order", batches: [][]string{{"a", "b"}, {"c"}, {"d"}}, want: []string{"a,b", "c", "d"}},
+		// a batch of one message takes about 100 bytes
+		{name: "oldest dropped over the limit", maxBytes: 250, batches: [][]string{{"a"}, {"b"}, {"c"}}, want: []string{"b", "c"}},
+		{name: "newest kept when alone over the limit", maxBytes: 10, batches: [][]string{{"a"}, {"b", "c"}}, want: []string{"b,c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b, err := newDiskBuffer(dir, tt.maxBytes)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			for _, batch := range tt.batches {
+				if err := b.write(batchOf(batch...)); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			if got := strings.Join(buffered(t, b), "|"); got != strings.Join(tt.want, "|") {
+				t.Fatalf("buffered %s, want %s", got, strings.Join(tt.want, "|"))
+			}
+
+			// a new run finds the batches left by the previous one
+			reopened, err := newDiskBuffer(dir, tt.maxBytes)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			if got := strings.Join(buffered(t, reopened), "|"); got != strings.Join(tt.want, "|") {
+				t.Errorf("after reopening buffered %s, want %s", got, strings.Join(tt.want, "|"))
+			}
+			if reopened.total != b.total {
+				t.Errorf("after reopening total = %d bytes, want %d", reopened.total, b.total)
+			}
+			for _, file := range reopened.files() {
+				reopened.remove(file)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 || reopened.total != 0 {
+				t.Errorf("%d files and %d bytes left after removing every batch", len(entries), reopened.total)
+			}
+		})
+	}
+}
+
+func TestProducerFailover(t *testing.T) {
+	type step struct {
+		down      bool
+		batch     []string // published when set, otherwise the buffer is replayed
+		published []string // every batch the broker got so far
+		buffered  []string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "broker up", steps: []step{
+			{batch: []string{"a"}, published: []string{"a"}},
+			{batch: []string{"b"}, published: []string{"a", "b"}},
+		}},
+		{name: "batches after a failure go to disk until replayed", steps: []step{
+			{down: true, batch: []string{"a"}, buffered: []string{"a"}},
+			// the broker is back, but the batch must not overtake the buffered one
+			{batch: []string{"b"}, buffered: []string{"a", "b"}},
+			{published: []string{"a", "b"}},
+			{batch: []string{"c"}, published: []string{"a", "b", "c"}},
+		}},
+		{name: "failing replay keeps the buffer", steps: []step{
+			{down: true, batch: []string{"a"}, buffered: []string{"a"}},
+			{down: true, buffered: []string{"a"}},
+			{down: true, batch: []string{"b"}, buffered: []string{"a", "b"}},
+			{published: []string{"a", "b"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer, err := newDiskBuffer(t.TempDir(), 0)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			publisher := &fakePublisher{}
+			// driven without its goroutine, the steps run as the goroutine would run them
+			p := &Producer{publisher: publisher, cfg: ProducerConfig{RetryInterval: time.Second}, buffer: buffer}
+			p.ctx, p.cancel = context.WithCancel(context.Background())
+			defer p.cancel()
+
+			for i, s := range tt.steps {
+				publisher.setDown(s.down)
+				if s.batch != nil {
+					p.publish(batchOf(s.batch...))
+				} else {
+					p.replay()
+				}
+				if got := strings.Join(publisher.published, "|"); got != strings.Join(s.published, "|") {
+					t.Errorf("step %d: published %s, want %s", i, got, strings.Join(s.published, "|"))
+				}
+				if got := strings.Join(buffered(t, buffer), "|"); got != strings.Join(s.buffered, "|") {
+					t.Errorf("step %d: buffered %s, want %s", i, got, strings.Join(s.buffered, "|"))
+				}
+			}
+		})
+	}
+}
+
+func TestProducerClose(t *testing.T) {
+	tests := []struct {
+		name          string
+		hung          bool
+		wantErr       error
+		wantPublished int
+		wantBuffered  int
+	}{
+		{name: "queue published", wantPublished: 3},
+		{name: "rest written to disk at the deadline", hung: true, wantErr: context.DeadlineExceeded, wantBuffered: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &fakePublisher{hung: tt.hung}
+			p, err := NewProducer(publisher, ProducerConfig{
+				QueueSize:     10,
+				BatchSize:     1,
+				Linger:        time.Hour,
+				BufferDir:     t.TempDir(),
+				RetryInterval: time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("new producer: %v", err)
+			}
+			for _, v := range []string{"a", "b", "c"} {
+				p.Emit(batchOf(v)[0])
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := p.Close(ctx); err != tt.wantErr {
+				t.Errorf("close: err = %v, want %v", err, tt.wantErr)
+			}
+			if len(publisher.published) != tt.wantPublished || !publisher.closed {
+				t.Errorf("published %v closed %v, want %d batches and closed", publisher.published, publisher.closed, tt.wantPublished)
+			}
+			if got := buffered(t, p.buffer); len(got) != tt.wantBuffered {
+				t.Errorf("buffered %v, want %d batches", got, tt.wantBuffered)
+			}
+			// messages emitted once closed are ignored
+			p.Emit(batchOf("d")[0])
+			if len(p.queue) != 0 {
+				t.Error("message queued after close")
+			}
+		})
+	}
+}
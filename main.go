@@ -10,20 +10,30 @@ import (
 	"github.com/smartpet/websocket/business"
 	"github.com/smartpet/websocket/constant"
 	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/utils"
 	"github.com/smartpet/websocket/utils/configs"
 	"github.com/smartpet/websocket/utils/flags"
 	log "github.com/smartpet/websocket/utils/logger"
 )
 
+// internalMux holds the routes of the other backend services and the metrics scrape, served on the internal listener only
+var internalMux = http.NewServeMux()
+
 func setupRoutes() {
-	http.HandleFunc("/ws", business.WsEndpoint)
+	http.HandleFunc(constant.SocketRoute, business.WsEndpoint)
+	http.HandleFunc(constant.SocketTicketRoute, metrics.Instrument(constant.SocketTicketRoute, business.TicketEndpoint))
+
+	internalMux.Handle(constant.MetricsRoute, metrics.Handler())
+	internalMux.HandleFunc(constant.InternalPushRoute, metrics.Instrument(constant.InternalPushRoute, business.PushEndpoint))
+	internalMux.HandleFunc(constant.AdminRevokeRoute, metrics.Instrument(constant.AdminRevokeRoute, business.RevokeEndpoint))
 }
 func main() {
 
 	Initialization()
 
 	setupRoutes()
-	http.ListenAndServe(":8001", nil)
+	publicTLS, internalTLS := initTLS()
+	serve(newServer(), newTLSServer(publicTLS), newInternalServer(internalTLS))
 }
 func initAWS() {
 
@@ -41,9 +51,16 @@ func initAWS() {
 }
 
 func initMetrics() {
-	// Below are value for time interval for time metric. Start corresponds to startin value in seconds,
-	// it'll start from 10ms, with increment of 20ms, and go till 300ms
-	metrics.Init(metrics.BucketConfig{Start: 0.01, Width: 0.03, Count: 4})
+	// Below are the default values for time interval for time metric. Start corresponds to startin value in seconds,
+	// it'll start from 10ms, with increment of 30ms, overridden by the metrics.buckets block of application.yml
+	cfg := metrics.BucketConfig{Start: 0.01, Width: 0.03, Count: 4}
+	if err := configs.UnmarshalAppConfig(constant.MetricsBucketsKey, &cfg); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error reading metrics buckets")
+	}
+	if err := cfg.Validate(); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("invalid metrics buckets")
+	}
+	metrics.Init(cfg)
 }
 func initConfigs() {
 	// init configs
@@ -52,7 +69,7 @@ func initConfigs() {
 	if flags.ApplicationMode() == constant.TestMode {
 		err = configs.InitTestModeConfigs(flags.BaseConfigPath(), constant.DatabaseConfig, constant.LoggerConfig, constant.ApplicationConfig, constant.ExternalConfig)
 	} else if flags.ApplicationMode() == constant.ReleaseMode {
-		err = configs.InitReleaseModeConfigs(constant.DatabaseConfig, constant.LoggerConfig)
+		err = configs.InitReleaseModeConfigs(constant.DatabaseConfig, constant.LoggerConfig, constant.ApplicationConfig)
 	}
 	if err != nil {
 		log.ApplicationFatal(context.Background()).Err(err).Msg("error loading configs")
@@ -71,11 +88,62 @@ func startLogger() {
 
 }
 
+func initCache() {
+	utils.InitCache()
+}
+
+func initJWKS() {
+	if err := utils.InitJWKS(context.Background()); err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error loading jwks")
+	}
+}
+
+func initSocket() {
+	business.Init()
+}
+
+func initShutdownHooks() {
+	addShutdownHook("eventBridge", func(ctx context.Context) error {
+		return business.CloseEventBridge(ctx)
+	})
+	addShutdownHook("activity", func(ctx context.Context) error {
+		return business.CloseActivity(ctx)
+	})
+	addShutdownHook("backplane", func(ctx context.Context) error {
+		return business.CloseBackplane(ctx)
+	})
+	addShutdownHook("messageStore", func(ctx context.Context) error {
+		return business.CloseMessageStore()
+	})
+	addShutdownHook("jwks", func(ctx context.Context) error {
+		utils.CloseJWKS()
+		return nil
+	})
+	addShutdownHook("tls", func(ctx context.Context) error {
+		utils.CloseTLS()
+		return nil
+	})
+	addShutdownHook("cache", func(ctx context.Context) error {
+		utils.CloseCache()
+		return nil
+	})
+	addShutdownHook("configs", func(ctx context.Context) error {
+		if configs.GetClient() == nil {
+			return nil
+		}
+		return configs.GetClient().Close()
+	})
+}
+
 func Initialization() {
 	initAWS()
-	initMetrics()
 	initConfigs()
 	startLogger()
+	initMetrics()
+	initCache()
+	initJWKS()
+	initSocket()
+	initShutdownHooks()
 	log.ApplicationInfo(context.Background()).Int("numCPUs", runtime.NumCPU()).Int("maxProcs", runtime.GOMAXPROCS(0)).Send()
 
 }
@@ -1,7 +1,12 @@
 package metrics
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,18 +14,37 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// BucketConfig is used to initialise bucket
+// BucketConfig is used to initialise bucket, the http, db and external call histograms get Count linear buckets
 type BucketConfig struct {
 	Start float64
 	Width float64
 	Count int
+	// buckets of the socket write latency, in seconds
+	SocketWrite []float64
 }
 
+// Validate checks the buckets can make histograms, the registration of invalid ones panics
+func (c BucketConfig) Validate() error {
+	if c.Count < 1 || c.Width <= 0 {
+		return errors.New("linear buckets need a count of at least 1 and a positive width")
+	}
+	for i := 1; i < len(c.SocketWrite); i++ {
+		if c.SocketWrite[i] <= c.SocketWrite[i-1] {
+			return fmt.Errorf("socket write buckets must be increasing: %v", c.SocketWrite)
+		}
+	}
+	return nil
+}
+
+// DefaultSocketWriteBuckets are the socket write latency buckets used when none are configured
+var DefaultSocketWriteBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+
 // timers
 var (
 	dbQueryTimer             *prometheus.HistogramVec
 	httpRequestTimer         *prometheus.HistogramVec
 	externalHTTPRequestTimer *prometheus.HistogramVec
+	socketWriteTimer         prometheus.Histogram
 )
 
 // counters
@@ -30,6 +54,20 @@ var (
 	httpTotalRequestCounter    *prometheus.CounterVec
 	httpResponseStatusCounter  *prometheus.CounterVec
 	externalHTTPRequestCounter *prometheus.CounterVec
+	socketMessagesDropped      *prometheus.CounterVec
+	socketOriginsRejected      *prometheus.CounterVec
+	socketUpgrades             *prometheus.CounterVec
+	socketMessages             *prometheus.CounterVec
+	socketMessageBytes         *prometheus.CounterVec
+	socketCloses               *prometheus.CounterVec
+	producerMessagesDropped    *prometheus.CounterVec
+	bridgeEventsUndelivered    *prometheus.CounterVec
+)
+
+// gauges
+var (
+	socketSendQueueDepth    prometheus.Gauge
+	socketActiveConnections *prometheus.GaugeVec
 )
 
 // Init is used to initialise metrics
@@ -91,6 +129,95 @@ func Init(cfg BucketConfig) {
 		},
 		[]string{"status", "url", "method"},
 	)
+
+	socketMessagesDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketMessagesDropped",
+			Help: "How many outbound socket messages were dropped because the send queue was full, partitioned by overflow policy",
+		},
+		[]string{"policy"},
+	)
+
+	socketOriginsRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketOriginsRejected",
+			Help: "How many socket upgrades were refused because of their origin, partitioned by reason",
+		},
+		[]string{"reason"},
+	)
+
+	producerMessagesDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "producerMessagesDropped",
+			Help: "How many events were dropped because the queue of the producer was full, partitioned by topic",
+		},
+		[]string{"topic"},
+	)
+
+	bridgeEventsUndelivered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridgeEventsUndelivered",
+			Help: "How many events read by the event bridge reached nobody, partitioned by source topic and target kind",
+		},
+		[]string{"topic", "target"},
+	)
+
+	socketSendQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "socketSendQueueDepth",
+			Help: "Number of outbound socket messages waiting in the send queues of all connections",
+		},
+	)
+
+	buckets := cfg.SocketWrite
+	if len(buckets) == 0 {
+		buckets = DefaultSocketWriteBuckets
+	}
+	socketWriteTimer = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "socketWriteSeconds",
+		Help:    "Duration of the writes of socket messages to the connection.",
+		Buckets: buckets,
+	})
+
+	socketActiveConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "socketActiveConnections",
+			Help: "Number of live socket connections, partitioned by user type and app",
+		},
+		[]string{"user_type", "app"},
+	)
+
+	socketUpgrades = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketUpgrades",
+			Help: "How many socket upgrade requests were handled, partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	socketMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketMessages",
+			Help: "How many socket messages were received and written, partitioned by direction and message type",
+		},
+		[]string{"direction", "type"},
+	)
+
+	socketMessageBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketMessageBytes",
+			Help: "Size of the socket messages received and written, partitioned by direction and message type",
+		},
+		[]string{"direction", "type"},
+	)
+
+	socketCloses = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socketCloses",
+			Help: "How many socket connections were closed, partitioned by the side sending the close frame and its close code",
+		},
+		[]string{"side", "code"},
+	)
 }
 
 // GetMetricsMiddleware is to add prometheus timer and counter stats for requests
@@ -123,11 +250,105 @@ func SetExternalHTTPRequestCounter(status, url, method string) {
 	externalHTTPRequestCounter.WithLabelValues(status, url, method).Inc()
 }
 
+// AddSocketSendQueueDepth is to track the messages waiting in the socket send queues
+func AddSocketSendQueueDepth(delta float64) {
+	socketSendQueueDepth.Add(delta)
+}
+
+// IncSocketMessagesDropped is to count the socket messages dropped by the overflow policy
+func IncSocketMessagesDropped(policy string) {
+	socketMessagesDropped.WithLabelValues(policy).Inc()
+}
+
+// IncProducerMessagesDropped is to count the events the producer dropped as its queue was full
+func IncProducerMessagesDropped(topic string) {
+	producerMessagesDropped.WithLabelValues(topic).Inc()
+}
+
+// AddBridgeEventsUndelivered is to count the users or socket topics an event of the bridge reached nobody of
+func AddBridgeEventsUndelivered(topic, target string, count int) {
+	bridgeEventsUndelivered.WithLabelValues(topic, target).Add(float64(count))
+}
+
+// IncSocketOriginRejected is to count the socket upgrades refused by the origin allowlist
+func IncSocketOriginRejected(reason string) {
+	socketOriginsRejected.WithLabelValues(reason).Inc()
+}
+
+// IncSocketUpgrades is to count the socket upgrade requests by result
+func IncSocketUpgrades(result string) {
+	socketUpgrades.WithLabelValues(result).Inc()
+}
+
+// AddSocketActiveConnections is to track the live socket connections
+func AddSocketActiveConnections(userType, app string, delta float64) {
+	socketActiveConnections.WithLabelValues(userType, app).Add(delta)
+}
+
+// AddSocketMessage is to count a socket message and its size, direction is in or out
+func AddSocketMessage(direction, msgType string, size int) {
+	socketMessages.WithLabelValues(direction, msgType).Inc()
+	socketMessageBytes.WithLabelValues(direction, msgType).Add(float64(size))
+}
+
+// ObserveSocketWrite is to log the time taken to write a socket message
+func ObserveSocketWrite(d time.Duration) {
+	socketWriteTimer.Observe(d.Seconds())
+}
+
+// IncSocketCloses is to count the close frames of the socket connections, side is server or client
+func IncSocketCloses(side string, code int) {
+	socketCloses.WithLabelValues(side, strconv.Itoa(code)).Inc()
+}
+
 // HTTPMetrics is the wrapper to add metrics to HTTP requests
 func HTTPMetrics() gin.HandlerFunc {
 	return gin.WrapH(promhttp.Handler())
 }
 
+// Handler serves the metrics on the net/http server
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder keeps the status written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// requestHost is the host label of the requests counted by Instrument, the name of the node rather than the Host
+// header the clients choose, which would grow a series per value sent
+var requestHost = nodeName()
+
+func nodeName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// Instrument adds the http request timer and counters to a net/http handler, name is the path label. It is not
+// meant for the socket route, whose handler runs for the whole life of the connection.
+func Instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := prometheus.NewTimer(httpRequestTimer.WithLabelValues(name))
+		httpTotalRequestCounter.WithLabelValues(name).Inc()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+		status := strconv.Itoa(rec.status)
+		httpResponseStatusCounter.WithLabelValues(status).Inc()
+		httpRequestCounter.WithLabelValues(status, requestHost, name, r.Method).Inc()
+		timer.ObserveDuration()
+	}
+}
+
 func GetHandlerName(ctx *gin.Context) string {
 	handlers := ctx.HandlerNames()
 	l := len(handlers)
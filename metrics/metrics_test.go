@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBucketConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     BucketConfig
+		wantErr bool
+	}{
+		{name: "valid", cfg: BucketConfig{Start: 0.01, Width: 0.03, Count: 4, SocketWrite: []float64{0.001, 0.01, 1}}},
+		{name: "default socket write buckets", cfg: BucketConfig{Start: 0.01, Width: 0.03, Count: 4}},
+		{name: "no linear bucket", cfg: BucketConfig{Start: 0.01, Width: 0.03}, wantErr: true},
+		{name: "zero width", cfg: BucketConfig{Start: 0.01, Count: 4}, wantErr: true},
+		{name: "negative width", cfg: BucketConfig{Start: 0.01, Width: -0.03, Count: 4}, wantErr: true},
+		{name: "socket write buckets repeated", cfg: BucketConfig{Width: 0.03, Count: 4, SocketWrite: []float64{0.001, 0.001}}, wantErr: true},
+		{name: "socket write buckets decreasing", cfg: BucketConfig{Width: 0.03, Count: 4, SocketWrite: []float64{0.01, 0.001}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// scrape returns the metrics served by Handler
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("reading metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	// the collectors are registered once for the process
+	Init(BucketConfig{Start: 0.01, Width: 0.03, Count: 4})
+
+	tests := []struct {
+		name     string
+		record   func()
+		wantLine string
+	}{
+		{name: "instrumented handler", record: func() {
+			h := Instrument("ticket", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) })
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/ticket", nil))
+		}, wantLine: `routerRequestsTotal{host="` + requestHost + `",method="POST",path="ticket",status="201"} 1`},
+		{name: "host header of the client ignored", record: func() {
+			h := Instrument("spoofed", func(w http.ResponseWriter, r *http.Request) {})
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://attacker-1.example.com/spoofed", nil))
+		}, wantLine: `routerRequestsTotal{host="` + requestHost + `",method="GET",path="spoofed",status="200"} 1`},
+		{name: "instrumented handler without a status", record: func() {
+			h := Instrument("revoke", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/revoke", nil))
+		}, wantLine: `routerRequestsTotal{host="` + requestHost + `",method="POST",path="revoke",status="200"} 1`},
+		{name: "close code", record: func() { IncSocketCloses("server", 1001) },
+			wantLine: `socketCloses{code="1001",side="server"} 1`},
+		{name: "message and its size", record: func() { AddSocketMessage("in", "chat.send", 42) },
+			wantLine: `socketMessageBytes{direction="in",type="chat.send"} 42`},
+		{name: "connection closed", record: func() {
+			AddSocketActiveConnections("parent", "none", 1)
+			AddSocketActiveConnections("parent", "none", -1)
+		}, wantLine: `socketActiveConnections{app="none",user_type="parent"} 0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.record()
+			if got := scrape(t); !strings.Contains(got, tt.wantLine+"\n") {
+				t.Errorf("metrics miss %s", tt.wantLine)
+			}
+		})
+	}
+}
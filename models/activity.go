@@ -0,0 +1,22 @@
+package models
+
+// ActivitySchemaVersion is bumped on breaking changes of ActivityEvent, fields are otherwise only ever added
+const ActivitySchemaVersion = 1
+
+// ActivityEvent is the socket activity published to kafka for analytics and crm, keyed by user id
+type ActivityEvent struct {
+	SchemaVersion  int    `json:"schema_version"`
+	EventID        string `json:"event_id"`
+	Type           string `json:"type"`
+	OccurredAt     int64  `json:"occurred_at"` // unix time in millis
+	Node           string `json:"node"`
+	UserID         string `json:"user_id"`
+	DeviceID       string `json:"device_id,omitempty"`
+	ConnectionID   string `json:"connection_id,omitempty"`
+	DurationMs     int64  `json:"duration_ms,omitempty"` // of the connection, on close
+	MessageID      string `json:"message_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	PeerID         string `json:"peer_id,omitempty"` // the other user of the message
+	Status         string `json:"status,omitempty"`  // presence of the user on presence changes
+	Actor          string `json:"actor,omitempty"`   // user acting as the user, for impersonated connections
+}
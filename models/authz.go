@@ -0,0 +1,27 @@
+package models
+
+// AuthzPolicy is the declarative policy of the message types and topics each kind of user may use.
+// Rules only grant access: an action matched by some rule is allowed when one of the matching rules grants it,
+// message types and subscriptions matched by no rule fall back to DefaultAction, publishing always needs a rule.
+type AuthzPolicy struct {
+	DefaultAction string        `json:"defaultAction"` // allow or deny
+	Messages      []MessageRule `json:"messages"`
+	Topics        []TopicRule   `json:"topics"`
+}
+
+// MessageRule grants the message types to the users of the user types holding the scopes.
+// An empty list of user types or scopes does not restrict on it, users need every scope of the rule.
+type MessageRule struct {
+	Types     []string `json:"types"`
+	UserTypes []string `json:"userTypes"`
+	Scopes    []string `json:"scopes"`
+}
+
+// TopicRule grants the actions on the topics matched by the pattern, {user_id} in the pattern stands for the
+// id of the connected user
+type TopicRule struct {
+	Pattern   string   `json:"pattern"`
+	Actions   []string `json:"actions"` // subscribe and publish
+	UserTypes []string `json:"userTypes"`
+	Scopes    []string `json:"scopes"`
+}
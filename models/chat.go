@@ -0,0 +1,93 @@
+package models
+
+// ChatSend is the payload of a chat.send message sent by the client
+type ChatSend struct {
+	To          string `json:"to"`
+	Text        string `json:"text"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+}
+
+// ChatMessage is a chat message as delivered to the devices of the recipient and the sender
+type ChatMessage struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Text           string `json:"text"`
+	ClientMsgID    string `json:"client_msg_id,omitempty"`
+	SentAt         int64  `json:"sent_at"`          // unix time in millis
+	Cursor         int64  `json:"cursor,omitempty"` // position of the message in the store, used for history paging
+	Status         string `json:"status,omitempty"` // delivery status for the recipient
+	Actor          string `json:"actor,omitempty"`  // user who sent the message as the sender, when impersonated
+}
+
+// ChatSent is the reply to chat.send once the message is accepted by the server
+type ChatSent struct {
+	ID          string `json:"id"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	SentAt      int64  `json:"sent_at"`
+	Delivered   int    `json:"delivered"` // number of recipient connections the message was handed to
+}
+
+// ChatRelationship is the data returned by the booking service for a pair of users
+type ChatRelationship struct {
+	Allowed bool `json:"allowed"`
+}
+
+// HistoryFetch is the payload of a history.fetch message, it pages the conversation with another user backwards
+type HistoryFetch struct {
+	With   string `json:"with"`
+	Before int64  `json:"before,omitempty"` // cursor of the oldest message already fetched, empty for the latest page
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// HistoryResult is the reply to history.fetch, messages are newest first
+type HistoryResult struct {
+	ConversationID string        `json:"conversation_id"`
+	Messages       []ChatMessage `json:"messages"`
+	NextCursor     int64         `json:"next_cursor,omitempty"` // empty once the start of the conversation is reached
+}
+
+// Ack is the payload of an ack message, sent by the recipient once messages reach the device or are read,
+// an ack holds at most 100 message ids
+type Ack struct {
+	MessageIDs []string `json:"message_ids"`
+	Status     string   `json:"status"` // delivered or read
+}
+
+// Receipt tells the devices of the sender that the status of a message changed for the recipient
+type Receipt struct {
+	MessageID      string `json:"message_id"`
+	ConversationID string `json:"conversation_id"`
+	UserID         string `json:"user_id"`
+	Status         string `json:"status"`
+	At             int64  `json:"at"` // unix time in millis
+}
+
+// PresenceSet is the payload of presence.set, sent by a device going to the background and back
+type PresenceSet struct {
+	Status string `json:"status"` // online or away
+}
+
+// PresenceSubscribe is the payload of presence.subscribe and presence.unsubscribe
+type PresenceSubscribe struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// Presence is the presence of a user over all of its devices
+type Presence struct {
+	UserID   string `json:"user_id"`
+	Status   string `json:"status"`
+	LastSeen int64  `json:"last_seen,omitempty"` // unix time in millis the user was last connected, set when offline
+}
+
+// PresenceState is the reply to presence.subscribe
+type PresenceState struct {
+	Users []Presence `json:"users"`
+}
+
+// Typing is the payload of typing.start and typing.stop, the client sets to and the server sets from
+type Typing struct {
+	To   string `json:"to,omitempty"`
+	From string `json:"from,omitempty"`
+}
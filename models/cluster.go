@@ -0,0 +1,25 @@
+package models
+
+// ClusterMessage is exchanged between the nodes of the socket service over the backplane
+type ClusterMessage struct {
+	Kind         string `json:"kind"`
+	Origin       string `json:"origin"` // node id of the sender
+	UserID       string `json:"user_id,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	ExceptDevice string `json:"except_device,omitempty"`
+	// presence of the user on the origin node, or of every user connected to it in a state message
+	Status   string            `json:"status,omitempty"`
+	Presence map[string]string `json:"presence,omitempty"`
+	Data     []byte            `json:"data,omitempty"`
+	// type of the envelope in data
+	MessageType string `json:"message_type,omitempty"`
+	// topic of the frame, or topic pattern subscribed to by the origin node
+	Topic string `json:"topic,omitempty"`
+	// topic patterns subscribed to on the origin node, in a state message
+	Patterns []string `json:"patterns,omitempty"`
+	// revocation made on the origin node, or every revocation it knows of in a state message
+	Revocation  *Revocation  `json:"revocation,omitempty"`
+	Revocations []Revocation `json:"revocations,omitempty"`
+	// version of the state of the origin node, on state, heartbeat, presence and topic route messages
+	Version uint64 `json:"version,omitempty"`
+}
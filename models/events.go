@@ -0,0 +1,11 @@
+package models
+
+// EventRoute maps the domain events read from kafka to the socket message pushed to their users
+type EventRoute struct {
+	Topic       string   `json:"topic"`       // empty matches every topic
+	EventType   string   `json:"eventType"`   // empty matches every event type
+	MessageType string   `json:"messageType"` // type of the pushed message, the event type when empty
+	UserFields  []string `json:"userFields"`  // dotted paths of the event fields holding the target user ids
+	// topic the event is published to, {dotted.path} placeholders are replaced by the event fields
+	TargetTopic string `json:"targetTopic"`
+}
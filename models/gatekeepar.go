@@ -64,13 +64,23 @@ type TokenClaims struct {
 	Source     string           `json:"source,omitempty"`
 	DeviceId   string           `json:"device_id,omitempty"`
 	KeyId      string           `json:"kid,omitempty"`
+	// set on the tokens an actor, like a support agent, was issued to act as the user of the token
+	Act *Actor `json:"act,omitempty"`
 }
 
 type JWTLoginToken struct {
 	UserData TokenUserData `json:"userData"`
+	TokenClaims
 	jwt.StandardClaims
 }
 
+// ServiceClaims are the claims of the service to service tokens of the internal api, the issuer is the calling service
+type ServiceClaims struct {
+	Scope jwt.ClaimStrings `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Actor is the act claim of a token, naming who is acting as the user of the token
 type Actor struct {
 	Subject string `json:"sub,omitempty"`
 }
@@ -0,0 +1,40 @@
+package models
+
+import "encoding/json"
+
+// PushRequest is the body of the internal push api
+type PushRequest struct {
+	IdempotencyKey string          `json:"idempotency_key"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload"`
+	Targets        []PushTarget    `json:"targets"`
+}
+
+// PushTarget is one recipient of a push, either a user, a device of a user, the subscribers of a topic or every connection
+type PushTarget struct {
+	UserID    string `json:"user_id,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Broadcast bool   `json:"broadcast,omitempty"`
+}
+
+// PushTargetResult is the outcome of a push for one of its targets
+type PushTargetResult struct {
+	PushTarget
+	Status string `json:"status"`
+	// connections of the node handling the push it was queued on, and other nodes it was forwarded to
+	Connections int `json:"connections"`
+	Nodes       int `json:"nodes"`
+}
+
+// PushResponse is the data of the response of the internal push api
+type PushResponse struct {
+	MessageID string             `json:"message_id"`
+	Results   []PushTargetResult `json:"results"`
+}
+
+// ServiceIdentity maps the subject of a client certificate of the push api to the service it stands for
+type ServiceIdentity struct {
+	Subject string `json:"subject"`
+	Service string `json:"service"`
+}
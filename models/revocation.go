@@ -0,0 +1,26 @@
+package models
+
+// Revocation denies a token, a device of a user, a device of any user or a whole user. A lifted revocation is
+// kept until it expires in place of the revocation, so a node handing the revocation over late does not restore it.
+type Revocation struct {
+	TokenID  string `json:"token_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// how long the revocation lasts, it should outlive the tokens it denies
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	// unix millis, a user revocation only denies the tokens issued before RevokedAt
+	RevokedAt int64  `json:"revoked_at,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	RevokedBy string `json:"revoked_by,omitempty"`
+	// unix millis, set when an admin lifted the revocation
+	LiftedAt int64  `json:"lifted_at,omitempty"`
+	LiftedBy string `json:"lifted_by,omitempty"`
+}
+
+// RevokeResponse is the revocation made and the number of connections of the node it closed right away,
+// the other nodes close theirs as they get it
+type RevokeResponse struct {
+	Revocation
+	Connections int `json:"connections"`
+}
@@ -0,0 +1,74 @@
+package models
+
+import "encoding/json"
+
+// Envelope is the frame exchanged over the socket in both directions
+type Envelope struct {
+	Version       string `json:"v"`
+	Type          string `json:"type"`
+	ID            string `json:"id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Timestamp     int64  `json:"ts"` // unix time in millis
+	// per user sequence number of the events pushed to the user, replies and transient events have none
+	Seq int64 `json:"seq,omitempty"`
+	// topic the message was published to, for messages delivered through a subscription
+	Topic string `json:"topic,omitempty"`
+	// user acting as the sender, stamped by the server on the messages of an impersonated connection
+	Actor   string          `json:"actor,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// GoingAway is the payload telling the client the server is shutting down and when to reconnect
+type GoingAway struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+// SocketTicket is what a connection ticket stands for, the token it was traded for
+type SocketTicket struct {
+	UserID   string         `json:"user_id"`
+	DeviceID string         `json:"device_id"`
+	Claims   *JWTLoginToken `json:"claims"`
+}
+
+// TicketResponse is the connection ticket handed to a browser
+type TicketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int64  `json:"expires_in"` // seconds
+}
+
+// AuthExpiring warns the client its token expires soon, it has to send auth.refresh with a new token before then
+type AuthExpiring struct {
+	ExpiresAt int64 `json:"expires_at"` // unix millis
+}
+
+// AuthRefresh carries a fresh token of the connected user
+type AuthRefresh struct {
+	Token string `json:"token"`
+}
+
+// AuthRefreshed confirms the connection now runs on the fresh token
+type AuthRefreshed struct {
+	ExpiresAt int64 `json:"expires_at,omitempty"` // unix millis, missing for tokens that do not expire
+}
+
+// SessionWelcome is sent first on every connection with the token to resume its session after a reconnect
+type SessionWelcome struct {
+	ResumeToken string `json:"resume_token"`
+	Seq         int64  `json:"seq"`     // sequence number of the last event of the user
+	Resumed     bool   `json:"resumed"` // the missed events follow when true
+}
+
+// SessionResync tells the client the missed events cannot be replayed and it has to fetch its state again
+type SessionResync struct {
+	Reason  string `json:"reason"`
+	LastSeq int64  `json:"last_seq"`
+	Seq     int64  `json:"seq"`
+}
+
+// ErrorPayload is the payload of an error frame
+type ErrorPayload struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
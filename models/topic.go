@@ -0,0 +1,19 @@
+package models
+
+import "encoding/json"
+
+// Subscribe is the payload of subscribe and unsubscribe, topics of subscribe can be patterns
+type Subscribe struct {
+	Topics []string `json:"topics"`
+}
+
+// Subscribed lists the topic patterns the connection is subscribed to, in reply to subscribe and unsubscribe
+type Subscribed struct {
+	Topics []string `json:"topics"`
+}
+
+// Publish is the payload of publish, subscribers get the payload as topic.message
+type Publish struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
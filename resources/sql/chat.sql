@@ -0,0 +1,40 @@
+-- schema of the mysql chat message store
+
+CREATE TABLE IF NOT EXISTS chat_messages (
+    id              BIGINT       NOT NULL AUTO_INCREMENT,
+    message_id      CHAR(36)     NOT NULL,
+    conversation_id VARCHAR(300) NOT NULL,
+    sender_id       VARCHAR(128) NOT NULL,
+    recipient_id    VARCHAR(128) NOT NULL,
+    body            TEXT         NOT NULL,
+    client_msg_id   VARCHAR(64)  NULL,
+    sent_at         BIGINT       NOT NULL,
+    -- user who sent the message as the sender, when impersonated
+    actor           VARCHAR(128) NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uk_chat_messages_message_id (message_id),
+    KEY idx_chat_messages_conversation (conversation_id, id)
+);
+
+-- tables created before impersonation need the actor column
+-- ALTER TABLE chat_messages ADD COLUMN actor VARCHAR(128) NULL AFTER sent_at;
+
+-- messages waiting for recipients that were offline when they were sent
+CREATE TABLE IF NOT EXISTS chat_offline_queue (
+    id         BIGINT       NOT NULL AUTO_INCREMENT,
+    user_id    VARCHAR(128) NOT NULL,
+    message_id CHAR(36)     NOT NULL,
+    created_at BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uk_chat_offline_queue_user_message (user_id, message_id)
+);
+
+-- delivery status of a message for each recipient
+CREATE TABLE IF NOT EXISTS chat_message_receipts (
+    message_id CHAR(36)     NOT NULL,
+    user_id    VARCHAR(128) NOT NULL,
+    status     VARCHAR(16)  NOT NULL,
+    updated_at BIGINT       NOT NULL,
+    PRIMARY KEY (message_id, user_id),
+    CONSTRAINT fk_chat_message_receipts_message FOREIGN KEY (message_id) REFERENCES chat_messages (message_id)
+);
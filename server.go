@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/smartpet/websocket/business"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/utils"
+	"github.com/smartpet/websocket/utils/configs"
+	"github.com/smartpet/websocket/utils/flags"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+const (
+	defaultShutdownTimeout      = 20 * time.Second
+	defaultShutdownHooksTimeout = 10 * time.Second
+	defaultTLSPort              = 8443
+	defaultInternalPort         = 8002
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+
+// addShutdownHook registers a hook to be run after the connections are drained, hooks run in the order they were added
+func addShutdownHook(name string, fn func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+func newServer() *http.Server {
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", flags.Port()),
+		Handler: http.DefaultServeMux,
+	}
+}
+
+// initTLS returns the configurations of the public and the internal TLS listeners, nil when no certificate is
+// configured. Client certificates are only asked for by the internal listener.
+func initTLS() (public *tls.Config, internal *tls.Config) {
+	public, internal, err := utils.InitTLS(context.Background())
+	if err != nil {
+		log.ApplicationFatal(context.Background()).Err(err).Msg("error loading tls")
+	}
+	return public, internal
+}
+
+// newTLSServer returns the server of the TLS listener, nil when no certificate is configured
+func newTLSServer(cfg *tls.Config) *http.Server {
+	if cfg == nil {
+		return nil
+	}
+	return &http.Server{
+		Addr:      fmt.Sprintf(":%d", configs.GetAppConfigIntD(constant.TLSPortKey, defaultTLSPort)),
+		Handler:   http.DefaultServeMux,
+		TLSConfig: cfg,
+	}
+}
+
+// newInternalServer returns the server of the internal listener, serving the routes of the other backend services
+// apart from the public sockets. It serves TLS, and so verifies client certificates, when a certificate is configured.
+func newInternalServer(cfg *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      fmt.Sprintf(":%d", configs.GetAppConfigIntD(constant.InternalPortKey, defaultInternalPort)),
+		Handler:   internalMux,
+		TLSConfig: cfg,
+	}
+}
+
+// serve runs the servers until SIGINT or SIGTERM is received and then shuts them down gracefully, nil servers are skipped
+func serve(servers ...*http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var running []*http.Server
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		running = append(running, server)
+		go func(server *http.Server) {
+			log.ApplicationInfo(context.Background()).Str("addr", server.Addr).Bool("tls", server.TLSConfig != nil).Msg("server started")
+			var err error
+			if server.TLSConfig != nil {
+				// the certificate comes from the TLSConfig
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.ApplicationFatal(context.Background()).Err(err).Msg("error starting server")
+			}
+		}(server)
+	}
+
+	<-ctx.Done()
+	stop()
+	shutdown(running...)
+}
+
+// shutdown drains the connections and stops the servers within the shutdown timeout, the hooks then get a deadline
+// of their own so a slow drain does not leave them without time to flush
+func shutdown(servers ...*http.Server) {
+	timeout := time.Duration(configs.GetAppConfigIntD(constant.SocketShutdownTimeoutInMillisKey, int(defaultShutdownTimeout.Milliseconds()))) * time.Millisecond
+	hooksTimeout := time.Duration(configs.GetAppConfigIntD(constant.SocketShutdownHooksTimeoutInMillisKey, int(defaultShutdownHooksTimeout.Milliseconds()))) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	log.ApplicationInfo(ctx).Dur("timeout", timeout).Dur("hooksTimeout", hooksTimeout).Msg("shutting down server")
+
+	// stop accepting upgrades and drain the sockets first, hijacked connections are not tracked by the server
+	business.Shutdown(ctx)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.ApplicationError(ctx).Err(err).Str("addr", server.Addr).Msg("error shutting down server")
+		}
+	}
+	cancel()
+
+	hooksCtx, cancelHooks := context.WithTimeout(context.Background(), hooksTimeout)
+	defer cancelHooks()
+	for _, hook := range shutdownHooks {
+		if err := hook.fn(hooksCtx); err != nil {
+			log.ApplicationError(hooksCtx).Err(err).Str("hook", hook.name).Msg("error running shutdown hook")
+		}
+	}
+	log.ApplicationInfo(hooksCtx).Msg("server stopped")
+}
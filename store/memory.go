@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+// memoryStore keeps everything in the process, it is meant for tests and local runs
+type memoryStore struct {
+	mu       sync.RWMutex
+	cursor   int64
+	messages []models.ChatMessage         // ordered by cursor
+	byID     map[string]int               // message id to index in messages
+	statuses map[string]map[string]string // message id to the status for each recipient
+	queues   map[string][]string          // user id to queued message ids, oldest first
+}
+
+// NewMemoryStore is used to create an empty in-memory message store
+func NewMemoryStore() MessageStore {
+	return &memoryStore{
+		byID:     make(map[string]int),
+		queues:   make(map[string][]string),
+		statuses: make(map[string]map[string]string),
+	}
+}
+
+func (m *memoryStore) Save(ctx context.Context, msg *models.ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cursor++
+	msg.Cursor = m.cursor
+	m.byID[msg.ID] = len(m.messages)
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// withStatus fills the status of the message for its recipient, the lock has to be held
+func (m *memoryStore) withStatus(msg models.ChatMessage) models.ChatMessage {
+	msg.Status = constant.MessageStatusSent
+	for _, status := range m.statuses[msg.ID] {
+		if statusRank[status] > statusRank[msg.Status] {
+			msg.Status = status
+		}
+	}
+	return msg
+}
+
+func (m *memoryStore) Get(ctx context.Context, messageID string) (models.ChatMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, ok := m.byID[messageID]
+	if !ok {
+		return models.ChatMessage{}, ErrNotFound
+	}
+	return m.withStatus(m.messages[i]), nil
+}
+
+func (m *memoryStore) SetStatus(ctx context.Context, messageID, userID, status string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[messageID]; !ok {
+		return false, ErrNotFound
+	}
+	statuses, ok := m.statuses[messageID]
+	if !ok {
+		statuses = make(map[string]string)
+		m.statuses[messageID] = statuses
+	}
+	if statusRank[status] <= statusRank[statuses[userID]] {
+		return false, nil
+	}
+	statuses[userID] = status
+	return true, nil
+}
+
+func (m *memoryStore) Enqueue(ctx context.Context, userID, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[messageID]; !ok {
+		return ErrNotFound
+	}
+	for _, id := range m.queues[userID] {
+		if id == messageID {
+			return nil
+		}
+	}
+	m.queues[userID] = append(m.queues[userID], messageID)
+	return nil
+}
+
+func (m *memoryStore) Pending(ctx context.Context, userID string, limit int) ([]models.ChatMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	queue := m.queues[userID]
+	result := make([]models.ChatMessage, 0, len(queue))
+	for _, id := range queue {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, m.withStatus(m.messages[m.byID[id]]))
+	}
+	return result, nil
+}
+
+func (m *memoryStore) Dequeue(ctx context.Context, userID string, messageIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	remove := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		remove[id] = true
+	}
+	queue := m.queues[userID][:0]
+	for _, id := range m.queues[userID] {
+		if !remove[id] {
+			queue = append(queue, id)
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.queues, userID)
+		return nil
+	}
+	m.queues[userID] = queue
+	return nil
+}
+
+func (m *memoryStore) History(ctx context.Context, conversationID string, before int64, limit int) ([]models.ChatMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var result []models.ChatMessage
+	for i := len(m.messages) - 1; i >= 0 && len(result) < limit; i-- {
+		msg := m.messages[i]
+		if msg.ConversationID != conversationID || (before > 0 && msg.Cursor >= before) {
+			continue
+		}
+		result = append(result, m.withStatus(msg))
+	}
+	return result, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
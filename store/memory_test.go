@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+// saveMessages saves n messages alternating between conversations a and b, so a holds the odd cursors
+func saveMessages(t *testing.T, s MessageStore, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		conversation := "a"
+		if i%2 == 0 {
+			conversation = "b"
+		}
+		msg := &models.ChatMessage{ID: fmt.Sprintf("m%d", i), ConversationID: conversation, From: "1", To: "2", Text: "hi"}
+		if err := s.Save(context.Background(), msg); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+}
+
+func cursors(messages []models.ChatMessage) []int64 {
+	result := []int64{}
+	for _, msg := range messages {
+		result = append(result, msg.Cursor)
+	}
+	return result
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	s := NewMemoryStore()
+	saveMessages(t, s, 10)
+
+	tests := []struct {
+		name         string
+		conversation string
+		before       int64
+		limit        int
+		want         []int64
+	}{
+		{name: "latest page", conversation: "a", limit: 2, want: []int64{9, 7}},
+		{name: "next page from cursor", conversation: "a", before: 7, limit: 2, want: []int64{5, 3}},
+		{name: "last short page", conversation: "a", before: 3, limit: 2, want: []int64{1}},
+		{name: "before the first message", conversation: "a", before: 1, limit: 2, want: []int64{}},
+		{name: "cursor of the other conversation", conversation: "b", before: 7, limit: 5, want: []int64{6, 4, 2}},
+		{name: "unknown conversation", conversation: "c", limit: 5, want: []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.History(context.Background(), tt.conversation, tt.before, tt.limit)
+			if err != nil {
+				t.Fatalf("history: %v", err)
+			}
+			if !reflect.DeepEqual(cursors(got), tt.want) {
+				t.Errorf("cursors = %v, want %v", cursors(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreHistoryPagesThroughEverything(t *testing.T) {
+	s := NewMemoryStore()
+	saveMessages(t, s, 9)
+
+	var seen []int64
+	before := int64(0)
+	for {
+		page, err := s.History(context.Background(), "a", before, 2)
+		if err != nil {
+			t.Fatalf("history: %v", err)
+		}
+		seen = append(seen, cursors(page)...)
+		if len(page) < 2 {
+			break
+		}
+		before = page[len(page)-1].Cursor
+	}
+	if want := []int64{9, 7, 5, 3, 1}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("cursors = %v, want %v", seen, want)
+	}
+}
+
+func TestMemoryStoreOfflineQueue(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	saveMessages(t, s, 3)
+
+	if err := s.Enqueue(ctx, "2", "unknown"); err != ErrNotFound {
+		t.Fatalf("enqueue of an unknown message = %v, want %v", err, ErrNotFound)
+	}
+	for _, id := range []string{"m1", "m2", "m1", "m3"} {
+		if err := s.Enqueue(ctx, "2", id); err != nil {
+			t.Fatalf("enqueue %s: %v", id, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		dequeue []string
+		limit   int
+		want    []string
+	}{
+		{name: "queued once in order", limit: 10, want: []string{"m1", "m2", "m3"}},
+		{name: "limited", limit: 2, want: []string{"m1", "m2"}},
+		{name: "after dequeue", dequeue: []string{"m2"}, limit: 10, want: []string{"m1", "m3"}},
+		{name: "empty", dequeue: []string{"m1", "m3"}, limit: 10, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Dequeue(ctx, "2", tt.dequeue); err != nil {
+				t.Fatalf("dequeue: %v", err)
+			}
+			pending, err := s.Pending(ctx, "2", tt.limit)
+			if err != nil {
+				t.Fatalf("pending: %v", err)
+			}
+			got := []string{}
+			for _, msg := range pending {
+				got = append(got, msg.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSetStatus(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	saveMessages(t, s, 1)
+
+	tests := []struct {
+		name        string
+		messageID   string
+		status      string
+		wantChanged bool
+		wantErr     error
+		wantStatus  string
+	}{
+		{name: "delivered", messageID: "m1", status: constant.MessageStatusDelivered, wantChanged: true, wantStatus: constant.MessageStatusDelivered},
+		{name: "read", messageID: "m1", status: constant.MessageStatusRead, wantChanged: true, wantStatus: constant.MessageStatusRead},
+		{name: "never moves back", messageID: "m1", status: constant.MessageStatusDelivered, wantStatus: constant.MessageStatusRead},
+		{name: "unknown message", messageID: "unknown", status: constant.MessageStatusRead, wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := s.SetStatus(ctx, tt.messageID, "2", tt.status)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			msg, err := s.Get(ctx, tt.messageID)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if msg.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", msg.Status, tt.wantStatus)
+			}
+		})
+	}
+}
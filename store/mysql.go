@@ -0,0 +1,212 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/metrics"
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+// queries of the mysql store, the schema is in resources/sql/chat.sql
+const (
+	insertMessageQuery = `INSERT INTO chat_messages (message_id, conversation_id, sender_id, recipient_id, body, client_msg_id, sent_at, actor)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	enqueueQuery = `INSERT IGNORE INTO chat_offline_queue (user_id, message_id, created_at)
+		SELECT ?, message_id, ? FROM chat_messages WHERE message_id = ?`
+	// the status of a message is the furthest status of any of its recipients, sent when there is none yet
+	messageColumns = `m.id, m.message_id, m.conversation_id, m.sender_id, m.recipient_id, m.body, m.client_msg_id, m.sent_at, m.actor,
+		COALESCE((SELECT r.status FROM chat_message_receipts r WHERE r.message_id = m.message_id
+			ORDER BY FIELD(r.status, 'sent', 'delivered', 'read') DESC LIMIT 1), 'sent')`
+	getMessageQuery = `SELECT ` + messageColumns + ` FROM chat_messages m WHERE m.message_id = ?`
+	pendingQuery    = `SELECT ` + messageColumns + ` FROM chat_offline_queue q JOIN chat_messages m ON m.message_id = q.message_id
+		WHERE q.user_id = ? ORDER BY q.id LIMIT ?`
+	dequeueQuery = `DELETE FROM chat_offline_queue WHERE user_id = ? AND message_id IN (%s)`
+	historyQuery = `SELECT ` + messageColumns + ` FROM chat_messages m WHERE m.conversation_id = ? AND m.id < ? ORDER BY m.id DESC LIMIT ?`
+	// only moves the status forward, affects 1 row on insert, 2 on change and 0 when unchanged
+	setStatusQuery = `INSERT INTO chat_message_receipts (message_id, user_id, status, updated_at) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			updated_at = IF(FIELD(VALUES(status), 'sent', 'delivered', 'read') > FIELD(status, 'sent', 'delivered', 'read'), VALUES(updated_at), updated_at),
+			status = IF(FIELD(VALUES(status), 'sent', 'delivered', 'read') > FIELD(status, 'sent', 'delivered', 'read'), VALUES(status), status)`
+)
+
+// maximum cursor, used when the history starts from the latest message
+const latestCursor = int64(1<<63 - 1)
+
+// mysql error number of a row referencing a missing parent row
+const foreignKeyViolation = 1452
+
+type mysqlStore struct {
+	db *sql.DB
+}
+
+// NewMySQLStore is used to create a message store on the mysql server configured under name in database.yml
+func NewMySQLStore(ctx context.Context, name string) (MessageStore, error) {
+	dbConfig, err := configs.Get(constant.DatabaseConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := dbConfig.Sub(name)
+	if serverConfig == nil {
+		return nil, fmt.Errorf("database config %s not found", name)
+	}
+
+	driverConfig := mysql.NewConfig()
+	driverConfig.User = configs.GetStringWithEnv(serverConfig.GetString(constant.DatabaseUsernameConfigKey))
+	driverConfig.Passwd = configs.GetStringWithEnv(serverConfig.GetString(constant.DatabasePasswordConfigKey))
+	driverConfig.Net = "tcp"
+	driverConfig.Addr = fmt.Sprintf("%s:%d", configs.GetStringWithEnv(serverConfig.GetString(constant.DatabaseServerConfigKey)),
+		serverConfig.GetInt(constant.DatabasePortConfigKey))
+	driverConfig.DBName = configs.GetStringWithEnv(serverConfig.GetString(constant.DatabaseNameConfigKey))
+
+	db, err := sql.Open(constant.MySqlServerDriverName, driverConfig.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(serverConfig.GetInt(constant.DatabaseMaxOpenConnectionsKey))
+	db.SetMaxIdleConns(serverConfig.GetInt(constant.DatabaseMaxIdleConnectionsKey))
+	db.SetConnMaxLifetime(time.Duration(serverConfig.GetInt(constant.DatabaseConnectionMaxLifetimeInSecondsKey)) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(serverConfig.GetInt(constant.DatabaseConnectionMaxIdleTimeInSecondsKey)) * time.Second)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &mysqlStore{db: db}, nil
+}
+
+func (s *mysqlStore) Save(ctx context.Context, msg *models.ChatMessage) error {
+	timer := metrics.GetDBQueryTimer("chatSaveMessage")
+	defer timer.ObserveDuration()
+	result, err := s.db.ExecContext(ctx, insertMessageQuery, msg.ID, msg.ConversationID, msg.From, msg.To, msg.Text,
+		nullString(msg.ClientMsgID), msg.SentAt, nullString(msg.Actor))
+	if err != nil {
+		return err
+	}
+	msg.Cursor, err = result.LastInsertId()
+	return err
+}
+
+func (s *mysqlStore) Get(ctx context.Context, messageID string) (models.ChatMessage, error) {
+	timer := metrics.GetDBQueryTimer("chatGetMessage")
+	defer timer.ObserveDuration()
+	rows, err := s.db.QueryContext(ctx, getMessageQuery, messageID)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	if len(messages) == 0 {
+		return models.ChatMessage{}, ErrNotFound
+	}
+	return messages[0], nil
+}
+
+func (s *mysqlStore) SetStatus(ctx context.Context, messageID, userID, status string) (bool, error) {
+	timer := metrics.GetDBQueryTimer("chatSetStatus")
+	defer timer.ObserveDuration()
+	result, err := s.db.ExecContext(ctx, setStatusQuery, messageID, userID, status, time.Now().UnixMilli())
+	if err != nil {
+		// the receipt references the message
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == foreignKeyViolation {
+			return false, ErrNotFound
+		}
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (s *mysqlStore) Enqueue(ctx context.Context, userID, messageID string) error {
+	timer := metrics.GetDBQueryTimer("chatEnqueueMessage")
+	defer timer.ObserveDuration()
+	result, err := s.db.ExecContext(ctx, enqueueQuery, userID, time.Now().UnixMilli(), messageID)
+	if err != nil {
+		return err
+	}
+	// zero rows is either an unknown message or one already queued
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM chat_messages WHERE message_id = ?)", messageID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) Pending(ctx context.Context, userID string, limit int) ([]models.ChatMessage, error) {
+	timer := metrics.GetDBQueryTimer("chatPendingMessages")
+	defer timer.ObserveDuration()
+	rows, err := s.db.QueryContext(ctx, pendingQuery, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *mysqlStore) Dequeue(ctx context.Context, userID string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	timer := metrics.GetDBQueryTimer("chatDequeueMessages")
+	defer timer.ObserveDuration()
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, userID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(dequeueQuery, placeholders), args...)
+	return err
+}
+
+func (s *mysqlStore) History(ctx context.Context, conversationID string, before int64, limit int) ([]models.ChatMessage, error) {
+	timer := metrics.GetDBQueryTimer("chatHistory")
+	defer timer.ObserveDuration()
+	if before <= 0 {
+		before = latestCursor
+	}
+	rows, err := s.db.QueryContext(ctx, historyQuery, conversationID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *mysqlStore) Close() error {
+	return s.db.Close()
+}
+
+func scanMessages(rows *sql.Rows) ([]models.ChatMessage, error) {
+	defer rows.Close()
+	var result []models.ChatMessage
+	for rows.Next() {
+		msg := models.ChatMessage{}
+		var clientMsgID, actor sql.NullString
+		if err := rows.Scan(&msg.Cursor, &msg.ID, &msg.ConversationID, &msg.From, &msg.To, &msg.Text, &clientMsgID, &msg.SentAt, &actor, &msg.Status); err != nil {
+			return nil, err
+		}
+		msg.ClientMsgID, msg.Actor = clientMsgID.String, actor.String
+		result = append(result, msg)
+	}
+	return result, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
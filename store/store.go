@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/models"
+)
+
+// ErrNotFound is returned when the message does not exist in the store
+var ErrNotFound = errors.New("message not found")
+
+// statusRank orders the delivery statuses, unknown statuses rank below sent
+var statusRank = map[string]int{
+	constant.MessageStatusSent:      1,
+	constant.MessageStatusDelivered: 2,
+	constant.MessageStatusRead:      3,
+}
+
+// ValidStatus tells if the status is a known delivery status
+func ValidStatus(status string) bool {
+	_, ok := statusRank[status]
+	return ok
+}
+
+// MessageStore persists chat messages and the queue of messages waiting for offline recipients.
+// User ids passed to the store are expected to be normalised by the caller.
+type MessageStore interface {
+	// Save persists the message and sets its cursor
+	Save(ctx context.Context, msg *models.ChatMessage) error
+
+	// Get returns the message with its delivery status
+	Get(ctx context.Context, messageID string) (models.ChatMessage, error)
+
+	// SetStatus moves the delivery status of the message for the recipient forward,
+	// it tells whether the status changed and never moves it back
+	SetStatus(ctx context.Context, messageID, userID, status string) (bool, error)
+
+	// Enqueue queues the message for a recipient that is not online
+	Enqueue(ctx context.Context, userID, messageID string) error
+
+	// Pending returns up to limit messages queued for the user, oldest first
+	Pending(ctx context.Context, userID string, limit int) ([]models.ChatMessage, error)
+
+	// Dequeue removes the messages from the queue of the user
+	Dequeue(ctx context.Context, userID string, messageIDs []string) error
+
+	// History returns up to limit messages of the conversation older than the before cursor, newest first.
+	// A before cursor of zero starts from the latest message.
+	History(ctx context.Context, conversationID string, before int64, limit int) ([]models.ChatMessage, error)
+
+	// Close releases the resources held by the store
+	Close() error
+}
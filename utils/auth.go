@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/smartpet/websocket/constant"
 	"github.com/smartpet/websocket/models"
 	"github.com/smartpet/websocket/utils/configs"
 	log "github.com/smartpet/websocket/utils/logger"
@@ -23,7 +25,10 @@ type Claims struct {
 	SourceID      string
 }
 
-func GenerateJWTAccessToken(userData models.TokenUserData) (string, error) {
+// GenerateJWTAccessToken signs a 30 minutes token of the user with jwt_key. The user type and scopes are the claims
+// the authorization policy checks, a token without them only gets what the policy grants to everyone. The token has
+// a random id and its issue time, so it can be revoked alone and a user revoked earlier can use it.
+func GenerateJWTAccessToken(userData models.TokenUserData, userType string, scopes ...string) (string, error) {
 
 	jwtSigninKey, err := configs.GetAppConfig("jwt_key", true)
 	if err != nil {
@@ -36,10 +41,13 @@ func GenerateJWTAccessToken(userData models.TokenUserData) (string, error) {
 
 	tokenData := jwt.New(jwt.GetSigningMethod("HS256"))
 	// prepare claims for token
+	now := time.Now()
 	claims := models.JWTLoginToken{
 		StandardClaims: jwt.StandardClaims{
+			Id:       uuid.New().String(),
+			IssuedAt: now.Unix(),
 			// set token lifetime in timestamp
-			ExpiresAt: time.Now().Add(time.Minute * 30).Unix(),
+			ExpiresAt: now.Add(time.Minute * 30).Unix(),
 			Issuer:    "smartpet",
 		},
 
@@ -51,6 +59,10 @@ func GenerateJWTAccessToken(userData models.TokenUserData) (string, error) {
 			AppID:       userData.AppID,
 			CreatedAt:   userData.CreatedAt,
 		},
+		TokenClaims: models.TokenClaims{
+			UserType: userType,
+			Scope:    scopes,
+		},
 	}
 	tokenData.Claims = claims
 
@@ -66,7 +78,7 @@ func GenerateJWTAccessToken(userData models.TokenUserData) (string, error) {
 
 func ValidateJwtAndMatchClientIdCtx(ctx *http.Request, reqBodyclientId string) bool {
 
-	err := AuthorizeSuperUser(ctx, reqBodyclientId) //validateJwtToken(bearerToken[7:], reqBodyclientId)
+	_, err := AuthorizeUser(ctx, reqBodyclientId) //validateJwtToken(bearerToken[7:], reqBodyclientId)
 
 	if err != nil {
 		return false
@@ -75,90 +87,210 @@ func ValidateJwtAndMatchClientIdCtx(ctx *http.Request, reqBodyclientId string) b
 
 }
 
-func AuthorizeSuperUser(ctx *http.Request, partycode string) error {
-	err := validateSupUserToken(ctx, partycode, "Authorization")
+// AuthorizeUser validates the token headers against the partycode and returns the claims of the first valid token
+func AuthorizeUser(ctx *http.Request, partycode string) (*models.JWTLoginToken, error) {
+	claims, err := validateUserToken(ctx, partycode, "Authorization")
 	if err == nil {
-		return nil
+		return claims, nil
 	}
 
-	err = validateSupUserToken(ctx, partycode, "AccessToken")
+	claims, err = validateUserToken(ctx, partycode, "AccessToken")
 	if err == nil {
-		return nil
+		return claims, nil
 	}
 
-	err = validateSupUserToken(ctx, partycode, "Token")
+	claims, err = validateUserToken(ctx, partycode, "Token")
 	if err == nil {
-		return nil
+		return claims, nil
 	}
 
-	return err
+	return nil, err
 }
 
-func isSuperUserToken(clientcode string) (bool, error) {
-
-	SuperUserIface, err := configs.GetAppConfig("superuserkey", true)
-	if err != nil {
-		return false, err
+// AuthenticateUser validates the token headers and returns the claims of the first valid token, the user is the
+// one of the token rather than one named by the caller
+func AuthenticateUser(ctx *http.Request) (*models.JWTLoginToken, error) {
+	err := errors.New("empty token headers")
+	for _, header := range []string{"Authorization", "AccessToken", "Token"} {
+		auth := strings.TrimSpace(strings.TrimPrefix(ctx.Header.Get(header), "Bearer "))
+		if auth == "" {
+			continue
+		}
+		var claims *models.JWTLoginToken
+		if claims, err = DecodeUserTokenClaims(auth); err != nil {
+			continue
+		}
+		if strings.TrimSpace(claims.UserData.UserID) == "" {
+			err = fmt.Errorf("%v has no user id", header)
+			continue
+		}
+		return claims, nil
 	}
-	SuperUserKey := fmt.Sprintf("%v", SuperUserIface)
-
-	log.Info(context.Background()).Msg("supper key " + SuperUserKey)
-
-	return clientcode == SuperUserKey, nil
-
+	return nil, err
 }
 
-func validateSupUserToken(ctx *http.Request, partycode, header string) error {
+// validateUserToken validates the token of the header and checks it belongs to the partycode. Acting as another
+// user takes a token issued for that user with an act claim, see authorizeActor.
+func validateUserToken(ctx *http.Request, partycode, header string) (*models.JWTLoginToken, error) {
 	partycode = strings.ToUpper(partycode)
 	auth := ctx.Header.Get(header)
 	if auth == "" {
-		return fmt.Errorf("empty header: %v", header)
-	}
-	authData, err := DecodeUserToken(auth)
-	if err != nil {
-		return err
+		return nil, fmt.Errorf("empty header: %v", header)
 	}
-	clientcode := strings.ToUpper(strings.TrimSpace(authData.UserID))
-	isSupe, err := isSuperUserToken(clientcode)
+	claims, err := DecodeUserTokenClaims(auth)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if clientcode != partycode && !isSupe {
-		return fmt.Errorf("%v data not valid for partycode: %v", header, partycode)
+	clientcode := strings.ToUpper(strings.TrimSpace(claims.UserData.UserID))
+	if clientcode != partycode {
+		return nil, fmt.Errorf("%v data not valid for partycode: %v", header, partycode)
 	}
-	return nil
+	return claims, nil
 }
 
 func DecodeUserToken(tokenID string) (models.TokenUserData, error) {
+	claims, err := DecodeUserTokenClaims(tokenID)
+	if err != nil {
+		return models.TokenUserData{}, err
+	}
+	return claims.UserData, nil
+}
+
+// DecodeUserTokenClaims verifies the token and returns all of its claims. HS256 tokens are verified with jwt_key,
+// RS256, ES256 and EdDSA tokens with the key of their key id from the key provider.
+func DecodeUserTokenClaims(tokenID string) (*models.JWTLoginToken, error) {
 	var (
 		claim = &models.JWTLoginToken{}
 		ok    bool
 	)
 
-	jwtSigninKey, err := configs.GetAppConfig("jwt_key", true)
+	token, err := jwt.ParseWithClaims(tokenID, claim, userTokenKey, jwt.WithValidMethods(userTokenMethods))
 	if err != nil {
-		log.Error(context.Background()).Err(err).Msg(
-			"error getting auth config")
-		return models.TokenUserData{}, err
+		return nil, err
 	}
 
-	//jwtSigninKey = configs.GetStringWithEnv(jwtSigninKey)
+	if claim, ok = token.Claims.(*models.JWTLoginToken); !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	userData := claim.UserData
+
+	if userData.UserID == "" && userData.MobileNo == "" {
+		return nil, errors.New("user data not found in requested token")
+	}
+	if err := authorizeActor(claim); err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
 
-	token, err := jwt.ParseWithClaims(tokenID, claim, func(token *jwt.Token) (interface{}, error) {
+// authorizeActor checks a token acting as its user holds one of the impersonation scopes, no token can act as
+// another user when none are configured
+func authorizeActor(claims *models.JWTLoginToken) error {
+	if claims.Act == nil {
+		return nil
+	}
+	actor := strings.TrimSpace(claims.Act.Subject)
+	if actor == "" {
+		return errors.New("act claim without subject")
+	}
+	if strings.EqualFold(actor, strings.TrimSpace(claims.UserData.UserID)) {
+		return errors.New("actor cannot act as itself")
+	}
+	for _, scope := range configs.GetAppConfigStringsD(constant.ImpersonationScopesKey, nil) {
+		for _, granted := range claims.Scope {
+			if scope == granted {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%v is not allowed to act as another user", actor)
+}
+
+// signing algorithms of the user tokens
+var userTokenMethods = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+// userTokenKey returns the key verifying the user token, picked by the kid header, or the kid claim when the header has none
+func userTokenKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		jwtSigninKey, err := configs.GetAppConfig("jwt_key", true)
+		if err != nil {
+			log.Error(context.Background()).Err(err).Msg(
+				"error getting auth config")
+			return nil, err
+		}
 		return []byte(jwtSigninKey), nil
-	})
-	if err != nil {
-		return models.TokenUserData{}, err
 	}
 
-	if claim, ok = token.Claims.(*models.JWTLoginToken); !ok || !token.Valid {
-		return models.TokenUserData{}, errors.New("invalid token")
+	if keyProvider == nil {
+		return nil, fmt.Errorf("no key provider for signing method: %v", token.Method.Alg())
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if claims, ok := token.Claims.(*models.JWTLoginToken); ok {
+			kid = claims.KeyId
+		}
 	}
+	key, alg, err := keyProvider.Key(context.Background(), kid)
+	if err != nil {
+		return nil, err
+	}
+	// a key meant for one algorithm is not used with another
+	if alg != "" && alg != token.Method.Alg() {
+		return nil, fmt.Errorf("key %v is not meant for %v", kid, token.Method.Alg())
+	}
+	return key, nil
+}
 
-	userData := claim.UserData
+// AuthorizeService validates the service to service token of the Authorization header. The token has to be signed
+// with s2s_key, expire, carry the audience and come from one of the allowed issuers, any issuer when none are given.
+func AuthorizeService(ctx *http.Request, audience string, allowedIssuers []string) (*models.ServiceClaims, error) {
+	auth := strings.TrimSpace(strings.TrimPrefix(ctx.Header.Get("Authorization"), "Bearer "))
+	if auth == "" {
+		return nil, errors.New("empty header: Authorization")
+	}
+	s2sKey, err := configs.GetAppConfig("s2s_key", true)
+	if err != nil {
+		return nil, err
+	}
+	if s2sKey == "" {
+		return nil, errors.New("s2s_key is not configured")
+	}
 
-	if userData.UserID == "" && userData.MobileNo == "" {
-		return models.TokenUserData{}, errors.New("user data not found in requested token")
+	claims := &models.ServiceClaims{}
+	token, err := jwt.ParseWithClaims(auth, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(s2sKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("service token without expiry")
+	}
+	if claims.Issuer == "" {
+		return nil, errors.New("service token without issuer")
+	}
+	if audience != "" && !claims.VerifyAudience(audience, true) {
+		return nil, fmt.Errorf("service token not issued for %v", audience)
+	}
+	if len(allowedIssuers) == 0 {
+		return claims, nil
+	}
+	for _, issuer := range allowedIssuers {
+		if claims.Issuer == issuer {
+			return claims, nil
+		}
 	}
-	return userData, nil
+	return nil, fmt.Errorf("issuer not allowed: %v", claims.Issuer)
 }
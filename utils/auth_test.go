@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/smartpet/websocket/models"
+	"github.com/smartpet/websocket/utils/configs"
+)
+
+func TestGenerateJWTAccessToken(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "application.yml"), []byte(`jwt_key: "${JWTKEY}"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWTKEY", "secret")
+	configs.Init(dir)
+
+	tests := []struct {
+		name     string
+		userType string
+		scopes   []string
+	}{
+		{name: "user type and scopes", userType: "provider", scopes: []string{"chat.send", "slots.publish"}},
+		{name: "user type only", userType: "parent"},
+		{name: "neither"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := GenerateJWTAccessToken(models.TokenUserData{UserID: "42"}, tt.userType, tt.scopes...)
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			claims, err := DecodeUserTokenClaims(token)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if claims.UserData.UserID != "42" {
+				t.Errorf("user id = %s, want 42", claims.UserData.UserID)
+			}
+			if claims.Id == "" || claims.IssuedAt == 0 {
+				t.Errorf("token id %q issued at %d, want both set", claims.Id, claims.IssuedAt)
+			}
+			if claims.UserType != tt.userType {
+				t.Errorf("user type = %s, want %s", claims.UserType, tt.userType)
+			}
+			if len(claims.Scope) != 0 || len(tt.scopes) != 0 {
+				if !reflect.DeepEqual([]string(claims.Scope), tt.scopes) {
+					t.Errorf("scopes = %v, want %v", claims.Scope, tt.scopes)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeActor(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "application.yml"), []byte(`impersonation:
+    scopes: ["support.impersonate"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configs.Init(dir)
+
+	tests := []struct {
+		name    string
+		actor   *models.Actor
+		scopes  []string
+		wantErr bool
+	}{
+		{name: "no act claim"},
+		{name: "actor with the scope", actor: &models.Actor{Subject: "support-7"}, scopes: []string{"chat.send", "support.impersonate"}},
+		{name: "actor without the scope", actor: &models.Actor{Subject: "support-7"}, scopes: []string{"chat.send"}, wantErr: true},
+		{name: "act claim without subject", actor: &models.Actor{Subject: " "}, scopes: []string{"support.impersonate"}, wantErr: true},
+		{name: "actor acting as itself", actor: &models.Actor{Subject: "USER-42"}, scopes: []string{"support.impersonate"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &models.JWTLoginToken{UserData: models.TokenUserData{UserID: "user-42"}}
+			claims.Act, claims.Scope = tt.actor, tt.scopes
+			if err := authorizeActor(claims); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -23,6 +23,9 @@ func GetCache() *ttlcache.Cache[string, interface{}] {
 }
 
 func CloseCache() {
+	if cache == nil {
+		return
+	}
 	cache.Stop()
 }
 
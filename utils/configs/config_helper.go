@@ -69,3 +69,48 @@ func GetConfigWithValue(config string, appname string, service string) (string,
 	}
 	return value.(string), nil
 }
+
+// GetAppConfigD returns the application config value, or the default when it is not set
+func GetAppConfigD(key, defaultValue string) string {
+	appConfig, err := Get(constant.ApplicationConfig)
+	if err != nil || !appConfig.IsSet(key) {
+		return defaultValue
+	}
+	return appConfig.GetString(key)
+}
+
+// GetAppConfigIntD returns the application config value as int, or the default when it is not set
+func GetAppConfigIntD(key string, defaultValue int) int {
+	appConfig, err := Get(constant.ApplicationConfig)
+	if err != nil || !appConfig.IsSet(key) {
+		return defaultValue
+	}
+	return appConfig.GetInt(key)
+}
+
+// GetAppConfigBoolD returns the application config value as bool, or the default when it is not set
+func GetAppConfigBoolD(key string, defaultValue bool) bool {
+	appConfig, err := Get(constant.ApplicationConfig)
+	if err != nil || !appConfig.IsSet(key) {
+		return defaultValue
+	}
+	return appConfig.GetBool(key)
+}
+
+// UnmarshalAppConfig decodes the application config section under key into v, leaving v untouched when it is not set
+func UnmarshalAppConfig(key string, v interface{}) error {
+	appConfig, err := Get(constant.ApplicationConfig)
+	if err != nil || !appConfig.IsSet(key) {
+		return nil
+	}
+	return appConfig.UnmarshalKey(key, v)
+}
+
+// GetAppConfigStringsD returns the application config list, or the default when it is not set
+func GetAppConfigStringsD(key string, defaultValue []string) []string {
+	appConfig, err := Get(constant.ApplicationConfig)
+	if err != nil || !appConfig.IsSet(key) {
+		return defaultValue
+	}
+	return appConfig.GetStringSlice(key)
+}
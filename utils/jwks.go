@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+// an unknown key id makes the document be fetched again, at most this often
+const jwksMinRefreshInterval = 30 * time.Second
+
+// key of the refreshes of unknown key ids in the singleflight group
+const jwksUnknownKeyRefresh = "unknown-kid"
+
+// largest JWKS document read from an url, a key set holds a few keys
+const jwksMaxBytes = 1 << 20
+
+// ErrUnknownKey is returned for a key id that is not in the key set
+var ErrUnknownKey = errors.New("unknown key id")
+
+// KeyProvider returns the public key verifying the tokens signed with the key id, with the algorithm it is meant for
+// when the key set tells it
+type KeyProvider interface {
+	Key(ctx context.Context, kid string) (crypto.PublicKey, string, error)
+}
+
+// verifies the asymmetrically signed user tokens, tokens can only be signed with jwt_key without one
+var keyProvider KeyProvider
+
+// SetKeyProvider replaces the provider of the keys verifying the user tokens
+func SetKeyProvider(p KeyProvider) {
+	keyProvider = p
+}
+
+// jwk is one key of a JWKS document, only the fields of RSA, EC and OKP public keys are read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type verificationKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// JWKSProvider serves the keys of a JWKS document read from a file or an http url. The document is read again
+// in the background and whenever a token names a key it does not have, so signing keys can be rotated by publishing
+// the new key next to the old one before signing with it. The last good key set is kept when reading fails.
+type JWKSProvider struct {
+	source          string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]verificationKey
+	lastRefresh time.Time
+	// serialises the reads of the document
+	refreshMu sync.Mutex
+	// tokens with unknown key ids arriving together share a single read of the document
+	unknownKeys singleflight.Group
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewJWKSProvider reads the document from the source, a file path or an http(s) url, and refreshes it every refreshInterval
+func NewJWKSProvider(ctx context.Context, source string, refreshInterval, timeout time.Duration) (*JWKSProvider, error) {
+	p := &JWKSProvider{
+		source:          source,
+		client:          &http.Client{Timeout: timeout},
+		refreshInterval: refreshInterval,
+		keys:            make(map[string]verificationKey),
+		stop:            make(chan struct{}),
+	}
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if refreshInterval > 0 {
+		go p.refreshLoop()
+	}
+	return p, nil
+}
+
+// Key returns the key with the key id, reading the document again when the key is unknown
+func (p *JWKSProvider) Key(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	if key, ok := p.lookup(kid); ok {
+		return key.key, key.alg, nil
+	}
+	p.refreshUnknown(ctx)
+	if key, ok := p.lookup(kid); ok {
+		return key.key, key.alg, nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrUnknownKey, kid)
+}
+
+// refreshUnknown reads the document again for a key id it does not have, unless it was read within
+// jwksMinRefreshInterval. Concurrent callers wait for the same read, which is not cancelled by any of them.
+func (p *JWKSProvider) refreshUnknown(ctx context.Context) {
+	p.unknownKeys.Do(jwksUnknownKeyRefresh, func() (interface{}, error) {
+		p.mu.RLock()
+		recent := time.Since(p.lastRefresh) < jwksMinRefreshInterval
+		p.mu.RUnlock()
+		if recent {
+			return nil, nil
+		}
+		if err := p.refresh(context.WithoutCancel(ctx)); err != nil {
+			log.ApplicationError(ctx).Err(err).Str("source", p.source).Msg("error refreshing jwks")
+		}
+		return nil, nil
+	})
+}
+
+// Close stops the background refresh
+func (p *JWKSProvider) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+func (p *JWKSProvider) lookup(kid string) (verificationKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *JWKSProvider) refreshLoop() {
+	ticker := time.NewTicker(p.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.refresh(context.Background()); err != nil {
+				log.ApplicationError(context.Background()).Err(err).Str("source", p.source).Msg("error refreshing jwks")
+			}
+		}
+	}
+}
+
+// refresh reads the document and replaces the key set, keys that cannot be used are skipped
+func (p *JWKSProvider) refresh(ctx context.Context) error {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	data, err := p.read(ctx)
+	// failed reads count as well, so a broken source is not hit by every token with an unknown key
+	p.mu.Lock()
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	doc := jwks{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	keys := make(map[string]verificationKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.ApplicationWarn(ctx).Err(err).Str("kid", k.Kid).Msg("skipping jwks key")
+			continue
+		}
+		keys[k.Kid] = verificationKey{key: key, alg: k.Alg}
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable key in jwks")
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *JWKSProvider) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(p.source, "http://") && !strings.HasPrefix(p.source, "https://") {
+		return os.ReadFile(p.source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("jwks source returned " + resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > jwksMaxBytes {
+		return nil, fmt.Errorf("jwks document larger than %d bytes", jwksMaxBytes)
+	}
+	return data, nil
+}
+
+// checkJWKSSource refuses the plain http urls, anyone on the network path could replace the keys and sign
+// tokens, unless insecure sources are allowed for local runs
+func checkJWKSSource(source string, allowInsecure bool) error {
+	if strings.HasPrefix(strings.ToLower(source), "http://") && !allowInsecure {
+		return errors.New("jwks source must be a file or an https url: " + source)
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unknown curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unknown key type %s", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// InitJWKS sets up the key provider of the jwks block of application.yml, tokens are only verified with jwt_key
+// when no source is configured
+func InitJWKS(ctx context.Context) error {
+	source := os.ExpandEnv(configs.GetAppConfigD(constant.JWKSSourceKey, ""))
+	if source == "" {
+		return nil
+	}
+	if err := checkJWKSSource(source, configs.GetAppConfigBoolD(constant.JWKSAllowInsecureKey, false)); err != nil {
+		return err
+	}
+	refreshInterval := time.Duration(configs.GetAppConfigIntD(constant.JWKSRefreshIntervalInMillisKey, 300000)) * time.Millisecond
+	timeout := time.Duration(configs.GetAppConfigIntD(constant.JWKSTimeoutInMillisKey, 5000)) * time.Millisecond
+	p, err := NewJWKSProvider(ctx, source, refreshInterval, timeout)
+	if err != nil {
+		return err
+	}
+	SetKeyProvider(p)
+	log.ApplicationInfo(ctx).Str("source", source).Msg("jwks loaded")
+	return nil
+}
+
+// CloseJWKS stops refreshing the jwks
+func CloseJWKS() {
+	if p, ok := keyProvider.(*JWKSProvider); ok {
+		p.Close()
+	}
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a key set holding the key ids, counting the reads of the document
+type jwksServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	kids  []string
+	reads atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &jwksServer{kids: kids}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.reads.Add(1)
+		// slow enough for the concurrent lookups to pile up on the read
+		time.Sleep(20 * time.Millisecond)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		doc := jwks{}
+		for _, kid := range s.kids {
+			doc.Keys = append(doc.Keys, jwk{Kty: "OKP", Crv: "Ed25519", Kid: kid, X: base64.RawURLEncoding.EncodeToString(pub)})
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) publish(kid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kids = append(s.kids, kid)
+}
+
+// age makes the last read of the document older than the minimum interval between reads for unknown key ids
+func age(p *JWKSProvider) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastRefresh = time.Now().Add(-jwksMinRefreshInterval)
+}
+
+func TestJWKSProviderUnknownKey(t *testing.T) {
+	ctx := context.Background()
+	server := newJWKSServer(t, "k1")
+	p, err := NewJWKSProvider(ctx, server.URL, 0, time.Second)
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name      string
+		aged      bool
+		publish   string
+		kid       string
+		wantReads int32
+		wantFound bool
+	}{
+		{name: "known key", kid: "k1", wantFound: true},
+		{name: "unknown key within the interval", kid: "k2"},
+		{name: "unknown key after the interval", aged: true, kid: "k2", wantReads: 1},
+		{name: "again right after a read", kid: "k2"},
+		{name: "rotated key", aged: true, publish: "k2", kid: "k2", wantReads: 1, wantFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.publish != "" {
+				server.publish(tt.publish)
+			}
+			if tt.aged {
+				age(p)
+			}
+			before := server.reads.Load()
+			// concurrent lookups share one read of the document
+			var wg sync.WaitGroup
+			errs := make([]error, 20)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, _, errs[i] = p.Key(ctx, tt.kid)
+				}(i)
+			}
+			wg.Wait()
+			if reads := server.reads.Load() - before; reads != tt.wantReads {
+				t.Errorf("reads = %d, want %d", reads, tt.wantReads)
+			}
+			for _, err := range errs {
+				if tt.wantFound && err != nil {
+					t.Fatalf("key: %v", err)
+				}
+				if !tt.wantFound && !errors.Is(err, ErrUnknownKey) {
+					t.Fatalf("err = %v, want %v", err, ErrUnknownKey)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckJWKSSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		source        string
+		allowInsecure bool
+		wantErr       bool
+	}{
+		{name: "file", source: "/etc/jwks.json"},
+		{name: "https url", source: "https://auth.smartpet.com/.well-known/jwks.json"},
+		{name: "http url", source: "http://auth.smartpet.com/.well-known/jwks.json", wantErr: true},
+		{name: "http url in upper case", source: "HTTP://auth.smartpet.com/jwks.json", wantErr: true},
+		{name: "http url allowed for local runs", source: "http://localhost:8080/jwks.json", allowInsecure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkJWKSSource(tt.source, tt.allowInsecure); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSProviderLargeDocument(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[],"padding":"`))
+		w.Write(make([]byte, jwksMaxBytes))
+	}))
+	defer server.Close()
+	if _, err := NewJWKSProvider(context.Background(), server.URL, 0, time.Second); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("err = %v, want the document refused for its size", err)
+	}
+}
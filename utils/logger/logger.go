@@ -126,6 +126,14 @@ func withIDAndPath(ctx context.Context, event *zerolog.Event) *zerolog.Event {
 	if correlationId != nil {
 		event.Interface(constant.CorrelationLogParam, correlationId)
 	}
+	s2sIssuer := ctx.Value(constant.S2SIssuerLogParam)
+	if s2sIssuer != nil {
+		event.Interface(constant.S2SIssuerLogParam, s2sIssuer)
+	}
+	actor := ctx.Value(constant.ActorLogParam)
+	if actor != nil {
+		event.Interface(constant.ActorLogParam, actor)
+	}
 	return event
 }
 
@@ -235,6 +243,25 @@ func ApplicationFatal(ctx context.Context) *zerolog.Event {
 	return addCategoryLog(event, ApplicationLog)
 }
 
+// ***********************AUDIT LOGS******************************
+
+// AuditInfo is the for info audit log
+func AuditInfo(ctx context.Context) *zerolog.Event {
+	event := addPartyCodeToLog(ctx, Info(ctx))
+	return addCategoryLog(event, LogTypeAudit)
+}
+
+// AuditWarn is the for warn audit log
+func AuditWarn(ctx context.Context) *zerolog.Event {
+	event := addPartyCodeToLog(ctx, Warn(ctx))
+	return addCategoryLog(event, LogTypeAudit)
+}
+
+// WithPartyCode returns a copy of the context whose logs carry the party code
+func WithPartyCode(ctx context.Context, partyCode string) context.Context {
+	return context.WithValue(ctx, partyCodeCtxKey, partyCode)
+}
+
 func addPartyCodeToLog(ctx context.Context, event *zerolog.Event) *zerolog.Event {
 	partyCode, ok := ctx.Value(partyCodeCtxKey).(string)
 	if ok {
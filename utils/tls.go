@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+	"github.com/smartpet/websocket/utils/configs"
+	log "github.com/smartpet/websocket/utils/logger"
+)
+
+// AEAD suites with forward secrecy, the ones of the modern cipher policy. TLS 1.3 suites are not configurable.
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// CertReloader serves the certificate of the TLS listener and the pool of the CAs of the client certificates,
+// reading the files again whenever they change on disk. The last good files are kept when reading fails.
+type CertReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCertReloader reads the files and checks them for changes every interval, clientCAFile is optional
+func NewCertReloader(certFile, keyFile, clientCAFile string, interval time.Duration) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		modTimes:     make(map[string]time.Time),
+		stop:         make(chan struct{}),
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go c.watch(interval)
+	}
+	return c, nil
+}
+
+// GetCertificate is the tls.Config hook serving the current certificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// ClientCAs returns the current pool of the CAs of the client certificates, nil without a client CA file
+func (c *CertReloader) ClientCAs() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientCAs
+}
+
+// Close stops watching the files
+func (c *CertReloader) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+func (c *CertReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				log.ApplicationError(context.Background()).Err(err).Str("certFile", c.certFile).Msg("error reloading tls certificates, keeping the previous ones")
+				continue
+			}
+			if reloaded {
+				log.ApplicationInfo(context.Background()).Str("certFile", c.certFile).Msg("tls certificates reloaded")
+			}
+		}
+	}
+}
+
+// reload reads the files when one of them changed since the last read, and tells if it did
+func (c *CertReloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time, 3)
+	changed := false
+	for _, file := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		c.mu.RLock()
+		changed = changed || !c.modTimes[file].Equal(info.ModTime())
+		c.mu.RUnlock()
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		data, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return false, errors.New("no certificate in " + c.clientCAFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert, c.clientCAs, c.modTimes = &cert, clientCAs, modTimes
+	c.mu.Unlock()
+	return true, nil
+}
+
+// TLSVersion returns the version of "1.2" or "1.3"
+func TLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown tls version %s", version)
+	}
+}
+
+// CipherSuites returns the TLS 1.2 suites of the policy, modern or compatible. Compatible adds the CBC suites
+// Go still considers secure, for older clients.
+func CipherSuites(policy string) ([]uint16, error) {
+	switch policy {
+	case constant.TLSCipherPolicyModern:
+		return modernCipherSuites, nil
+	case constant.TLSCipherPolicyCompatible:
+		suites := make([]uint16, 0, len(tls.CipherSuites()))
+		for _, s := range tls.CipherSuites() {
+			suites = append(suites, s.ID)
+		}
+		return suites, nil
+	default:
+		return nil, fmt.Errorf("unknown cipher policy %s", policy)
+	}
+}
+
+var certReloader *CertReloader
+
+// InitTLS returns the configurations of the public and the internal TLS listeners of the tls block of
+// application.yml, nil when no certificate is configured. Both serve the same certificate. Only the internal
+// listener asks for client certificates, and verifies them against the client CAs, when a client CA file is given;
+// it is up to the handlers to require one.
+func InitTLS(ctx context.Context) (public *tls.Config, internal *tls.Config, err error) {
+	certFile := os.ExpandEnv(configs.GetAppConfigD(constant.TLSCertFileKey, ""))
+	clientCAFile := os.ExpandEnv(configs.GetAppConfigD(constant.TLSClientCAFileKey, ""))
+	if err := checkMTLSMode(configs.GetAppConfigD(constant.PushMTLSModeKey, constant.MTLSOff), certFile, clientCAFile); err != nil {
+		return nil, nil, err
+	}
+	if certFile == "" {
+		return nil, nil, nil
+	}
+	keyFile := os.ExpandEnv(configs.GetAppConfigD(constant.TLSKeyFileKey, ""))
+	minVersion, err := TLSVersion(configs.GetAppConfigD(constant.TLSMinVersionKey, "1.2"))
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := CipherSuites(configs.GetAppConfigD(constant.TLSCipherPolicyKey, constant.TLSCipherPolicyModern))
+	if err != nil {
+		return nil, nil, err
+	}
+	interval := time.Duration(configs.GetAppConfigIntD(constant.TLSReloadIntervalInMillisKey, 60000)) * time.Millisecond
+	reloader, err := NewCertReloader(certFile, keyFile, clientCAFile, interval)
+	if err != nil {
+		return nil, nil, err
+	}
+	certReloader = reloader
+
+	public = &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: reloader.GetCertificate,
+	}
+	log.ApplicationInfo(ctx).Str("certFile", certFile).Bool("clientCerts", clientCAFile != "").Msg("tls loaded")
+	return public, internalTLSConfig(public, reloader, clientCAFile != ""), nil
+}
+
+// checkMTLSMode refuses an unknown client certificate mode of the push api, and a mode verifying certificates
+// without the certificate and client CAs it needs, rather than letting calls through unauthenticated
+func checkMTLSMode(mode, certFile, clientCAFile string) error {
+	switch mode {
+	case constant.MTLSOff:
+		return nil
+	case constant.MTLSOptional, constant.MTLSRequired:
+	default:
+		return fmt.Errorf("unknown mtls mode %s", mode)
+	}
+	if certFile == "" {
+		return fmt.Errorf("mtls mode %s needs %s", mode, constant.TLSCertFileKey)
+	}
+	if clientCAFile == "" {
+		return fmt.Errorf("mtls mode %s needs %s", mode, constant.TLSClientCAFileKey)
+	}
+	return nil
+}
+
+// internalTLSConfig returns the configuration of the internal listener, a copy of the public one asking for client
+// certificates when client CAs are configured. The pool of the client CAs is picked per handshake so it follows
+// the reloads.
+func internalTLSConfig(public *tls.Config, reloader *CertReloader, clientCerts bool) *tls.Config {
+	internal := public.Clone()
+	if !clientCerts {
+		return internal
+	}
+	internal.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := public.Clone()
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		cfg.ClientCAs = reloader.ClientCAs()
+		return cfg, nil
+	}
+	return internal
+}
+
+// CloseTLS stops watching the certificate files
+func CloseTLS() {
+	if certReloader != nil {
+		certReloader.Close()
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartpet/websocket/constant"
+)
+
+// writeCert writes a self-signed certificate of the common name and its key, dated so the files look modified
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER}} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "1.1", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := TLSVersion(tt.version)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("version = %x err = %v, want %x error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckMTLSMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		certFile     string
+		clientCAFile string
+		wantErr      string
+	}{
+		{name: "off without tls", mode: constant.MTLSOff},
+		{name: "optional", mode: constant.MTLSOptional, certFile: "cert.pem", clientCAFile: "ca.pem"},
+		{name: "required", mode: constant.MTLSRequired, certFile: "cert.pem", clientCAFile: "ca.pem"},
+		{name: "unknown mode", mode: "reqiured", certFile: "cert.pem", clientCAFile: "ca.pem", wantErr: "unknown mtls mode reqiured"},
+		{name: "required without tls", mode: constant.MTLSRequired, wantErr: constant.TLSCertFileKey},
+		{name: "optional without client CAs", mode: constant.MTLSOptional, certFile: "cert.pem", wantErr: constant.TLSClientCAFileKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMTLSMode(tt.mode, tt.certFile, tt.clientCAFile)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	insecure := make(map[uint16]bool)
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.ID] = true
+	}
+	tests := []struct {
+		policy   string
+		wantCBC  bool
+		wantErr  bool
+		minCount int
+	}{
+		{policy: constant.TLSCipherPolicyModern, minCount: 6},
+		{policy: constant.TLSCipherPolicyCompatible, wantCBC: true, minCount: 7},
+		{policy: "legacy", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			suites, err := CipherSuites(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if len(suites) < tt.minCount {
+				t.Errorf("%d suites, want at least %d", len(suites), tt.minCount)
+			}
+			cbc := false
+			for _, id := range suites {
+				if insecure[id] {
+					t.Errorf("insecure suite %s", tls.CipherSuiteName(id))
+				}
+				cbc = cbc || strings.Contains(tls.CipherSuiteName(id), "_CBC_")
+			}
+			if cbc != tt.wantCBC {
+				t.Errorf("cbc suites = %v, want %v", cbc, tt.wantCBC)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+	writeCert(t, caFile, filepath.Join(dir, "ca-key.pem"), "clients", start)
+	c, err := NewCertReloader(certFile, keyFile, caFile, 0)
+	if err != nil {
+		t.Fatalf("new reloader: %v", err)
+	}
+	defer c.Close()
+
+	steps := []struct {
+		name         string
+		change       func()
+		wantReloaded bool
+		wantErr      bool
+		wantCN       string
+	}{
+		{name: "files unchanged", change: func() {}, wantCN: "first"},
+		{name: "certificate renewed", change: func() { writeCert(t, certFile, keyFile, "second", start.Add(time.Minute)) },
+			wantReloaded: true, wantCN: "second"},
+		{name: "unreadable certificate", change: func() {
+			os.WriteFile(certFile, []byte("garbage"), 0o600)
+			os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+		}, wantErr: true, wantCN: "second"},
+		{name: "certificate fixed", change: func() { writeCert(t, certFile, keyFile, "third", start.Add(3*time.Minute)) },
+			wantReloaded: true, wantCN: "third"},
+		{name: "client CA without certificate", change: func() {
+			os.WriteFile(caFile, []byte("garbage"), 0o600)
+			os.Chtimes(caFile, start.Add(4*time.Minute), start.Add(4*time.Minute))
+		}, wantErr: true, wantCN: "third"},
+		{name: "certificate file gone", change: func() { os.Remove(certFile) }, wantErr: true, wantCN: "third"},
+	}
+	for _, step := range steps {
+		step.change()
+		reloaded, err := c.reload()
+		if reloaded != step.wantReloaded || (err != nil) != step.wantErr {
+			t.Fatalf("%s: reloaded = %v err = %v, want %v error %v", step.name, reloaded, err, step.wantReloaded, step.wantErr)
+		}
+		cert, _ := c.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("%s: parse: %v", step.name, err)
+		}
+		if leaf.Subject.CommonName != step.wantCN {
+			t.Errorf("%s: serving %s, want %s", step.name, leaf.Subject.CommonName, step.wantCN)
+		}
+		if c.ClientCAs() == nil {
+			t.Errorf("%s: client CAs dropped", step.name)
+		}
+	}
+}
+
+func TestInternalTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeCert(t, certFile, keyFile, "socket", time.Now())
+	writeCert(t, caFile, filepath.Join(dir, "ca-key.pem"), "services", time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile, caFile, 0)
+	if err != nil {
+		t.Fatalf("new reloader: %v", err)
+	}
+	t.Cleanup(reloader.Close)
+	public := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+
+	tests := []struct {
+		name           string
+		clientCerts    bool
+		wantClientAuth tls.ClientAuthType
+	}{
+		{name: "client CAs configured", clientCerts: true, wantClientAuth: tls.VerifyClientCertIfGiven},
+		{name: "no client CA", wantClientAuth: tls.NoClientCert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			internal := internalTLSConfig(public, reloader, tt.clientCerts)
+			cfg := internal
+			if internal.GetConfigForClient != nil {
+				if cfg, err = internal.GetConfigForClient(&tls.ClientHelloInfo{}); err != nil {
+					t.Fatalf("config for client: %v", err)
+				}
+			}
+			if cfg.ClientAuth != tt.wantClientAuth || (cfg.ClientCAs != nil) != tt.clientCerts || cfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("internal listener client auth %v with CAs %v, want %v", cfg.ClientAuth, cfg.ClientCAs != nil, tt.wantClientAuth)
+			}
+			// the public listener never asks for a client certificate
+			if public.GetConfigForClient != nil || public.ClientAuth != tls.NoClientCert || public.ClientCAs != nil {
+				t.Error("public listener asks for client certificates")
+			}
+		})
+	}
+}
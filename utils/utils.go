@@ -103,6 +103,29 @@ func JSONSuccessResponder(ctx *gin.Context, httpCode int, reqID, partycode, desc
 	})
 }
 
+// JSONResponder writes the response for the net/http handlers, the same way JSONSuccessResponder does for gin
+func JSONResponder(r *http.Request, w http.ResponseWriter, httpCode int, reqID, partycode, description string, reqStartTime time.Time, response interface{}) {
+	log.WithFields(log.Fields{
+		"reqID":      reqID,
+		"statusCode": httpCode,
+		"clientID":   partycode,
+		"latency":    time.Since(reqStartTime).Milliseconds(),
+		"publicIP":   r.RemoteAddr,
+		"method":     r.Method,
+		"url_path":   r.URL.Path,
+	}).Infoln(description)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpCode)
+	o, _ := json.Marshal(models.Response{
+		StatusCode:        httpCode,
+		StatusDescription: http.StatusText(httpCode),
+		Description:       description,
+		Response:          response,
+	})
+	w.Write(o)
+}
+
 func IsNumeric(s string) bool {
 	val, err := strconv.ParseFloat(s, 64)
 	if val <= 0 {